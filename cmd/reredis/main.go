@@ -13,6 +13,7 @@ import (
 	"github.com/121watts/reredis/internal/observer"
 	"github.com/121watts/reredis/internal/server"
 	"github.com/121watts/reredis/internal/store"
+	"github.com/121watts/reredis/internal/wal"
 )
 
 // main initializes and starts the Reredis server with both TCP and HTTP interfaces.
@@ -21,10 +22,32 @@ import (
 func main() {
 	tcpPort := flag.Int("port", 6379, "TCP port for Redis protocol")
 	httpPort := flag.Int("http-port", 8080, "HTTP port for WebSocket connections")
+	dir := flag.String("dir", ".", "Data directory for the WAL and other persistent files")
+	appendFsync := flag.String("appendfsync", "always", "WAL fsync policy: always, everysec or no")
+	autoRewritePct := flag.Int("auto-aof-rewrite-percentage", 100, "Rewrite the WAL after it grows by this percentage (0 disables)")
+	autoRewriteMinSize := flag.Int64("auto-aof-rewrite-min-size", 64<<20, "Minimum WAL size in bytes before automatic rewrites")
+	walRecovery := flag.String("wal-recovery", "fail", "How startup treats corrupt WAL records: fail, truncate or skip")
+	walSegmentSize := flag.Int64("wal-segment-size", wal.DefaultSegmentSize, "Size in bytes at which the active WAL segment is rotated")
+	maxBulkLen := flag.Int64("proto-max-bulk-len", server.DefaultMaxBulkLen, "Largest request argument in bytes that clients may send")
+	walMaxRecordSize := flag.Int64("wal-max-record-size", 0, "Largest WAL record in bytes that is written or replayed (0 derives it from proto-max-bulk-len)")
+	pubsubBufferLimit := flag.Int("pubsub-buffer-limit", server.DefaultPubSubBufferLimit, "Bytes of undelivered messages a pub/sub subscriber may fall behind by before it is disconnected")
+	notifyKeyspaceEvents := flag.String("notify-keyspace-events", "", "Keyspace notification classes to publish, as in Redis (for example KEA); empty disables them")
 	flag.Parse()
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
+	fsyncPolicy, err := wal.ParseFsyncPolicy(*appendFsync)
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	recoveryPolicy, err := wal.ParseRecoveryPolicy(*walRecovery)
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
 	// Create cluster manager
 	cm := cluster.NewManager("127.0.0.1", fmt.Sprintf("%d", *tcpPort))
 
@@ -37,14 +60,33 @@ func main() {
 	hub := observer.NewHub(logger)
 	go hub.Run()
 
+	// Replay the WAL before either listener starts so clients never see a partial store
+	handler, err := server.Open(server.Config{
+		Dir:                   *dir,
+		AppendFsync:           fsyncPolicy,
+		AutoRewritePercentage: *autoRewritePct,
+		AutoRewriteMinSize:    *autoRewriteMinSize,
+		WALRecovery:           recoveryPolicy,
+		WALSegmentSize:        *walSegmentSize,
+		MaxBulkLen:            *maxBulkLen,
+		WALMaxRecordSize:      *walMaxRecordSize,
+		PubSubBufferLimit:     *pubsubBufferLimit,
+		NotifyKeyspaceEvents:  *notifyKeyspaceEvents,
+	}, s, logger, hub, cm)
+	if err != nil {
+		logger.Error("recovery failed", "error", err)
+		os.Exit(1)
+	}
+	defer handler.Close()
+
 	go func() {
-		if err := server.Start(tcpAddr, s, logger, hub, cm); err != nil {
+		if err := server.Start(tcpAddr, handler, logger); err != nil {
 			logger.Error("server failed", "error", err)
 			os.Exit(1)
 		}
 	}()
 
-	if err := server.StartWebServer(httpAddr, hub, logger, s, cm); err != nil {
+	if err := server.StartWebServer(httpAddr, handler, logger); err != nil {
 		logger.Error("http server failed", "error", err)
 		os.Exit(1)
 	}
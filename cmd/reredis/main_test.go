@@ -2,29 +2,55 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/121watts/reredis/internal/cluster"
+	"github.com/121watts/reredis/internal/datadir"
 	"github.com/121watts/reredis/internal/observer"
+	"github.com/121watts/reredis/internal/query"
 	"github.com/121watts/reredis/internal/server"
 	"github.com/121watts/reredis/internal/store"
+	"github.com/121watts/reredis/internal/wal"
 	"github.com/gorilla/websocket"
 )
 
 func startTestServer(t *testing.T) string {
+	_, addr := startTestServerWithDir(t, t.TempDir(), store.NewStore(), cluster.NewManager("localhost", "6379"))
+	return addr
+}
+
+func startTestServerWithDir(t *testing.T, dir string, s *store.Store, cm *cluster.Manager) (*server.CommandHandler, string) {
+	t.Helper()
+	return startTestServerWithConfig(t, server.Config{Dir: dir}, s, cm)
+}
+
+func startTestServerWithConfig(t testing.TB, cfg server.Config, s *store.Store, cm *cluster.Manager) (*server.CommandHandler, string) {
+	t.Helper()
 	// For tests, we can discard log output to keep the test runner clean.
 	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
 	hub := observer.NewHub(logger)
 	go hub.Run()
-	s := store.NewStore()
-	cm := cluster.NewManager("localhost", "6379")
+
+	handler, err := server.Open(cfg, s, logger, hub, cm)
+	if err != nil {
+		t.Fatalf("failed to open server: %v", err)
+	}
+	t.Cleanup(func() { handler.Close() })
+
 	ln, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		t.Fatalf("failed to listen: %v", err)
@@ -32,7 +58,7 @@ func startTestServer(t *testing.T) string {
 	addr := ln.Addr().String()
 
 	go func() {
-		if err := server.StartWithListener(ln, s, logger, hub, cm); err != nil {
+		if err := server.StartWithListener(ln, handler, logger); err != nil {
 			t.Logf("Server exited with error: %v", err)
 		}
 	}()
@@ -43,12 +69,12 @@ func startTestServer(t *testing.T) string {
 		conn, err := net.Dial("tcp", addr)
 		if err == nil {
 			conn.Close()
-			return addr
+			return handler, addr
 		}
 		time.Sleep(retryDelay)
 	}
 	t.Fatalf("server did not start in time")
-	return addr
+	return handler, addr
 }
 
 func newConn(t *testing.T, addr string) net.Conn {
@@ -60,16 +86,43 @@ func newConn(t *testing.T, addr string) net.Conn {
 	return conn
 }
 
+// sendCommand sends one command and returns its complete raw RESP reply.
 func sendCommand(t *testing.T, conn net.Conn, cmd string) string {
 	_, err := fmt.Fprintf(conn, "%s\r\n", cmd)
 	if err != nil {
 		t.Fatalf("write failed: %v", err)
 	}
-	resp, err := bufio.NewReader(conn).ReadString('\n')
+	return readReply(t, bufio.NewReader(conn))
+}
+
+// readReply reads one RESP2 or RESP3 reply, including every element of an aggregate.
+func readReply(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	line, err := reader.ReadString('\n')
 	if err != nil {
 		t.Fatalf("read failed: %v", err)
 	}
-	return resp
+
+	var n int
+	switch line[0] {
+	case '$', '=':
+		if fmt.Sscanf(line[1:], "%d", &n); n >= 0 {
+			body := make([]byte, n+2)
+			if _, err := io.ReadFull(reader, body); err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			line += string(body)
+		}
+	case '*', '~', '>', '%':
+		fmt.Sscanf(line[1:], "%d", &n)
+		if line[0] == '%' {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			line += readReply(t, reader)
+		}
+	}
+	return line
 }
 
 func newWsConn(t *testing.T, url string) *websocket.Conn {
@@ -86,76 +139,1670 @@ func newWsConn(t *testing.T, url string) *websocket.Conn {
 	return conn
 }
 
-func TestIntegration(t *testing.T) {
-	addr := startTestServer(t)
+func TestIntegration(t *testing.T) {
+	addr := startTestServer(t)
+
+	t.Run("SET and GET", func(t *testing.T) {
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		setResp := sendCommand(t, conn, "SET foo bar")
+		if setResp != "+OK\r\n" {
+			t.Errorf("expected +OK, got %q", setResp)
+		}
+
+		getResp := sendCommand(t, conn, "GET foo")
+		if getResp != "$3\r\nbar\r\n" {
+			t.Errorf("expected '$3\\r\\nbar\\r\\n', got %q", getResp)
+		}
+	})
+
+	t.Run("GET non-existent key", func(t *testing.T) {
+		conn := newConn(t, addr)
+		defer conn.Close()
+		getNilResp := sendCommand(t, conn, "GET baz")
+		if getNilResp != "$-1\r\n" {
+			t.Errorf("expected null bulk string '$-1\\r\\n', got %q", getNilResp)
+		}
+	})
+
+	t.Run("errors match Redis", func(t *testing.T) {
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		if resp := sendCommand(t, conn, "GET"); resp != "-ERR wrong number of arguments for 'get' command\r\n" {
+			t.Errorf("unexpected arity error %q", resp)
+		}
+		if resp := sendCommand(t, conn, "FOO bar"); resp != "-ERR unknown command 'FOO', with args beginning with: 'bar' \r\n" {
+			t.Errorf("unexpected unknown command error %q", resp)
+		}
+	})
+
+	t.Run("DEL command", func(t *testing.T) {
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		// Set a key to ensure it exists before deleting
+		sendCommand(t, conn, "SET key-to-del value")
+
+		// Test deleting an existing key
+		delResp := sendCommand(t, conn, "DEL key-to-del")
+		if delResp != ":1\r\n" {
+			t.Errorf("expected ':1\\r\\n' when deleting existing key, got %q", delResp)
+		}
+
+		// Verify the key is gone
+		getAfterDelResp := sendCommand(t, conn, "GET key-to-del")
+		if getAfterDelResp != "$-1\r\n" {
+			t.Errorf("expected key not found after delete, got %q", getAfterDelResp)
+		}
+
+		// Test deleting a non-existent key
+		delNonExistentResp := sendCommand(t, conn, "DEL non-existent-key")
+		if delNonExistentResp != ":0\r\n" {
+			t.Errorf("expected ':0\\r\\n' when deleting non-existent key, got %q", delNonExistentResp)
+		}
+	})
+}
+
+func TestMultiBulkRequests(t *testing.T) {
+	s := store.NewStore()
+	_, addr := startTestServerWithDir(t, t.TempDir(), s, cluster.NewManager("localhost", "6379"))
+
+	t.Run("binary-safe arguments", func(t *testing.T) {
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		value := "line\r\nbreak \"quoted\"\x00"
+		request := string(wal.EncodeArray([]string{"SET", "multi bulk", value}))
+		if resp := sendCommand(t, conn, strings.TrimSuffix(request, "\r\n")); resp != "+OK\r\n" {
+			t.Fatalf("expected +OK for a multi-bulk SET, got %q", resp)
+		}
+		if got, ok := s.Get("multi bulk"); !ok || got != value {
+			t.Errorf("expected the value to be stored byte for byte, got ok=%v value=%q", ok, got)
+		}
+	})
+
+	t.Run("protocol errors close the connection", func(t *testing.T) {
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		if resp := sendCommand(t, conn, "*1\r\n$-5"); !strings.HasPrefix(resp, "-ERR Protocol error") {
+			t.Fatalf("expected a protocol error, got %q", resp)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected the server to close the connection, got %v", err)
+		}
+	})
+}
+
+func TestCommandIntrospection(t *testing.T) {
+	addr := startTestServer(t)
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	count := sendCommand(t, conn, "COMMAND COUNT")
+	if !strings.HasPrefix(count, ":") || count == ":0\r\n" {
+		t.Fatalf("expected a positive command count, got %q", count)
+	}
+	all := sendCommand(t, conn, "COMMAND")
+	if !strings.HasPrefix(all, "*"+count[1:]) {
+		t.Errorf("expected COMMAND to describe %s commands, got %q", strings.TrimSpace(count[1:]), all[:min(len(all), 20)])
+	}
+
+	info := sendCommand(t, conn, "COMMAND INFO get nosuchcommand")
+	wantGet := "*2\r\n*10\r\n$3\r\nget\r\n:2\r\n*2\r\n+readonly\r\n+fast\r\n:1\r\n:1\r\n:1\r\n*2\r\n+@read\r\n+@fast\r\n*0\r\n"
+	if !strings.HasPrefix(info, wantGet) || !strings.HasSuffix(info, "*0\r\n*-1\r\n") {
+		t.Errorf("unexpected COMMAND INFO reply %q", info)
+	}
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"COMMAND GETKEYS SET k v", "*1\r\n$1\r\nk\r\n"},
+		{"COMMAND GETKEYS SET k", "-ERR Invalid number of arguments specified for command\r\n"},
+		{"COMMAND GETKEYS INFO persistence", "-ERR The command has no key arguments\r\n"},
+		{"COMMAND GETKEYS NOPE k", "-ERR Invalid command specified\r\n"},
+		{"COMMAND NOPE", "-ERR unknown subcommand 'NOPE'. Try COMMAND HELP.\r\n"},
+		{"CLUSTER MEET host", "-ERR wrong number of arguments for 'cluster|meet' command\r\n"},
+	}
+	for _, tt := range tests {
+		if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+		}
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	cm := cluster.NewManager("localhost", "6379")
+	handler, addr := startTestServerWithDir(t, dir, s, cm)
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"SET lock owner1 NX EX 30", "+OK\r\n"},
+		{"SET lock owner2 NX EX 30", "$-1\r\n"},
+		{"SET lock owner3 NX GET", "$6\r\nowner1\r\n"},
+		{"SET missing v XX", "$-1\r\n"},
+		{"SET lock owner4 XX KEEPTTL GET", "$6\r\nowner1\r\n"},
+		{"SET fresh v GET", "$-1\r\n"},
+		{"SET gone v PXAT 1", "+OK\r\n"},
+		{"SET fresh v NX XX", "-ERR syntax error\r\n"},
+		{"SET fresh v EX 10 PX 10", "-ERR syntax error\r\n"},
+		{"SET fresh v EX 10 KEEPTTL", "-ERR syntax error\r\n"},
+		{"SET fresh v EX", "-ERR syntax error\r\n"},
+		{"SET fresh v BOGUS", "-ERR syntax error\r\n"},
+		{"SET fresh v EX ten", "-ERR value is not an integer or out of range\r\n"},
+		{"SET fresh v EX 0", "-ERR invalid expire time in 'set' command\r\n"},
+		{"SET fresh v EX 9223372036854775807", "-ERR invalid expire time in 'set' command\r\n"},
+	}
+	for _, tt := range tests {
+		if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+		}
+	}
+
+	if v, ok := s.Get("lock"); !ok || v != "owner4" {
+		t.Errorf("expected lock=owner4, got ok=%v value=%q", ok, v)
+	}
+	if _, ok := s.Get("gone"); ok {
+		t.Errorf("expected a deadline in the past to leave the key deleted")
+	}
+	if cm.Node.KeyCount != 2 {
+		t.Errorf("expected key count 2, got %d", cm.Node.KeyCount)
+	}
+
+	var deadline time.Time
+	for _, item := range s.Items() {
+		if item.Key == "lock" {
+			deadline = item.Expiration
+		}
+	}
+	if remaining := time.Until(deadline); remaining <= 25*time.Second || remaining > 30*time.Second {
+		t.Fatalf("expected KEEPTTL to keep the 30s expiration, got %v remaining", remaining)
+	}
+
+	t.Run("only one concurrent NX wins", func(t *testing.T) {
+		results := make(chan string, 10)
+		for i := 0; i < 10; i++ {
+			go func() {
+				c := newConn(t, addr)
+				defer c.Close()
+				results <- sendCommand(t, c, "SET race "+strconv.Itoa(i)+" NX")
+			}()
+		}
+
+		wins := 0
+		for i := 0; i < 10; i++ {
+			if <-results == "+OK\r\n" {
+				wins++
+			}
+		}
+		if wins != 1 {
+			t.Errorf("expected exactly one NX to succeed, got %d", wins)
+		}
+	})
+
+	t.Run("outcomes are replayed with absolute deadlines", func(t *testing.T) {
+		handler.Close()
+
+		s := store.NewStore()
+		restarted, _ := startTestServerWithDir(t, dir, s, cluster.NewManager("localhost", "6379"))
+		defer restarted.Close()
+
+		items := s.Items()
+		if len(items) != 3 {
+			t.Fatalf("expected lock, fresh and race after replay, got %+v", items)
+		}
+		for _, item := range items {
+			if item.Key == "lock" && (item.Value != "owner4" || !item.Expiration.Equal(deadline.Truncate(time.Millisecond))) {
+				t.Errorf("expected lock=owner4 expiring at %v after replay, got %+v", deadline, item)
+			}
+		}
+		if _, ok := s.Get("gone"); ok {
+			t.Errorf("expected gone to stay deleted after replay")
+		}
+	})
+}
+
+func TestExpire(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	cm := cluster.NewManager("localhost", "6379")
+	handler, addr := startTestServerWithDir(t, dir, s, cm)
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	sendCommand(t, conn, "SET session token")
+	sendCommand(t, conn, "SET doomed value")
+	sendCommand(t, conn, "SET permanent value EX 100")
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"TTL missing", ":-2\r\n"},
+		{"TTL session", ":-1\r\n"},
+		{"EXPIRETIME session", ":-1\r\n"},
+		{"EXPIRE missing 10", ":0\r\n"},
+		{"EXPIRE session 100 XX", ":0\r\n"},
+		{"EXPIRE session 100 GT", ":0\r\n"},
+		{"EXPIRE session 100 NX", ":1\r\n"},
+		{"TTL session", ":100\r\n"},
+		{"EXPIRE session 50 GT", ":0\r\n"},
+		{"PEXPIRE session 200000 GT", ":1\r\n"},
+		{"TTL session", ":200\r\n"},
+		{"EXPIRE session 300 XX LT", ":0\r\n"},
+		{"EXPIRE session 150 XX LT", ":1\r\n"},
+		{"EXPIREAT session 4102444800", ":1\r\n"},
+		{"EXPIRETIME session", ":4102444800\r\n"},
+		{"PEXPIRETIME session", ":4102444800000\r\n"},
+		{"PERSIST permanent", ":1\r\n"},
+		{"PERSIST permanent", ":0\r\n"},
+		{"PTTL permanent", ":-1\r\n"},
+		{"EXPIRE doomed 0", ":1\r\n"},
+		{"GET doomed", "$-1\r\n"},
+		{"EXPIRE session ten", "-ERR value is not an integer or out of range\r\n"},
+		{"EXPIRE session 10 NX XX", "-ERR NX and XX, GT or LT options at the same time are not compatible\r\n"},
+		{"EXPIRE session 10 GT LT", "-ERR GT and LT options at the same time are not compatible\r\n"},
+		{"EXPIRE session 10 SOON", "-ERR Unsupported option SOON\r\n"},
+		{"EXPIRE session 9223372036854775807", "-ERR invalid expire time in 'expire' command\r\n"},
+	}
+	for _, tt := range tests {
+		if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+		}
+	}
+
+	if cm.Node.KeyCount != 2 {
+		t.Errorf("expected key count 2 after EXPIRE deleted a key, got %d", cm.Node.KeyCount)
+	}
+
+	t.Run("expirations are replayed after a restart", func(t *testing.T) {
+		handler.Close()
+
+		s := store.NewStore()
+		restarted, addr := startTestServerWithDir(t, dir, s, cluster.NewManager("localhost", "6379"))
+		defer restarted.Close()
+
+		conn := newConn(t, addr)
+		defer conn.Close()
+		for _, tt := range []struct{ cmd, want string }{
+			{"PEXPIRETIME session", ":4102444800000\r\n"},
+			{"TTL permanent", ":-1\r\n"},
+			{"TTL doomed", ":-2\r\n"},
+		} {
+			if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+				t.Errorf("%s after restart: expected %q, got %q", tt.cmd, tt.want, got)
+			}
+		}
+	})
+}
+
+func TestCounters(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	handler, addr := startTestServerWithDir(t, dir, s, cluster.NewManager("localhost", "6379"))
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	sendCommand(t, conn, "SET text hello")
+	sendCommand(t, conn, "SET max 9223372036854775807")
+	sendCommand(t, conn, "SET limited 10 EX 100")
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"INCR hits", ":1\r\n"},
+		{"INCRBY hits 41", ":42\r\n"},
+		{"DECR hits", ":41\r\n"},
+		{"DECRBY hits 50", ":-9\r\n"},
+		{"GET hits", "$2\r\n-9\r\n"},
+		{"INCR text", "-ERR value is not an integer or out of range\r\n"},
+		{"INCRBY hits 1.5", "-ERR value is not an integer or out of range\r\n"},
+		{"INCR max", "-ERR increment or decrement would overflow\r\n"},
+		{"DECRBY hits -9223372036854775808", "-ERR decrement would overflow\r\n"},
+		{"INCR limited", ":11\r\n"},
+		{"TTL limited", ":100\r\n"},
+		{"INCRBYFLOAT price 10.5", "$4\r\n10.5\r\n"},
+		{"INCRBYFLOAT price 0.1", "$4\r\n10.6\r\n"},
+		{"INCRBYFLOAT price 5.0e3", "$6\r\n5010.6\r\n"},
+		{"INCRBYFLOAT price abc", "-ERR value is not a valid float\r\n"},
+		{"INCRBYFLOAT text 1", "-ERR value is not a valid float\r\n"},
+		{"INCRBYFLOAT price inf", "-ERR value is not a valid float\r\n"},
+		{"SET huge 1.7e308", "+OK\r\n"},
+		{"INCRBYFLOAT huge 1.7e308", "-ERR increment would produce NaN or Infinity\r\n"},
+	}
+	for _, tt := range tests {
+		if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+		}
+	}
+
+	t.Run("concurrent increments are not lost", func(t *testing.T) {
+		done := make(chan struct{})
+		for i := 0; i < 10; i++ {
+			go func() {
+				defer func() { done <- struct{}{} }()
+				c := newConn(t, addr)
+				defer c.Close()
+				for j := 0; j < 20; j++ {
+					sendCommand(t, c, "INCR concurrent")
+				}
+			}()
+		}
+		for i := 0; i < 10; i++ {
+			<-done
+		}
+
+		if v, _ := s.Get("concurrent"); v != "200" {
+			t.Errorf("expected 200 after 10 clients made 20 increments each, got %q", v)
+		}
+	})
+
+	t.Run("results are replayed as the values they produced", func(t *testing.T) {
+		handler.Close()
+
+		s := store.NewStore()
+		restarted, _ := startTestServerWithDir(t, dir, s, cluster.NewManager("localhost", "6379"))
+		defer restarted.Close()
+
+		for k, want := range map[string]string{"hits": "-9", "price": "5010.6", "limited": "11", "concurrent": "200"} {
+			if v, _ := s.Get(k); v != want {
+				t.Errorf("expected %s=%s after replay, got %q", k, want, v)
+			}
+		}
+		for _, item := range s.Items() {
+			if item.Key == "limited" && item.Expiration.IsZero() {
+				t.Errorf("expected limited to keep its expiration after replay")
+			}
+		}
+	})
+}
+
+func TestMultiKeyCommands(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	cm := cluster.NewManager("localhost", "6379")
+	_, addr := startTestServerWithDir(t, dir, s, cm)
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"MSET a 1 b 2 a 3", "+OK\r\n"},
+		{"MGET a b missing", "*3\r\n$1\r\n3\r\n$1\r\n2\r\n$-1\r\n"},
+		{"MSETNX b 9 c 9", ":0\r\n"},
+		{"GET c", "$-1\r\n"},
+		{"MSETNX c 4 d 5", ":1\r\n"},
+		{"MGET c d", "*2\r\n$1\r\n4\r\n$1\r\n5\r\n"},
+		{"SET e 6", "+OK\r\n"},
+		{"DEL e missing e", ":1\r\n"},
+		{"DEL missing", ":0\r\n"},
+		{"MSET a 1 b", "-ERR wrong number of arguments for 'mset' command\r\n"},
+		{"MGET", "-ERR wrong number of arguments for 'mget' command\r\n"},
+		{"DEL", "-ERR wrong number of arguments for 'del' command\r\n"},
+	}
+	for _, tt := range tests {
+		if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+		}
+	}
+	if cm.Node.KeyCount != 4 {
+		t.Errorf("expected key count 4, got %d", cm.Node.KeyCount)
+	}
+
+	t.Run("MSET and DEL are one WAL record each", func(t *testing.T) {
+		reader, err := wal.NewReader(activeSegment(t, filepath.Join(dir, "wal")), wal.ReaderOptions{})
+		if err != nil {
+			t.Fatalf("failed to open WAL: %v", err)
+		}
+		defer reader.Close()
+
+		var logged []string
+		for {
+			entry, err := reader.ReadEntry()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("failed to read WAL: %v", err)
+			}
+			logged = append(logged, strings.Join(entry.Command, " "))
+		}
+
+		want := []string{"MSET a 1 b 2 a 3", "MSET c 4 d 5", "SET e 6", "DEL e missing e"}
+		if strings.Join(logged, "|") != strings.Join(want, "|") {
+			t.Errorf("expected WAL records %q, got %q", want, logged)
+		}
+	})
+
+	t.Run("keys must share a slot in a cluster", func(t *testing.T) {
+		cm := cluster.NewManager("localhost", "6379")
+		cm.AddNode("localhost", "6380")
+		cm.AddNode("localhost", "6381")
+		_, addr := startTestServerWithDir(t, t.TempDir(), store.NewStore(), cm)
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		var tag string
+		for i := 0; tag == ""; i++ {
+			candidate := fmt.Sprintf("{user%d}", i)
+			if slot := cluster.CalculateSlot(candidate); slot >= cm.Node.Slot.Start && slot <= cm.Node.Slot.End {
+				tag = candidate
+			}
+		}
+
+		if got := sendCommand(t, conn, "MSET "+tag+":name ann "+tag+":email ann@example.com"); got != "+OK\r\n" {
+			t.Errorf("expected keys with one hash tag to be set together, got %q", got)
+		}
+		if got := sendCommand(t, conn, "MGET "+tag+":name {other}:name"); got != "-CROSSSLOT Keys in request don't hash to the same slot\r\n" {
+			t.Errorf("expected CROSSSLOT for keys in different slots, got %q", got)
+		}
+	})
+}
+
+func TestStringEditing(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	cm := cluster.NewManager("localhost", "6379")
+	_, addr := startTestServerWithDir(t, dir, s, cm)
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"APPEND greeting Hello", ":5\r\n"},
+		{"APPEND greeting \" World\"", ":11\r\n"},
+		{"STRLEN greeting", ":11\r\n"},
+		{"STRLEN missing", ":0\r\n"},
+		{"GETRANGE greeting 0 4", "$5\r\nHello\r\n"},
+		{"GETRANGE greeting -5 -1", "$5\r\nWorld\r\n"},
+		{"GETRANGE greeting 6 100", "$5\r\nWorld\r\n"},
+		{"GETRANGE greeting 5 2", "$0\r\n\r\n"},
+		{"GETRANGE greeting -1 -5", "$0\r\n\r\n"},
+		{"GETRANGE missing 0 -1", "$0\r\n\r\n"},
+		{"SETRANGE greeting 6 Redis", ":11\r\n"},
+		{"GET greeting", "$11\r\nHello Redis\r\n"},
+		{"SETRANGE padded 3 abc", ":6\r\n"},
+		{"GET padded", "$6\r\n\x00\x00\x00abc\r\n"},
+		{strings.TrimSuffix(string(wal.EncodeArray([]string{"SETRANGE", "empty", "5", ""})), "\r\n"), ":0\r\n"},
+		{"SETRANGE padded -1 x", "-ERR offset is out of range\r\n"},
+		{"SETRANGE padded 536870911 xx", "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n"},
+		{"GETSET greeting Bye", "$11\r\nHello Redis\r\n"},
+		{"GETSET fresh v", "$-1\r\n"},
+		{"GETDEL fresh", "$1\r\nv\r\n"},
+		{"GETDEL fresh", "$-1\r\n"},
+		{"GETEX greeting EX 100", "$3\r\nBye\r\n"},
+		{"TTL greeting", ":100\r\n"},
+		{"GETEX greeting PERSIST", "$3\r\nBye\r\n"},
+		{"TTL greeting", ":-1\r\n"},
+		{"GETEX greeting PERSIST", "$3\r\nBye\r\n"},
+		{"GETEX missing PERSIST", "$-1\r\n"},
+		{"GETEX greeting", "$3\r\nBye\r\n"},
+		{"GETEX missing EX 10", "$-1\r\n"},
+		{"GETEX greeting EX 10 PERSIST", "-ERR syntax error\r\n"},
+		{"GETEX greeting EX 0", "-ERR invalid expire time in 'getex' command\r\n"},
+	}
+	for _, tt := range tests {
+		if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+		}
+	}
+
+	if _, ok := s.Get("empty"); ok {
+		t.Errorf("expected SETRANGE with an empty value not to create the key")
+	}
+	want := int64(len("greeting") + len("Bye") + len("padded") + 6)
+	if cm.Node.KeyCount != 2 || cm.Node.ByteSize != want {
+		t.Errorf("expected 2 keys and %d bytes, got %d keys and %d bytes", want, cm.Node.KeyCount, cm.Node.ByteSize)
+	}
+
+	t.Run("GETEX PERSIST logs only a removed expiration", func(t *testing.T) {
+		reader, err := wal.NewReader(activeSegment(t, filepath.Join(dir, "wal")), wal.ReaderOptions{})
+		if err != nil {
+			t.Fatalf("failed to open WAL: %v", err)
+		}
+		defer reader.Close()
+
+		var persists int
+		for {
+			entry, err := reader.ReadEntry()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("failed to read WAL: %v", err)
+			}
+			if entry.Command[0] == "PERSIST" {
+				persists++
+			}
+		}
+		if persists != 1 {
+			t.Errorf("expected one PERSIST record, got %d", persists)
+		}
+	})
+}
+
+func TestKeyspaceCommands(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	cm := cluster.NewManager("localhost", "6379")
+	handler, addr := startTestServerWithDir(t, dir, s, cm)
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	sendCommand(t, conn, "MSET a 1 b 2 c 3")
+	sendCommand(t, conn, "SET session token EXAT 4102444800")
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"EXISTS a b missing a", ":3\r\n"},
+		{"TOUCH a missing", ":1\r\n"},
+		{"TYPE a", "+string\r\n"},
+		{"TYPE missing", "+none\r\n"},
+		{"RENAME session login", "+OK\r\n"},
+		{"EXISTS session", ":0\r\n"},
+		{"GET login", "$5\r\ntoken\r\n"},
+		{"EXPIRETIME login", ":4102444800\r\n"},
+		{"RENAME missing other", "-ERR no such key\r\n"},
+		{"RENAME a a", "+OK\r\n"},
+		{"RENAMENX a b", ":0\r\n"},
+		{"RENAMENX a a", ":0\r\n"},
+		{"RENAMENX a d", ":1\r\n"},
+		{"RENAME d b", "+OK\r\n"},
+		{"GET b", "$1\r\n1\r\n"},
+		{"COPY login backup", ":1\r\n"},
+		{"EXPIRETIME backup", ":4102444800\r\n"},
+		{"COPY b c", ":0\r\n"},
+		{"COPY b c REPLACE", ":1\r\n"},
+		{"GET c", "$1\r\n1\r\n"},
+		{"COPY missing c", ":0\r\n"},
+		{"COPY b b", "-ERR source and destination objects are the same\r\n"},
+		{"COPY b e DB 1", "-ERR DB index is out of range\r\n"},
+		{"COPY b e DB 0", ":1\r\n"},
+		{"COPY b f SOMEWHERE", "-ERR syntax error\r\n"},
+		{"UNLINK e missing c", ":2\r\n"},
+		{"EXISTS e c", ":0\r\n"},
+	}
+	for _, tt := range tests {
+		if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+		}
+	}
+
+	// b, login and backup remain
+	want := int64(len("b") + 1 + len("login") + len("token") + len("backup") + len("token"))
+	if cm.Node.KeyCount != 3 || cm.Node.ByteSize != want {
+		t.Errorf("expected 3 keys and %d bytes, got %d keys and %d bytes", want, cm.Node.KeyCount, cm.Node.ByteSize)
+	}
+
+	t.Run("RANDOMKEY", func(t *testing.T) {
+		if got := sendCommand(t, conn, "RANDOMKEY"); got != "$1\r\nb\r\n" && got != "$5\r\nlogin\r\n" && got != "$6\r\nbackup\r\n" {
+			t.Errorf("expected one of the existing keys, got %q", got)
+		}
+
+		empty := newConn(t, startTestServer(t))
+		defer empty.Close()
+		if got := sendCommand(t, empty, "RANDOMKEY"); got != "$-1\r\n" {
+			t.Errorf("expected a null reply without keys, got %q", got)
+		}
+	})
+
+	t.Run("renames are replayed after a restart", func(t *testing.T) {
+		// The source expires before the restart, so replay must not leave the
+		// destination's old value behind
+		sendCommand(t, conn, "SET short lived PX 100")
+		sendCommand(t, conn, "SET target old")
+		if got := sendCommand(t, conn, "RENAME short target"); got != "+OK\r\n" {
+			t.Fatalf("RENAME failed: %q", got)
+		}
+		time.Sleep(150 * time.Millisecond)
+		handler.Close()
+
+		restarted, addr := startTestServerWithDir(t, dir, store.NewStore(), cluster.NewManager("localhost", "6379"))
+		defer restarted.Close()
+
+		conn := newConn(t, addr)
+		defer conn.Close()
+		for _, tt := range []struct{ cmd, want string }{
+			{"GET b", "$1\r\n1\r\n"},
+			{"EXISTS a c d e session target", ":0\r\n"},
+			{"GET backup", "$5\r\ntoken\r\n"},
+			{"EXPIRETIME login", ":4102444800\r\n"},
+		} {
+			if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+				t.Errorf("%s after restart: expected %q, got %q", tt.cmd, tt.want, got)
+			}
+		}
+	})
+
+	t.Run("keys must share a slot in a cluster", func(t *testing.T) {
+		cm := cluster.NewManager("localhost", "6379")
+		cm.AddNode("localhost", "6380")
+		cm.AddNode("localhost", "6381")
+		_, addr := startTestServerWithDir(t, t.TempDir(), store.NewStore(), cm)
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		var tag string
+		for i := 0; tag == ""; i++ {
+			candidate := fmt.Sprintf("{user%d}", i)
+			if slot := cluster.CalculateSlot(candidate); slot >= cm.Node.Slot.Start && slot <= cm.Node.Slot.End {
+				tag = candidate
+			}
+		}
+
+		sendCommand(t, conn, "SET "+tag+":name ann")
+		if got := sendCommand(t, conn, "RENAME "+tag+":name "+tag+":fullname"); got != "+OK\r\n" {
+			t.Errorf("expected keys with one hash tag to be renamed, got %q", got)
+		}
+		if got := sendCommand(t, conn, "COPY "+tag+":fullname {other}:name"); got != "-CROSSSLOT Keys in request don't hash to the same slot\r\n" {
+			t.Errorf("expected CROSSSLOT for keys in different slots, got %q", got)
+		}
+	})
+}
+
+// parseScanReply splits a SCAN reply into its cursor and keys.
+func parseScanReply(t *testing.T, reply string) (string, []string) {
+	t.Helper()
+	lines := strings.Split(strings.TrimSuffix(reply, "\r\n"), "\r\n")
+	if len(lines) < 4 || lines[0] != "*2" {
+		t.Fatalf("malformed SCAN reply %q", reply)
+	}
+
+	var keys []string
+	for i := 5; i < len(lines); i += 2 {
+		keys = append(keys, lines[i])
+	}
+	return lines[2], keys
+}
+
+func TestScan(t *testing.T) {
+	s := store.NewStore()
+	_, addr := startTestServerWithDir(t, t.TempDir(), s, cluster.NewManager("localhost", "6379"))
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	want := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		k := fmt.Sprintf("user:%d", i)
+		s.Set(k, "v")
+		want[k] = true
+	}
+	s.Set("session:1", "v")
+
+	t.Run("iterates every key", func(t *testing.T) {
+		seen := make(map[string]bool)
+		cursor := "0"
+		for {
+			var keys []string
+			cursor, keys = parseScanReply(t, sendCommand(t, conn, "SCAN "+cursor+" MATCH user:* COUNT 7"))
+			for _, k := range keys {
+				seen[k] = true
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+		if len(seen) != len(want) {
+			t.Errorf("expected %d keys matching user:*, got %d: %v", len(want), len(seen), seen)
+		}
+		for k := range want {
+			if !seen[k] {
+				t.Errorf("key %q was never returned", k)
+			}
+		}
+	})
+
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"KEYS session:*", "*1\r\n$9\r\nsession:1\r\n"},
+		{"KEYS nothing*", "*0\r\n"},
+		{"SCAN 0 TYPE hash COUNT 1000", "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{"SCAN 0 MATCH session:? COUNT 1000", "*2\r\n$1\r\n0\r\n*1\r\n$9\r\nsession:1\r\n"},
+		{"SCAN abc", "-ERR invalid cursor\r\n"},
+		{"SCAN 0 COUNT 0", "-ERR syntax error\r\n"},
+		{"SCAN 0 COUNT many", "-ERR value is not an integer or out of range\r\n"},
+		{"SCAN 0 MATCH", "-ERR syntax error\r\n"},
+	}
+	for _, tt := range tests {
+		if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+		}
+	}
+
+	if got := sendCommand(t, conn, "SCAN 0 TYPE string COUNT 1000"); !strings.HasPrefix(got, "*2\r\n$1\r\n0\r\n*51\r\n") {
+		t.Errorf("expected every key to be a string, got %q", got)
+	}
+}
+
+func TestScanCursorStability(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		doomed int // Keys that change may delete
+		change func(s *store.Store, round int)
+	}{
+		{"while the store grows", 0, func(s *store.Store, round int) {
+			// Stay under the store's size limit so LRU eviction removes no keys
+			for i := 0; i < 40 && round < 20; i++ {
+				s.Set(fmt.Sprintf("new:%d:%d", round, i), "v")
+			}
+		}},
+		{"while the store shrinks", 800, func(s *store.Store, round int) {
+			for i := 0; i < 40; i++ {
+				s.Delete(fmt.Sprintf("doomed:%d", round*40+i))
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := store.NewStore()
+			for i := 0; i < 100; i++ {
+				s.Set(fmt.Sprintf("stable:%d", i), "v")
+			}
+			for i := 0; i < tc.doomed; i++ {
+				s.Set(fmt.Sprintf("doomed:%d", i), "v")
+			}
+
+			seen := make(map[string]bool)
+			var cursor uint64
+			for round := 0; ; round++ {
+				var keys []string
+				keys, cursor = s.Scan(cursor, 10)
+				for _, k := range keys {
+					seen[k] = true
+				}
+				if cursor == 0 {
+					break
+				}
+				tc.change(s, round)
+			}
+
+			for i := 0; i < 100; i++ {
+				if k := fmt.Sprintf("stable:%d", i); !seen[k] {
+					t.Errorf("key %q was present throughout but never returned", k)
+				}
+			}
+		})
+	}
+}
+
+func TestKeysEndpoint(t *testing.T) {
+	s := store.NewStore()
+	_, url := startTestWebServer(t, t.TempDir(), s, cluster.NewManager("localhost", "6379"))
+	for i := 0; i < 95; i++ {
+		s.Set(fmt.Sprintf("key:%d", i), "v")
+	}
+
+	seen := make(map[string]bool)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 95 {
+			t.Fatal("pagination did not finish")
+		}
+
+		resp, err := http.Get(url + "/api/v1/keys?limit=20&cursor=" + cursor)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		var page query.PaginationResult
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode page: %v", err)
+		}
+
+		for _, k := range page.Keys {
+			seen[k] = true
+		}
+		if page.HasMore && len(page.Keys) < 20 {
+			t.Errorf("expected a full page before the last, got %d keys", len(page.Keys))
+		}
+		if !page.HasMore {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(seen) != 95 {
+		t.Errorf("expected 95 keys across all pages, got %d", len(seen))
+	}
+
+	resp, err := http.Get(url + "/api/v1/keys?cursor=bogus")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid cursor, got %d", resp.StatusCode)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	dir := t.TempDir()
+	s := store.NewStore()
+	cm := cluster.NewManager("localhost", "6379")
+	handler, addr := startTestServerWithDir(t, dir, s, cm)
+	conn := newConn(t, addr)
+	defer conn.Close()
+	other := newConn(t, addr)
+	defer other.Close()
+
+	sendCommand(t, conn, "MSET alice 100 bob 20")
+
+	tests := []struct {
+		conn net.Conn
+		cmd  string
+		want string
+	}{
+		{conn, "EXEC", "-ERR EXEC without MULTI\r\n"},
+		{conn, "DISCARD", "-ERR DISCARD without MULTI\r\n"},
+
+		// Moving a balance between two keys
+		{conn, "MULTI", "+OK\r\n"},
+		{conn, "MULTI", "-ERR MULTI calls can not be nested\r\n"},
+		{conn, "DECRBY alice 30", "+QUEUED\r\n"},
+		{conn, "INCRBY bob 30", "+QUEUED\r\n"},
+		{other, "GET bob", "$2\r\n20\r\n"},
+		{conn, "EXEC", "*2\r\n:70\r\n:50\r\n"},
+
+		// Errors while queueing abort the transaction
+		{conn, "MULTI", "+OK\r\n"},
+		{conn, "SET alice 0", "+QUEUED\r\n"},
+		{conn, "INCRBY bob", "-ERR wrong number of arguments for 'incrby' command\r\n"},
+		{conn, "WATCH alice", "-ERR Command not allowed inside a transaction\r\n"},
+		{conn, "EXEC", "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{conn, "GET alice", "$2\r\n70\r\n"},
+
+		// Errors while running do not stop the other commands
+		{conn, "MULTI", "+OK\r\n"},
+		{conn, "SET note hello", "+QUEUED\r\n"},
+		{conn, "INCR note", "+QUEUED\r\n"},
+		{conn, "EXEC", "*2\r\n+OK\r\n-ERR value is not an integer or out of range\r\n"},
+
+		{conn, "MULTI", "+OK\r\n"},
+		{conn, "DEL note", "+QUEUED\r\n"},
+		{conn, "DISCARD", "+OK\r\n"},
+		{conn, "GET note", "$5\r\nhello\r\n"},
+
+		// WATCH aborts EXEC when another client changes a watched key
+		{conn, "WATCH alice bob", "+OK\r\n"},
+		{other, "INCR bob", ":51\r\n"},
+		{conn, "MULTI", "+OK\r\n"},
+		{conn, "SET alice 0", "+QUEUED\r\n"},
+		{conn, "EXEC", "*-1\r\n"},
+		{conn, "GET alice", "$2\r\n70\r\n"},
+
+		// EXEC releases the watched keys, and unchanged keys let it run
+		{other, "INCR bob", ":52\r\n"},
+		{conn, "WATCH alice", "+OK\r\n"},
+		{other, "GET alice", "$2\r\n70\r\n"},
+		{conn, "MULTI", "+OK\r\n"},
+		{conn, "SET alice 0", "+QUEUED\r\n"},
+		{conn, "EXEC", "*1\r\n+OK\r\n"},
+
+		// A watched key that is deleted, or that expires, counts as changed
+		{conn, "WATCH note", "+OK\r\n"},
+		{other, "DEL note", ":1\r\n"},
+		{conn, "MULTI", "+OK\r\n"},
+		{conn, "EXEC", "*-1\r\n"},
+		{conn, "SET fleeting v PX 50", "+OK\r\n"},
+		{conn, "WATCH fleeting", "+OK\r\n"},
+	}
+	for _, tt := range tests {
+		if got := sendCommand(t, tt.conn, tt.cmd); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	sendCommand(t, conn, "MULTI")
+	if got := sendCommand(t, conn, "EXEC"); got != "*-1\r\n" {
+		t.Errorf("expected EXEC to abort after a watched key expired, got %q", got)
+	}
+
+	t.Run("a transaction is one WAL record", func(t *testing.T) {
+		reader, err := wal.NewReader(activeSegment(t, filepath.Join(dir, "wal")), wal.ReaderOptions{})
+		if err != nil {
+			t.Fatalf("failed to open WAL: %v", err)
+		}
+		defer reader.Close()
+
+		var execs []string
+		for {
+			entry, err := reader.ReadEntry()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("failed to read WAL: %v", err)
+			}
+			if entry.Command[0] == "EXEC" {
+				execs = append(execs, strings.Join(entry.Command, " "))
+			}
+		}
+
+		want := []string{
+			"EXEC 3 SET alice 70 3 SET bob 50",
+			"EXEC 3 SET note hello",
+			"EXEC 3 SET alice 0",
+		}
+		if strings.Join(execs, "|") != strings.Join(want, "|") {
+			t.Errorf("expected EXEC records %q, got %q", want, execs)
+		}
+	})
+
+	t.Run("transactions are replayed after a restart", func(t *testing.T) {
+		handler.Close()
+
+		restarted, addr := startTestServerWithDir(t, dir, store.NewStore(), cluster.NewManager("localhost", "6379"))
+		defer restarted.Close()
+
+		conn := newConn(t, addr)
+		defer conn.Close()
+		if got := sendCommand(t, conn, "MGET alice bob note"); got != "*3\r\n$1\r\n0\r\n$2\r\n52\r\n$-1\r\n" {
+			t.Errorf("unexpected values after restart: %q", got)
+		}
+	})
+
+	t.Run("other clients never see part of a transaction", func(t *testing.T) {
+		addr := startTestServer(t)
+		conn := newConn(t, addr)
+		defer conn.Close()
+		sendCommand(t, conn, "MSET a 0 b 0")
+
+		// Read both counters from another connection for as long as the
+		// transactions run; they must always be equal
+		reader := newConn(t, addr)
+		defer reader.Close()
+		stop := make(chan struct{})
+		torn := make(chan string, 1)
+		go func() {
+			defer close(torn)
+			br := bufio.NewReader(reader)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				io.WriteString(reader, "MGET a b\r\n")
+				var lines []string
+				for i := 0; i < 5; i++ {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					lines = append(lines, line)
+				}
+				if lines[2] != lines[4] {
+					torn <- strings.Join(lines, "")
+					return
+				}
+			}
+		}()
+
+		br := bufio.NewReader(conn)
+		batch := strings.Repeat("MULTI\r\nINCR a\r\nINCR b\r\nEXEC\r\n", 20)
+		for i := 0; i < 50; i++ {
+			io.WriteString(conn, batch)
+			for j := 0; j < 4*20; j++ {
+				readReply(t, br)
+			}
+		}
+		close(stop)
+
+		if reply, ok := <-torn; ok {
+			t.Errorf("saw a partly applied transaction: %q", reply)
+		}
+		if got := sendCommand(t, conn, "MGET a b"); got != "*2\r\n$4\r\n1000\r\n$4\r\n1000\r\n" {
+			t.Errorf("expected both counters at 1000, got %q", got)
+		}
+	})
+
+	t.Run("a transaction whose record is too large is discarded", func(t *testing.T) {
+		cfg := server.Config{Dir: t.TempDir(), WALMaxRecordSize: 4096}
+		_, addr := startTestServerWithConfig(t, cfg, store.NewStore(), cluster.NewManager("localhost", "6379"))
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		sendCommand(t, conn, "SET a 1")
+		sendCommand(t, conn, "MULTI")
+		sendCommand(t, conn, "INCR a")
+		sendCommand(t, conn, "SET big "+strings.Repeat("x", 5000))
+		if got := sendCommand(t, conn, "EXEC"); !strings.HasPrefix(got, "-EXECABORT") || !strings.Contains(got, "record too large") {
+			t.Errorf("expected EXECABORT for a record over the limit, got %q", got)
+		}
+
+		// None of the batch may run, not even the writes that would fit on their own
+		if got := sendCommand(t, conn, "MGET a big"); got != "*2\r\n$1\r\n1\r\n$-1\r\n" {
+			t.Errorf("expected the discarded transaction to change nothing, got %q", got)
+		}
+		if got := sendCommand(t, conn, "SET a 2"); got != "+OK\r\n" {
+			t.Errorf("expected writes to go on after the discarded transaction, got %q", got)
+		}
+	})
+
+	t.Run("keys must share a slot in a cluster", func(t *testing.T) {
+		cm := cluster.NewManager("localhost", "6379")
+		cm.AddNode("localhost", "6380")
+		cm.AddNode("localhost", "6381")
+		_, addr := startTestServerWithDir(t, t.TempDir(), store.NewStore(), cm)
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		var tag string
+		for i := 0; tag == ""; i++ {
+			candidate := fmt.Sprintf("{user%d}", i)
+			if slot := cluster.CalculateSlot(candidate); slot >= cm.Node.Slot.Start && slot <= cm.Node.Slot.End {
+				tag = candidate
+			}
+		}
+		var other string
+		for i := 0; other == ""; i++ {
+			candidate := fmt.Sprintf("{account%d}", i)
+			if slot := cluster.CalculateSlot(candidate); slot >= cm.Node.Slot.Start && slot <= cm.Node.Slot.End && slot != cluster.CalculateSlot(tag) {
+				other = candidate
+			}
+		}
+
+		for _, tt := range []struct{ cmd, want string }{
+			{"MULTI", "+OK\r\n"},
+			{"SET " + tag + ":a 1", "+QUEUED\r\n"},
+			{"SET " + tag + ":b 2", "+QUEUED\r\n"},
+			{"EXEC", "*2\r\n+OK\r\n+OK\r\n"},
+			{"MULTI", "+OK\r\n"},
+			{"SET " + tag + ":a 1", "+QUEUED\r\n"},
+			{"SET " + other + ":a 1", "-CROSSSLOT Keys in request don't hash to the same slot\r\n"},
+			{"EXEC", "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		} {
+			if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+				t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+			}
+		}
+	})
+}
+
+func TestPipelining(t *testing.T) {
+	addr := startTestServer(t)
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	// A whole batch in one write, with a partial request at the end that only
+	// completes after the replies to the earlier commands have arrived
+	batch := "SET a 1\r\nGET a\r\n" + string(wal.EncodeArray([]string{"DEL", "a"})) + "GET a\r\n*2\r\n$3\r\nGET\r\n"
+	if _, err := io.WriteString(conn, batch); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"+OK\r\n", "$1\r\n1\r\n", ":1\r\n", "$-1\r\n"} {
+		if got := readReply(t, reader); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+
+	if _, err := io.WriteString(conn, "$1\r\na\r\n"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if got := readReply(t, reader); got != "$-1\r\n" {
+		t.Errorf("expected the completed request to be answered, got %q", got)
+	}
+}
+
+// BenchmarkPipeline measures SET throughput when clients send batches of commands
+// and wait for all the replies before sending the next batch.
+func BenchmarkPipeline(b *testing.B) {
+	// Sync once a second so the benchmark measures the protocol rather than the disk
+	cfg := server.Config{Dir: b.TempDir(), AppendFsync: wal.FsyncEverySec}
+	_, addr := startTestServerWithConfig(b, cfg, store.NewStore(), cluster.NewManager("localhost", "6379"))
+
+	for _, depth := range []int{1, 16, 128} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatalf("could not connect to server: %v", err)
+			}
+			defer conn.Close()
+
+			var batch []byte
+			for i := 0; i < depth; i++ {
+				batch = append(batch, wal.EncodeArray([]string{"SET", "key:" + strconv.Itoa(i), "value"})...)
+			}
+			reader := bufio.NewReader(conn)
+
+			b.ResetTimer()
+			for sent := 0; sent < b.N; sent += depth {
+				if _, err := conn.Write(batch); err != nil {
+					b.Fatalf("write failed: %v", err)
+				}
+				for i := 0; i < depth; i++ {
+					if line, err := reader.ReadString('\n'); err != nil || line != "+OK\r\n" {
+						b.Fatalf("unexpected reply %q: %v", line, err)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "cmds/s")
+		})
+	}
+}
+
+func TestHello(t *testing.T) {
+	addr := startTestServer(t)
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	sendCommand(t, conn, "SET hello world")
+
+	if resp := sendCommand(t, conn, "HELLO 4"); resp != "-NOPROTO unsupported protocol version\r\n" {
+		t.Errorf("expected NOPROTO for an unknown version, got %q", resp)
+	}
+	if resp := sendCommand(t, conn, "HELLO 3 AUTH admin secret"); !strings.HasPrefix(resp, "-WRONGPASS") {
+		t.Errorf("expected WRONGPASS for an unknown user, got %q", resp)
+	}
+	if resp := sendCommand(t, conn, "GET missing"); resp != "$-1\r\n" {
+		t.Errorf("expected a failed HELLO to leave RESP2 in place, got %q", resp)
+	}
+
+	resp := sendCommand(t, conn, "HELLO 3 AUTH default anything SETNAME loader")
+	if !strings.HasPrefix(resp, "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n") || !strings.Contains(resp, "$5\r\nproto\r\n:3\r\n") {
+		t.Fatalf("expected a RESP3 map describing the server, got %q", resp)
+	}
+
+	if resp := sendCommand(t, conn, "GET missing"); resp != "_\r\n" {
+		t.Errorf("expected the RESP3 null after HELLO 3, got %q", resp)
+	}
+	if resp := sendCommand(t, conn, "GET hello"); resp != "$5\r\nworld\r\n" {
+		t.Errorf("expected bulk strings to be unchanged under RESP3, got %q", resp)
+	}
+	if resp := sendCommand(t, conn, "INFO persistence"); !strings.HasPrefix(resp, "=") || !strings.Contains(resp, "txt:# Persistence") {
+		t.Errorf("expected INFO as a verbatim string under RESP3, got %q", resp)
+	}
+
+	if resp := sendCommand(t, conn, "HELLO 2"); !strings.HasPrefix(resp, "*14\r\n") {
+		t.Errorf("expected HELLO 2 to reply with a flat array, got %q", resp)
+	}
+	if resp := sendCommand(t, conn, "GET missing"); resp != "$-1\r\n" {
+		t.Errorf("expected the RESP2 null after HELLO 2, got %q", resp)
+	}
+
+	sendCommand(t, conn, "MULTI")
+	sendCommand(t, conn, "HELLO 3")
+	if resp := sendCommand(t, conn, "EXEC"); !strings.HasPrefix(resp, "*1\r\n%7\r\n") {
+		t.Errorf("expected EXEC to reply with HELLO's RESP3 map, got %q", resp)
+	}
+	if resp := sendCommand(t, conn, "GET missing"); resp != "_\r\n" {
+		t.Errorf("expected HELLO inside a transaction to switch to RESP3, got %q", resp)
+	}
+}
+
+// encodeRecord frames a command as a WAL record, failing the test if it cannot be.
+func encodeRecord(t *testing.T, cmd []string) []byte {
+	t.Helper()
+	record, err := wal.EncodeRecord(cmd)
+	if err != nil {
+		t.Fatalf("failed to encode WAL record: %v", err)
+	}
+	return record
+}
+
+// activeSegment returns the path of the WAL segment currently receiving appends.
+func activeSegment(t *testing.T, walDir string) string {
+	t.Helper()
+	manifest, err := wal.ReadManifest(walDir)
+	if err != nil {
+		t.Fatalf("failed to read WAL manifest: %v", err)
+	}
+	return filepath.Join(walDir, wal.SegmentName(manifest.ActiveSegment))
+}
+
+func TestWALRecovery(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, datadir.WALDirName)
+
+	handler, addr := startTestServerWithDir(t, dir, store.NewStore(), cluster.NewManager("localhost", "6379"))
+	conn := newConn(t, addr)
+	sendCommand(t, conn, "SET user:1 alice")
+	sendCommand(t, conn, "SET user:2 bob")
+	sendCommand(t, conn, "SET user:1 carol")
+	sendCommand(t, conn, "DEL user:2")
+	conn.Close()
+
+	t.Run("data directory is locked while in use", func(t *testing.T) {
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		_, err := server.Open(server.Config{Dir: dir}, store.NewStore(), logger, nil, cluster.NewManager("localhost", "6380"))
+		if !errors.Is(err, datadir.ErrLocked) {
+			t.Fatalf("expected datadir.ErrLocked for a second node on the same dir, got %v", err)
+		}
+	})
+
+	// Simulate a restart by releasing the directory before reopening it
+	handler.Close()
+
+	t.Run("restart restores store and cluster counters", func(t *testing.T) {
+		s := store.NewStore()
+		cm := cluster.NewManager("localhost", "6379")
+		handler, addr := startTestServerWithDir(t, dir, s, cm)
+		defer handler.Close()
+
+		if v, ok := s.Get("user:1"); !ok || v != "carol" {
+			t.Errorf("expected user:1=carol after replay, got ok=%v value=%q", ok, v)
+		}
+		if _, ok := s.Get("user:2"); ok {
+			t.Errorf("expected user:2 to stay deleted after replay")
+		}
+		if cm.Node.KeyCount != 1 {
+			t.Errorf("expected key count 1 after replay, got %d", cm.Node.KeyCount)
+		}
+		if cm.Node.ByteSize != int64(len("user:1")+len("carol")) {
+			t.Errorf("expected byte size %d after replay, got %d", len("user:1")+len("carol"), cm.Node.ByteSize)
+		}
+
+		conn := newConn(t, addr)
+		defer conn.Close()
+		if resp := sendCommand(t, conn, "GET user:1"); resp != "$5\r\ncarol\r\n" {
+			t.Errorf("expected carol as a bulk string, got %q", resp)
+		}
+	})
+
+	t.Run("torn final record is truncated", func(t *testing.T) {
+		walPath := activeSegment(t, walDir)
+		before, err := os.Stat(walPath)
+		if err != nil {
+			t.Fatalf("failed to stat WAL: %v", err)
+		}
+
+		f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("failed to open WAL: %v", err)
+		}
+		f.Write(encodeRecord(t, []string{"SET", "torn", "value"})[:20])
+		f.Close()
+
+		s := store.NewStore()
+		handler, _ := startTestServerWithDir(t, dir, s, cluster.NewManager("localhost", "6379"))
+		defer handler.Close()
+
+		if _, ok := s.Get("torn"); ok {
+			t.Errorf("torn record should not be applied")
+		}
+		if v, ok := s.Get("user:1"); !ok || v != "carol" {
+			t.Errorf("expected records before the torn one to survive, got ok=%v value=%q", ok, v)
+		}
+
+		after, err := os.Stat(walPath)
+		if err != nil {
+			t.Fatalf("failed to stat WAL: %v", err)
+		}
+		if after.Size() != before.Size() {
+			t.Errorf("expected WAL truncated to %d bytes, got %d", before.Size(), after.Size())
+		}
+	})
+
+	t.Run("expirations are replayed as absolute deadlines", func(t *testing.T) {
+		ttlDir := t.TempDir()
+		future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+		past := strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10)
+		var log []byte
+		for _, cmd := range [][]string{
+			{"SET", "session", "token", "PXAT", future},
+			{"SET", "stale", "old"},
+			{"SET", "stale", "new", "PXAT", past},
+		} {
+			log = append(log, encodeRecord(t, cmd)...)
+		}
+		if err := os.WriteFile(filepath.Join(ttlDir, datadir.LegacyWALFileName), log, 0644); err != nil {
+			t.Fatalf("failed to write WAL: %v", err)
+		}
+
+		s := store.NewStore()
+		cm := cluster.NewManager("localhost", "6379")
+		handler, _ := startTestServerWithDir(t, ttlDir, s, cm)
+		defer handler.Close()
+
+		if _, ok := s.Get("stale"); ok {
+			t.Errorf("expected a key whose deadline passed while down to be dropped")
+		}
+		if cm.Node.KeyCount != 1 {
+			t.Errorf("expected key count 1 after dropping the expired key, got %d", cm.Node.KeyCount)
+		}
+
+		items := s.Items()
+		if len(items) != 1 || items[0].Key != "session" || strconv.FormatInt(items[0].Expiration.UnixMilli(), 10) != future {
+			t.Errorf("expected session to expire at %s, got %+v", future, items)
+		}
+	})
+
+	t.Run("single-file WAL from older versions is adopted", func(t *testing.T) {
+		legacyDir := t.TempDir()
+		legacy := append(wal.EncodeArray([]string{"SET", "old", "1"}), encodeRecord(t, []string{"SET", "new", "2"})...)
+		if err := os.WriteFile(filepath.Join(legacyDir, datadir.LegacyWALFileName), legacy, 0644); err != nil {
+			t.Fatalf("failed to write legacy WAL: %v", err)
+		}
+
+		s := store.NewStore()
+		handler, _ := startTestServerWithDir(t, legacyDir, s, cluster.NewManager("localhost", "6379"))
+		defer handler.Close()
+
+		for k, want := range map[string]string{"old": "1", "new": "2"} {
+			if got, ok := s.Get(k); !ok || got != want {
+				t.Errorf("expected %s=%s from the legacy WAL, got ok=%v value=%q", k, want, ok, got)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(legacyDir, datadir.LegacyWALFileName)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected legacy WAL to be moved into the segment directory, got %v", err)
+		}
+	})
+
+	t.Run("records over the size limit are refused", func(t *testing.T) {
+		limitDir := t.TempDir()
+		cfg := server.Config{Dir: limitDir, WALMaxRecordSize: 4096}
+		handler, addr := startTestServerWithConfig(t, cfg, store.NewStore(), cluster.NewManager("localhost", "6379"))
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		sendCommand(t, conn, "SET small value")
+		sendCommand(t, conn, "SET grow "+strings.Repeat("x", 3000))
+		for _, cmd := range []string{
+			"SET big " + strings.Repeat("x", 5000),
+			"MSET small other big " + strings.Repeat("x", 5000),
+			"APPEND grow " + strings.Repeat("x", 1000),
+		} {
+			if resp := sendCommand(t, conn, cmd); !strings.Contains(resp, "record too large") {
+				t.Errorf("expected a write over the record limit to fail, got %q", resp)
+			}
+		}
+
+		// A refused write must not be applied either, or the store would hold data the
+		// WAL never saw
+		for _, tt := range []struct{ cmd, want string }{
+			{"GET small", "$5\r\nvalue\r\n"},
+			{"EXISTS big", ":0\r\n"},
+			{"STRLEN grow", ":3000\r\n"},
+		} {
+			if got := sendCommand(t, conn, tt.cmd); got != tt.want {
+				t.Errorf("%s: expected %q, got %q", tt.cmd, tt.want, got)
+			}
+		}
+		handler.Close()
+
+		s := store.NewStore()
+		// Replay applies the same limit, so it would refuse to start had the record been written
+		handler, _ = startTestServerWithConfig(t, cfg, s, cluster.NewManager("localhost", "6379"))
+		defer handler.Close()
+		if got, ok := s.Get("small"); !ok || got != "value" {
+			t.Errorf("expected small=value after restart, got ok=%v value=%q", ok, got)
+		}
+	})
+
+	t.Run("refused key moves leave the keys in place", func(t *testing.T) {
+		cfg := server.Config{Dir: t.TempDir(), WALMaxRecordSize: 4096}
+		_, addr := startTestServerWithConfig(t, cfg, store.NewStore(), cluster.NewManager("localhost", "6379"))
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		sendCommand(t, conn, "MSET a 1 b 2")
+		long := strings.Repeat("k", 5000)
+		for _, cmd := range []string{"DEL a b " + long, "UNLINK a " + long, "RENAME a " + long, "COPY b " + long} {
+			if resp := sendCommand(t, conn, cmd); !strings.Contains(resp, "record too large") {
+				t.Errorf("%s: expected the record to be refused, got %q", strings.Fields(cmd)[0], resp)
+			}
+		}
+		if got := sendCommand(t, conn, "MGET a b"); got != "*2\r\n$1\r\n1\r\n$1\r\n2\r\n" {
+			t.Errorf("expected a and b to survive the refused writes, got %q", got)
+		}
+	})
+}
+
+func TestInfoPersistence(t *testing.T) {
+	addr := startTestServer(t)
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	sendCommand(t, conn, "SET info-key value")
+
+	fmt.Fprintf(conn, "INFO persistence\r\n")
+	reader := bufio.NewReader(conn)
+	header, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(header, "$") {
+		t.Fatalf("expected bulk string header, got %q (err %v)", header, err)
+	}
+
+	var length int
+	fmt.Sscanf(header, "$%d", &length)
+	body := make([]byte, length+2)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		t.Fatalf("failed to read INFO body: %v", err)
+	}
+
+	info := string(body)
+	for _, field := range []string{"aof_fsync_policy:always", "aof_pending_bytes:0", "aof_fsync_lag_ms:0"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("expected INFO to contain %q, got %q", field, info)
+		}
+	}
+}
+
+// waitForRewrite polls the WAL manifest until a rewrite has installed a base.
+func waitForRewrite(t *testing.T, walDir string) {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		if manifest, err := wal.ReadManifest(walDir); err == nil && manifest.Base != "" {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("WAL was not rewritten in time")
+}
+
+func TestWALRewrite(t *testing.T) {
+	t.Run("BGREWRITEAOF compacts the log", func(t *testing.T) {
+		dir := t.TempDir()
+		walDir := filepath.Join(dir, datadir.WALDirName)
+		handler, addr := startTestServerWithDir(t, dir, store.NewStore(), cluster.NewManager("localhost", "6379"))
+
+		conn := newConn(t, addr)
+		defer conn.Close()
+		for i := 0; i < 100; i++ {
+			sendCommand(t, conn, fmt.Sprintf("SET counter %d", i))
+		}
+		sendCommand(t, conn, "SET other value")
+
+		before, _ := os.Stat(activeSegment(t, walDir))
+		if resp := sendCommand(t, conn, "BGREWRITEAOF"); resp != "+Background append only file rewriting started\r\n" {
+			t.Fatalf("unexpected BGREWRITEAOF response %q", resp)
+		}
+		waitForRewrite(t, walDir)
+		if _, err := os.Stat(filepath.Join(walDir, wal.SegmentName(1))); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected the %d-byte segment covered by the rewrite to be deleted, got %v", before.Size(), err)
+		}
+		sendCommand(t, conn, "SET after rewrite")
+		handler.Close()
+
+		s := store.NewStore()
+		handler, _ = startTestServerWithDir(t, dir, s, cluster.NewManager("localhost", "6379"))
+		defer handler.Close()
+
+		expected := map[string]string{"counter": "99", "other": "value", "after": "rewrite"}
+		for k, want := range expected {
+			if got, ok := s.Get(k); !ok || got != want {
+				t.Errorf("expected %s=%s after rewrite and restart, got ok=%v value=%q", k, want, ok, got)
+			}
+		}
+	})
+
+	t.Run("rewrite keeps expirations", func(t *testing.T) {
+		dir := t.TempDir()
+		walDir := filepath.Join(dir, datadir.WALDirName)
+		s := store.NewStore()
+		handler, addr := startTestServerWithDir(t, dir, s, cluster.NewManager("localhost", "6379"))
+
+		expiration := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+		s.SetWithExpiration("session", "token", expiration)
 
-	t.Run("SET and GET", func(t *testing.T) {
 		conn := newConn(t, addr)
 		defer conn.Close()
+		sendCommand(t, conn, "BGREWRITEAOF")
+		waitForRewrite(t, walDir)
+		handler.Close()
 
-		setResp := sendCommand(t, conn, "SET foo bar")
-		if setResp != "+OK\r\n" {
-			t.Errorf("expected +OK, got %q", setResp)
-		}
+		restored := store.NewStore()
+		handler, _ = startTestServerWithDir(t, dir, restored, cluster.NewManager("localhost", "6379"))
+		defer handler.Close()
 
-		getResp := sendCommand(t, conn, "GET foo")
-		if getResp != "bar\r\n" {
-			t.Errorf("expected 'bar\\r\\n', got %q", getResp)
+		items := restored.Items()
+		if len(items) != 1 || !items[0].Expiration.Equal(expiration) {
+			t.Errorf("expected session to keep expiration %v after rewrite, got %+v", expiration, items)
 		}
 	})
 
-	t.Run("GET non-existent key", func(t *testing.T) {
+	t.Run("automatic rewrite on growth", func(t *testing.T) {
+		dir := t.TempDir()
+		walDir := filepath.Join(dir, datadir.WALDirName)
+		cfg := server.Config{Dir: dir, AutoRewritePercentage: 100, AutoRewriteMinSize: 2048}
+		_, addr := startTestServerWithConfig(t, cfg, store.NewStore(), cluster.NewManager("localhost", "6379"))
+
 		conn := newConn(t, addr)
 		defer conn.Close()
-		getNilResp := sendCommand(t, conn, "GET baz")
-		if getNilResp != "-ERR key not found\r\n" {
-			t.Errorf("expected '-ERR key not found\\r\\n', got %q", getNilResp)
+
+		// Each overwrite is ~35 bytes, so the log crosses the minimum size partway through
+		for i := 0; i < 100; i++ {
+			sendCommand(t, conn, fmt.Sprintf("SET counter %d", i))
 		}
+
+		waitForRewrite(t, walDir)
 	})
+}
 
-	t.Run("DEL command", func(t *testing.T) {
-		conn := newConn(t, addr)
-		defer conn.Close()
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, datadir.WALDirName)
+	s := store.NewStore()
+	handler, addr := startTestServerWithDir(t, dir, s, cluster.NewManager("localhost", "6379"))
 
-		// Set a key to ensure it exists before deleting
-		sendCommand(t, conn, "SET key-to-del value")
+	conn := newConn(t, addr)
+	defer conn.Close()
+	for i := 0; i < 100; i++ {
+		sendCommand(t, conn, fmt.Sprintf("SET counter %d", i))
+	}
+	sendCommand(t, conn, "SET other value")
+	s.SetWithTTL("session", "token", time.Hour)
+	s.SetWithTTL("short", "lived", 100*time.Millisecond)
 
-		// Test deleting an existing key
-		delResp := sendCommand(t, conn, "DEL key-to-del")
-		if delResp != ":1\r\n" {
-			t.Errorf("expected ':1\\r\\n' when deleting existing key, got %q", delResp)
+	var started int64
+	fmt.Sscanf(sendCommand(t, conn, "LASTSAVE"), ":%d", &started)
+
+	if resp := sendCommand(t, conn, "SAVE"); resp != "+OK\r\n" {
+		t.Fatalf("unexpected SAVE response %q", resp)
+	}
+
+	manifest, err := wal.ReadManifest(walDir)
+	if err != nil || manifest.BaseFormat != wal.BaseSnapshot || manifest.FirstSegment != 2 {
+		t.Fatalf("expected a snapshot base followed by segment 2, got %+v (err %v)", manifest, err)
+	}
+	if _, err := os.Stat(filepath.Join(walDir, wal.SegmentName(1))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the segment covered by the snapshot to be deleted, got %v", err)
+	}
+
+	var saved int64
+	fmt.Sscanf(sendCommand(t, conn, "LASTSAVE"), ":%d", &saved)
+	if saved < started {
+		t.Errorf("expected LASTSAVE to advance from %d after SAVE, got %d", started, saved)
+	}
+
+	sendCommand(t, conn, "SET after snapshot")
+	if resp := sendCommand(t, conn, "BGSAVE"); resp != "+Background saving started\r\n" {
+		t.Fatalf("unexpected BGSAVE response %q", resp)
+	}
+	for i := 0; i < 50 && manifest.FirstSegment == 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if m, err := wal.ReadManifest(walDir); err == nil {
+			manifest = m
 		}
+	}
+	if manifest.FirstSegment != 3 {
+		t.Fatalf("expected BGSAVE to replace the base and segment 2, got %+v", manifest)
+	}
+	sendCommand(t, conn, "SET after bgsave")
 
-		// Verify the key is gone
-		getAfterDelResp := sendCommand(t, conn, "GET key-to-del")
-		if getAfterDelResp != "-ERR key not found\r\n" {
-			t.Errorf("expected key not found after delete, got %q", getAfterDelResp)
+	// Let the short-lived key expire while the node is down
+	time.Sleep(150 * time.Millisecond)
+	handler.Close()
+
+	restored := store.NewStore()
+	cm := cluster.NewManager("localhost", "6379")
+	handler, _ = startTestServerWithDir(t, dir, restored, cm)
+	defer handler.Close()
+
+	expected := map[string]string{"counter": "99", "other": "value", "session": "token", "after": "bgsave"}
+	for k, want := range expected {
+		if got, ok := restored.Get(k); !ok || got != want {
+			t.Errorf("expected %s=%s after loading the snapshot, got ok=%v value=%q", k, want, ok, got)
 		}
+	}
+	if _, ok := restored.Get("short"); ok {
+		t.Errorf("expected a key that expired while the node was down to be dropped")
+	}
+	if cm.Node.KeyCount != len(expected) {
+		t.Errorf("expected key count %d after loading the snapshot, got %d", len(expected), cm.Node.KeyCount)
+	}
 
-		// Test deleting a non-existent key
-		delNonExistentResp := sendCommand(t, conn, "DEL non-existent-key")
-		if delNonExistentResp != ":0\r\n" {
-			t.Errorf("expected ':0\\r\\n' when deleting non-existent key, got %q", delNonExistentResp)
+	session := false
+	for _, item := range restored.Items() {
+		if item.Key == "session" {
+			session = time.Until(item.Expiration) > 59*time.Minute
 		}
-	})
+	}
+	if !session {
+		t.Errorf("expected session to keep its expiration across the snapshot")
+	}
 }
 
-func TestWebsocketIntegration(t *testing.T) {
+// startTestWebServer opens a handler on dir and serves its HTTP and WebSocket API.
+func startTestWebServer(t *testing.T, dir string, s *store.Store, cm *cluster.Manager) (*server.CommandHandler, string) {
+	t.Helper()
 	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
 	hub := observer.NewHub(logger)
 	go hub.Run()
-	s := store.NewStore()
-	cm := cluster.NewManager("localhost", "6379")
 
-	// Start an httptest server for WebSockets
-	httpHandler := server.NewHTTPHandler(hub, s, cm, logger)
-	httpServer := httptest.NewServer(httpHandler)
+	handler, err := server.Open(server.Config{Dir: dir}, s, logger, hub, cm)
+	if err != nil {
+		t.Fatalf("failed to open server: %v", err)
+	}
+	t.Cleanup(func() { handler.Close() })
+
+	httpServer := httptest.NewServer(server.NewHTTPHandler(handler, logger))
 	t.Cleanup(httpServer.Close)
 
+	return handler, httpServer.URL
+}
+
+func TestWebsocketIntegration(t *testing.T) {
+	s := store.NewStore()
+	cm := cluster.NewManager("localhost", "6379")
+	_, url := startTestWebServer(t, t.TempDir(), s, cm)
+
 	t.Run("SET command via WebSocket broadcasts correctly", func(t *testing.T) {
 		// Create two clients to check broadcast logic
-		clientA := newWsConn(t, httpServer.URL)
-		clientB := newWsConn(t, httpServer.URL)
+		clientA := newWsConn(t, url)
+		clientB := newWsConn(t, url)
 
 		// Client A sends a SET command
 		cmd := observer.CommandMessage{Action: "set", Key: "ws-test", Value: "success"}
@@ -175,7 +1822,7 @@ func TestWebsocketIntegration(t *testing.T) {
 	})
 
 	t.Run("GET_ALL command via WebSocket returns full store", func(t *testing.T) {
-		client := newWsConn(t, httpServer.URL)
+		client := newWsConn(t, url)
 		// Pre-populate the store with some data for the test
 		s.Set("sync-key-1", "sync-val-1")
 		s.Set("sync-key-2", "sync-val-2")
@@ -204,6 +1851,143 @@ func TestWebsocketIntegration(t *testing.T) {
 	})
 }
 
+func TestRenameBroadcasts(t *testing.T) {
+	handler, url := startTestWebServer(t, t.TempDir(), store.NewStore(), cluster.NewManager("localhost", "6379"))
+	client := newWsConn(t, url)
+
+	if _, _, err := handler.HandleSet([]string{"SET", "old", "value"}); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	if _, err := handler.HandleRename([]string{"RENAME", "old", "new"}); err != nil {
+		t.Fatalf("RENAME failed: %v", err)
+	}
+	if _, err := handler.HandleCopy([]string{"COPY", "new", "copy"}); err != nil {
+		t.Fatalf("COPY failed: %v", err)
+	}
+
+	want := []observer.UpdateMessage{
+		{Action: "set", Key: "old", Value: "value"},
+		{Action: "del", Key: "old"},
+		{Action: "set", Key: "new", Value: "value"},
+		{Action: "set", Key: "copy", Value: "value"},
+	}
+	for _, w := range want {
+		var got observer.UpdateMessage
+		if err := client.ReadJSON(&got); err != nil {
+			t.Fatalf("failed to read broadcast: %v", err)
+		}
+		if got.Action != w.Action || got.Key != w.Key || got.Value != w.Value {
+			t.Errorf("expected %+v, got %+v", w, got)
+		}
+	}
+}
+
+func TestWebsocketMutationPath(t *testing.T) {
+	t.Run("writes are logged and counted", func(t *testing.T) {
+		dir := t.TempDir()
+		cm := cluster.NewManager("localhost", "6379")
+		handler, url := startTestWebServer(t, dir, store.NewStore(), cm)
+
+		client := newWsConn(t, url)
+		for _, cmd := range []observer.CommandMessage{
+			{Action: "set", Key: "kept", Value: "value"},
+			{Action: "set", Key: "dropped", Value: "value"},
+			{Action: "del", Key: "dropped"},
+		} {
+			if err := client.WriteJSON(cmd); err != nil {
+				t.Fatalf("failed to send command: %v", err)
+			}
+			var update observer.UpdateMessage
+			if err := client.ReadJSON(&update); err != nil || update.Action != cmd.Action {
+				t.Fatalf("expected a %s broadcast, got %+v (err %v)", cmd.Action, update, err)
+			}
+		}
+
+		if cm.Node.KeyCount != 1 {
+			t.Errorf("expected WebSocket writes to update the key count to 1, got %d", cm.Node.KeyCount)
+		}
+		handler.Close()
+
+		s := store.NewStore()
+		handler, _ = startTestServerWithDir(t, dir, s, cluster.NewManager("localhost", "6379"))
+		defer handler.Close()
+
+		if v, ok := s.Get("kept"); !ok || v != "value" {
+			t.Errorf("expected WebSocket SET to survive a restart, got ok=%v value=%q", ok, v)
+		}
+		if _, ok := s.Get("dropped"); ok {
+			t.Errorf("expected WebSocket DEL to survive a restart")
+		}
+	})
+
+	t.Run("keys owned by another node are redirected", func(t *testing.T) {
+		cm := cluster.NewManager("localhost", "6379")
+		cm.AddNode("localhost", "6380")
+		cm.AddNode("localhost", "6381")
+		s := store.NewStore()
+		_, url := startTestWebServer(t, t.TempDir(), s, cm)
+
+		var key string
+		for i := 0; key == ""; i++ {
+			candidate := fmt.Sprintf("key-%d", i)
+			if slot := cluster.CalculateSlot(candidate); slot < cm.Node.Slot.Start || slot > cm.Node.Slot.End {
+				key = candidate
+			}
+		}
+		owner := cm.GetNodeForSlots(cluster.CalculateSlot(key))
+
+		client := newWsConn(t, url)
+		if err := client.WriteJSON(observer.CommandMessage{Action: "set", Key: key, Value: "value"}); err != nil {
+			t.Fatalf("failed to send command: %v", err)
+		}
+
+		var moved observer.MovedMessage
+		if err := client.ReadJSON(&moved); err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		if moved.Action != "moved" || moved.Slot != cluster.CalculateSlot(key) || moved.Port != owner.Port {
+			t.Errorf("expected a moved message pointing at port %s, got %+v", owner.Port, moved)
+		}
+		if _, ok := s.Get(key); ok {
+			t.Errorf("expected a redirected SET not to be stored locally")
+		}
+	})
+}
+
+func TestRandomKey(t *testing.T) {
+	s := store.NewStore()
+	if _, ok := s.RandomKey(); ok {
+		t.Fatal("expected no key from an empty store")
+	}
+
+	keys := []string{"a", "b", "c", "d"}
+	for _, k := range keys {
+		s.Set(k, "v")
+	}
+	s.SetWithTTL("expired", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	const samples = 4000
+	counts := make(map[string]int)
+	for i := 0; i < samples; i++ {
+		k, ok := s.RandomKey()
+		if !ok {
+			t.Fatal("expected a key")
+		}
+		counts[k]++
+	}
+
+	// Each key is expected samples/4 times; allow a wide margin against flakes
+	for _, k := range keys {
+		if n := counts[k]; n < samples/8 || n > samples*3/8 {
+			t.Errorf("key %q chosen %d times out of %d, expected about %d", k, n, samples, samples/len(keys))
+		}
+	}
+	if counts["expired"] != 0 {
+		t.Errorf("expected expired keys never to be chosen, got %d", counts["expired"])
+	}
+}
+
 func TestTTLAndLRU(t *testing.T) {
 	_ = slog.New(slog.NewTextHandler(io.Discard, nil))
 
@@ -402,3 +2186,386 @@ func TestTTLAndLRU(t *testing.T) {
 		}
 	})
 }
+
+func TestPubSub(t *testing.T) {
+	addr := startTestServer(t)
+
+	// send writes a command and reads n replies from the connection's own reader, so
+	// pushes that arrive together are not lost between calls
+	send := func(t *testing.T, conn net.Conn, r *bufio.Reader, cmd string, n int) string {
+		t.Helper()
+		if _, err := fmt.Fprintf(conn, "%s\r\n", cmd); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		var out string
+		for i := 0; i < n; i++ {
+			out += readReply(t, r)
+		}
+		return out
+	}
+
+	t.Run("channels and patterns", func(t *testing.T) {
+		sub := newConn(t, addr)
+		defer sub.Close()
+		subR := bufio.NewReader(sub)
+		pub := newConn(t, addr)
+		defer pub.Close()
+
+		want := "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n" +
+			"*3\r\n$9\r\nsubscribe\r\n$6\r\nsports\r\n:2\r\n"
+		if resp := send(t, sub, subR, "SUBSCRIBE news sports", 2); resp != want {
+			t.Fatalf("unexpected SUBSCRIBE reply %q", resp)
+		}
+		want = "*3\r\n$10\r\npsubscribe\r\n$6\r\nnews.*\r\n:3\r\n"
+		if resp := send(t, sub, subR, "PSUBSCRIBE news.*", 1); resp != want {
+			t.Fatalf("unexpected PSUBSCRIBE reply %q", resp)
+		}
+
+		if resp := sendCommand(t, pub, "PUBLISH news hello"); resp != ":1\r\n" {
+			t.Errorf("expected one receiver, got %q", resp)
+		}
+		if resp := readReply(t, subR); resp != "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n" {
+			t.Errorf("unexpected message %q", resp)
+		}
+
+		if resp := sendCommand(t, pub, "PUBLISH news.tech launch"); resp != ":1\r\n" {
+			t.Errorf("expected one receiver, got %q", resp)
+		}
+		if resp := readReply(t, subR); resp != "*4\r\n$8\r\npmessage\r\n$6\r\nnews.*\r\n$9\r\nnews.tech\r\n$6\r\nlaunch\r\n" {
+			t.Errorf("unexpected pmessage %q", resp)
+		}
+
+		if resp := sendCommand(t, pub, "PUBLISH weather rain"); resp != ":0\r\n" {
+			t.Errorf("expected no receivers, got %q", resp)
+		}
+
+		if resp := sendCommand(t, pub, "PUBSUB CHANNELS"); resp != "*2\r\n$4\r\nnews\r\n$6\r\nsports\r\n" {
+			t.Errorf("unexpected PUBSUB CHANNELS reply %q", resp)
+		}
+		if resp := sendCommand(t, pub, "PUBSUB CHANNELS s*"); resp != "*1\r\n$6\r\nsports\r\n" {
+			t.Errorf("unexpected PUBSUB CHANNELS reply %q", resp)
+		}
+		if resp := sendCommand(t, pub, "PUBSUB NUMSUB news weather"); resp != "*4\r\n$4\r\nnews\r\n:1\r\n$7\r\nweather\r\n:0\r\n" {
+			t.Errorf("unexpected PUBSUB NUMSUB reply %q", resp)
+		}
+		if resp := sendCommand(t, pub, "PUBSUB NUMPAT"); resp != ":1\r\n" {
+			t.Errorf("unexpected PUBSUB NUMPAT reply %q", resp)
+		}
+		if resp := sendCommand(t, pub, "PUBSUB NOPE"); !strings.HasPrefix(resp, "-ERR unknown subcommand 'NOPE'") {
+			t.Errorf("expected an unknown subcommand error, got %q", resp)
+		}
+
+		// Without arguments every channel is dropped, and the pattern stays
+		want = "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:2\r\n" +
+			"*3\r\n$11\r\nunsubscribe\r\n$6\r\nsports\r\n:1\r\n"
+		if resp := send(t, sub, subR, "UNSUBSCRIBE", 2); resp != want {
+			t.Errorf("unexpected UNSUBSCRIBE reply %q", resp)
+		}
+		if resp := send(t, sub, subR, "UNSUBSCRIBE", 1); resp != "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:1\r\n" {
+			t.Errorf("unexpected UNSUBSCRIBE reply with no channels %q", resp)
+		}
+		if resp := send(t, sub, subR, "PUNSUBSCRIBE news.*", 1); resp != "*3\r\n$12\r\npunsubscribe\r\n$6\r\nnews.*\r\n:0\r\n" {
+			t.Errorf("unexpected PUNSUBSCRIBE reply %q", resp)
+		}
+
+		if resp := sendCommand(t, pub, "PUBLISH news hello"); resp != ":0\r\n" {
+			t.Errorf("expected no receivers after unsubscribing, got %q", resp)
+		}
+	})
+
+	t.Run("subscribed mode", func(t *testing.T) {
+		conn := newConn(t, addr)
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		send(t, conn, r, "SUBSCRIBE ch", 1)
+		if resp := send(t, conn, r, "GET foo", 1); resp != "-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context\r\n" {
+			t.Errorf("expected GET to be refused, got %q", resp)
+		}
+		if resp := send(t, conn, r, "PING", 1); resp != "*2\r\n$4\r\npong\r\n$0\r\n\r\n" {
+			t.Errorf("unexpected PING reply %q", resp)
+		}
+		if resp := send(t, conn, r, "MULTI", 1); !strings.HasPrefix(resp, "-ERR Can't execute 'multi'") {
+			t.Errorf("expected MULTI to be refused, got %q", resp)
+		}
+
+		// Leaving every channel ends subscribed mode
+		send(t, conn, r, "UNSUBSCRIBE ch", 1)
+		if resp := send(t, conn, r, "PING", 1); resp != "+PONG\r\n" {
+			t.Errorf("expected a plain PONG, got %q", resp)
+		}
+		if resp := send(t, conn, r, "GET foo", 1); resp != "$-1\r\n" {
+			t.Errorf("expected GET to run, got %q", resp)
+		}
+	})
+
+	t.Run("RESP3 pushes", func(t *testing.T) {
+		conn := newConn(t, addr)
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		pub := newConn(t, addr)
+		defer pub.Close()
+
+		send(t, conn, r, "HELLO 3", 1)
+		if resp := send(t, conn, r, "SUBSCRIBE ch", 1); resp != ">3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n" {
+			t.Fatalf("unexpected SUBSCRIBE reply %q", resp)
+		}
+
+		// Pushes cannot be mistaken for replies, so any command may run
+		if resp := send(t, conn, r, "SET foo bar", 1); resp != "+OK\r\n" {
+			t.Errorf("expected SET to run while subscribed, got %q", resp)
+		}
+
+		sendCommand(t, pub, "PUBLISH ch hi")
+		if resp := readReply(t, r); resp != ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n" {
+			t.Errorf("unexpected push %q", resp)
+		}
+	})
+
+	t.Run("not allowed in transactions", func(t *testing.T) {
+		conn := newConn(t, addr)
+		defer conn.Close()
+
+		sendCommand(t, conn, "MULTI")
+		if resp := sendCommand(t, conn, "SUBSCRIBE ch"); resp != "-ERR Command not allowed inside a transaction\r\n" {
+			t.Errorf("expected SUBSCRIBE to be refused after MULTI, got %q", resp)
+		}
+		sendCommand(t, conn, "DISCARD")
+	})
+
+	t.Run("disconnect drops subscriptions", func(t *testing.T) {
+		conn := newConn(t, addr)
+		send(t, conn, bufio.NewReader(conn), "SUBSCRIBE gone", 1)
+		conn.Close()
+
+		pub := newConn(t, addr)
+		defer pub.Close()
+		deadline := time.Now().Add(2 * time.Second)
+		for sendCommand(t, pub, "PUBSUB NUMSUB gone") != "*2\r\n$4\r\ngone\r\n:0\r\n" {
+			if time.Now().After(deadline) {
+				t.Fatal("subscription outlived its connection")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestPubSubSlowSubscriber(t *testing.T) {
+	_, addr := startTestServerWithConfig(t, server.Config{Dir: t.TempDir(), PubSubBufferLimit: 1 << 20}, store.NewStore(), cluster.NewManager("localhost", "6379"))
+
+	// The subscriber never reads, so messages pile up once the socket buffers fill
+	sub := newConn(t, addr)
+	defer sub.Close()
+	fmt.Fprintf(sub, "SUBSCRIBE firehose\r\n")
+
+	pub := newConn(t, addr)
+	defer pub.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for sendCommand(t, pub, "PUBSUB NUMSUB firehose") != "*2\r\n$8\r\nfirehose\r\n:1\r\n" {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber never subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	payload := strings.Repeat("x", 64<<10)
+	cmd := fmt.Sprintf("*3\r\n$7\r\nPUBLISH\r\n$8\r\nfirehose\r\n$%d\r\n%s\r\n", len(payload), payload)
+	r := bufio.NewReader(pub)
+	for i := 0; ; i++ {
+		if i == 2000 {
+			t.Fatal("slow subscriber was never disconnected")
+		}
+
+		// PUBLISH must keep answering however far behind the subscriber is
+		pub.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(pub, cmd); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if resp := readReply(t, r); resp == ":0\r\n" {
+			break
+		}
+	}
+
+	// The server closed the subscriber's connection
+	sub.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, sub); err != nil {
+		t.Errorf("expected the subscriber's connection to be closed, got %v", err)
+	}
+}
+
+func TestPubSubWebsocketBridge(t *testing.T) {
+	handler, url := startTestWebServer(t, t.TempDir(), store.NewStore(), cluster.NewManager("localhost", "6379"))
+	client := newWsConn(t, url)
+
+	for _, cmd := range []observer.CommandMessage{
+		{Action: "subscribe", Key: "chat"},
+		{Action: "psubscribe", Key: "alerts:*"},
+	} {
+		if err := client.WriteJSON(cmd); err != nil {
+			t.Fatalf("failed to send command: %v", err)
+		}
+		var resp observer.UpdateMessage
+		if err := client.ReadJSON(&resp); err != nil || resp.Action != cmd.Action+"_resp" {
+			t.Fatalf("expected a %s_resp, got %+v (err %v)", cmd.Action, resp, err)
+		}
+	}
+
+	// RESP publishers reach browser subscribers through the shared registry
+	if n := handler.PubSub().Publish("chat", "hello"); n != 1 {
+		t.Errorf("expected one receiver, got %d", n)
+	}
+	if n := handler.PubSub().Publish("alerts:disk", "full"); n != 1 {
+		t.Errorf("expected one receiver, got %d", n)
+	}
+
+	want := []observer.PubSubMessage{
+		{Action: "message", Channel: "chat", Payload: "hello"},
+		{Action: "pmessage", Pattern: "alerts:*", Channel: "alerts:disk", Payload: "full"},
+	}
+	for _, w := range want {
+		var got observer.PubSubMessage
+		if err := client.ReadJSON(&got); err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		if got != w {
+			t.Errorf("expected %+v, got %+v", w, got)
+		}
+	}
+
+	// And browser publishers reach RESP subscribers
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.StartWithListener(ln, handler, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	sub := newConn(t, ln.Addr().String())
+	defer sub.Close()
+	subR := bufio.NewReader(sub)
+	fmt.Fprintf(sub, "SUBSCRIBE chat\r\n")
+	readReply(t, subR)
+
+	if err := client.WriteJSON(observer.CommandMessage{Action: "publish", Key: "chat", Value: "from the browser"}); err != nil {
+		t.Fatalf("failed to send PUBLISH: %v", err)
+	}
+	if resp := readReply(t, subR); resp != "*3\r\n$7\r\nmessage\r\n$4\r\nchat\r\n$16\r\nfrom the browser\r\n" {
+		t.Errorf("unexpected message %q", resp)
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	s := store.NewStore()
+	_, addr := startTestServerWithConfig(t, server.Config{Dir: t.TempDir(), NotifyKeyspaceEvents: "Eg$x"}, s, cluster.NewManager("localhost", "6379"))
+	conn := newConn(t, addr)
+	defer conn.Close()
+
+	sub := newConn(t, addr)
+	defer sub.Close()
+	subR := bufio.NewReader(sub)
+	fmt.Fprintf(sub, "PSUBSCRIBE __key*@0__:*\r\n")
+	readReply(t, subR)
+
+	// next returns the channel and payload of the next message the subscriber gets
+	next := func(t *testing.T) (string, string) {
+		t.Helper()
+		sub.SetReadDeadline(time.Now().Add(2 * time.Second))
+		lines := strings.Split(readReply(t, subR), "\r\n")
+		if len(lines) < 9 || lines[2] != "pmessage" {
+			t.Fatalf("expected a pmessage, got %q", lines)
+		}
+		return lines[6], lines[8]
+	}
+	expect := func(t *testing.T, events ...string) {
+		t.Helper()
+		for i := 0; i < len(events); i += 2 {
+			channel, key := next(t)
+			if want := "__keyevent@0__:" + events[i]; channel != want || key != events[i+1] {
+				t.Errorf("expected %s on %s, got %s on %s", events[i+1], want, key, channel)
+			}
+		}
+	}
+
+	t.Run("commands", func(t *testing.T) {
+		sendCommand(t, conn, "SET a 1 EX 100")
+		expect(t, "set", "a", "expire", "a")
+
+		sendCommand(t, conn, "INCR a")
+		sendCommand(t, conn, "APPEND a 0")
+		expect(t, "incrby", "a", "append", "a")
+
+		sendCommand(t, conn, "RENAME a b")
+		expect(t, "rename_from", "a", "rename_to", "b")
+
+		// Only the first PERSIST has an expiration to remove
+		sendCommand(t, conn, "PERSIST b")
+		sendCommand(t, conn, "GETEX b PERSIST")
+		sendCommand(t, conn, "DEL b")
+		expect(t, "persist", "b", "del", "b")
+
+		sendCommand(t, conn, "MSET c 1 d 2")
+		sendCommand(t, conn, "UNLINK c d")
+		expect(t, "set", "c", "set", "d", "del", "c", "del", "d")
+
+		// A failed write announces nothing
+		sendCommand(t, conn, "DEL missing")
+		sendCommand(t, conn, "SET e v")
+		expect(t, "set", "e")
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		sendCommand(t, conn, "SET short v PX 20")
+		expect(t, "set", "short", "expire", "short")
+
+		// Whether a lookup or the background sweep removes it, the expiration is announced
+		time.Sleep(50 * time.Millisecond)
+		sendCommand(t, conn, "GET short")
+		expect(t, "expired", "short")
+	})
+
+	t.Run("keyspace channel", func(t *testing.T) {
+		if resp := sendCommand(t, conn, "CONFIG SET notify-keyspace-events K$"); resp != "+OK\r\n" {
+			t.Fatalf("CONFIG SET failed: %q", resp)
+		}
+		if resp := sendCommand(t, conn, "CONFIG GET notify-*"); resp != "*2\r\n$22\r\nnotify-keyspace-events\r\n$2\r\n$K\r\n" {
+			t.Errorf("unexpected CONFIG GET reply %q", resp)
+		}
+
+		// Only string events are enabled now, so DEL is not announced
+		sendCommand(t, conn, "DEL e")
+		sendCommand(t, conn, "SET f v")
+		if channel, event := next(t); channel != "__keyspace@0__:f" || event != "set" {
+			t.Errorf("expected set on __keyspace@0__:f, got %s on %s", event, channel)
+		}
+	})
+
+	t.Run("evicted", func(t *testing.T) {
+		sendCommand(t, conn, "CONFIG SET notify-keyspace-events Ee")
+
+		// Fill the store to its limit, so the next new key evicts the least recently used
+		sendCommand(t, conn, "DEL f")
+		s.Set("oldest", "v")
+		for i := 0; len(s.GetAllKeys()) < 1000; i++ {
+			s.Set(fmt.Sprintf("filler:%d", i), "v")
+		}
+		sendCommand(t, conn, "SET newest v")
+		expect(t, "evicted", "oldest")
+	})
+
+	t.Run("invalid classes", func(t *testing.T) {
+		resp := sendCommand(t, conn, "CONFIG SET notify-keyspace-events Kl")
+		if !strings.HasPrefix(resp, "-ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events')") {
+			t.Errorf("expected an invalid class error, got %q", resp)
+		}
+		if resp := sendCommand(t, conn, "CONFIG GET notify-keyspace-events"); !strings.HasSuffix(resp, "$2\r\neE\r\n") {
+			t.Errorf("expected a refused CONFIG SET to change nothing, got %q", resp)
+		}
+		if resp := sendCommand(t, conn, "CONFIG SET maxmemory 1"); !strings.HasPrefix(resp, "-ERR Unknown option") {
+			t.Errorf("expected an unknown option error, got %q", resp)
+		}
+
+		_, err := server.Open(server.Config{Dir: t.TempDir(), NotifyKeyspaceEvents: "Kz"}, store.NewStore(), slog.New(slog.NewTextHandler(io.Discard, nil)), nil, nil)
+		if err == nil {
+			t.Error("expected Open to refuse invalid notify-keyspace-events")
+		}
+	})
+}
@@ -93,6 +93,14 @@ export const useWebSocket = (url: string): UseWebSocketReturn => {
             ws.current.send(JSON.stringify({ action: 'cluster_info' }))
           }
           break
+        case 'error':
+          // A command we sent was rejected
+          console.error(`Command for key "${message.key}" failed: ${message.error}`)
+          break
+        case 'moved':
+          // The key lives on another node; the edit must be sent there
+          console.warn(`Key "${message.key}" (slot ${message.slot}) is served by ${message.host}:${message.port}`)
+          break
       }
     }
 
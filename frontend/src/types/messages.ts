@@ -10,6 +10,17 @@ export interface DelMessage {
   key: string
 }
 
+export interface ExpireMessage {
+  action: 'expire'
+  key: string
+  value: string // Unix time in milliseconds at which the key expires
+}
+
+export interface PersistMessage {
+  action: 'persist'
+  key: string
+}
+
 export interface SyncMessage {
   action: 'sync'
   data: Record<string, string>
@@ -50,10 +61,49 @@ export interface ClusterStatsMessage {
   totalKeys: number
 }
 
-export type ServerMessage = SetMessage | DelMessage | SyncMessage | ClusterInfoMessage | ClusterEventMessage | ClusterStatsMessage
+export interface ErrorMessage {
+  action: 'error'
+  key?: string
+  error: string
+}
+
+export interface MovedMessage {
+  action: 'moved'
+  key: string
+  slot: number
+  host: string
+  port: string
+}
+
+export interface SubscriptionMessage {
+  action: 'subscribe_resp' | 'psubscribe_resp' | 'unsubscribe_resp' | 'punsubscribe_resp'
+  key: string // Channel or pattern
+  value: string // Number of channels and patterns the connection is now subscribed to
+}
+
+export interface PublishResponseMessage {
+  action: 'publish_resp'
+  key: string // Channel
+  value: string // Number of subscribers the message was delivered to
+}
+
+export interface PubSubMessage {
+  action: 'message'
+  channel: string
+  payload: string
+}
+
+export interface PatternPubSubMessage {
+  action: 'pmessage'
+  pattern: string // Subscribed pattern the channel matched
+  channel: string
+  payload: string
+}
+
+export type ServerMessage = SetMessage | DelMessage | ExpireMessage | PersistMessage | SyncMessage | ClusterInfoMessage | ClusterEventMessage | ClusterStatsMessage | ErrorMessage | MovedMessage | SubscriptionMessage | PublishResponseMessage | PubSubMessage | PatternPubSubMessage
 
 export interface CommandMessage {
-  action: 'set' | 'del' | 'get_all' | 'cluster_info'
-  key?: string
-  value?: string
+  action: 'set' | 'del' | 'get_all' | 'cluster_info' | 'subscribe' | 'psubscribe' | 'unsubscribe' | 'punsubscribe' | 'publish'
+  key?: string // Channel or pattern for the pub/sub actions
+  value?: string // Message for publish
 }
@@ -2,4 +2,4 @@ module github.com/121watts/reredis
 
 go 1.24.4
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require github.com/gorilla/websocket v1.5.3
@@ -19,10 +19,11 @@ const SLOT_RANGE int32 = 16_384
 func CalculateSlot(key string) int32 {
 	// Redis hash tag support: if key contains {tag}, hash only the tag content
 	// This allows developers to control key placement by ensuring keys with
-	// the same tag go to the same node, enabling multi-key operations
+	// the same tag go to the same node, enabling multi-key operations.
+	// An empty tag such as "{}" is ignored and the whole key is hashed, as in Redis.
 	hashKey := key
 	if start := strings.Index(key, "{"); start != -1 {
-		if end := strings.Index(key[start+1:], "}"); end != -1 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
 			hashKey = key[start+1 : start+1+end]
 		}
 	}
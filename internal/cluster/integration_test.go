@@ -26,6 +26,12 @@ func startClusterTestServer(t *testing.T, host, port string) (*cluster.Manager,
 	s := store.NewStore()
 	clusterManager := cluster.NewManager(host, port)
 
+	handler, err := server.Open(server.Config{Dir: t.TempDir()}, s, logger, hub, clusterManager)
+	if err != nil {
+		t.Fatalf("failed to open server: %v", err)
+	}
+	t.Cleanup(func() { handler.Close() })
+
 	ln, err := net.Listen("tcp", host+":0") // Use dynamic port
 	if err != nil {
 		t.Fatalf("failed to listen: %v", err)
@@ -33,7 +39,7 @@ func startClusterTestServer(t *testing.T, host, port string) (*cluster.Manager,
 	addr := ln.Addr().String()
 
 	go func() {
-		if err := server.StartWithListener(ln, s, logger, hub, clusterManager); err != nil {
+		if err := server.StartWithListener(ln, handler, logger); err != nil {
 			t.Logf("Server exited with error: %v", err)
 		}
 	}()
@@ -62,11 +68,22 @@ func sendClusterCommand(t *testing.T, conn net.Conn, cmd string) string {
 		t.Fatalf("write failed: %v", err)
 	}
 
-	resp, err := bufio.NewReader(conn).ReadString('\n')
+	reader := bufio.NewReader(conn)
+	resp, err := reader.ReadString('\n')
 	if err != nil {
 		t.Fatalf("read failed: %v", err)
 	}
 
+	// Bulk string replies carry their payload on the following line
+	var length int
+	if n, _ := fmt.Sscanf(resp, "$%d", &length); n == 1 && length >= 0 {
+		body := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		resp += string(body)
+	}
+
 	return resp
 }
 
@@ -108,7 +125,7 @@ func TestClusterManagerIntegration(t *testing.T) {
 
 			// Get the key
 			getResp := sendClusterCommand(t, conn, fmt.Sprintf("GET %s", test.key))
-			expectedResp := test.value + "\r\n"
+			expectedResp := fmt.Sprintf("$%d\r\n%s\r\n", len(test.value), test.value)
 			if getResp != expectedResp {
 				t.Errorf("GET %s: expected %q, got %q", test.key, expectedResp, getResp)
 			}
@@ -233,6 +250,7 @@ func TestHashtagSupport(t *testing.T) {
 		{"key1", "key2", false},
 		{"{shared}:data1", "{shared}:data2", true},
 		{"prefix{tag}suffix", "other{tag}end", true},
+		{"{}:data1", "{}:data2", false}, // Empty tags are ignored
 	}
 
 	for _, tc := range testCases {
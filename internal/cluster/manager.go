@@ -157,8 +157,8 @@ func (m *Manager) UpdateByteSize(size int64) {
 func (m *Manager) IncrementKeyCount() {
 	if m.Node != nil {
 		m.Node.KeyCount++
-		// Also update in the nodes map
-		if node, exists := m.Nodes[m.Node.ID]; exists {
+		// Also update in the nodes map, unless it is the same *Node
+		if node, exists := m.Nodes[m.Node.ID]; exists && node != m.Node {
 			node.KeyCount++
 		}
 	}
@@ -169,8 +169,8 @@ func (m *Manager) IncrementKeyCount() {
 func (m *Manager) DecrementKeyCount() {
 	if m.Node != nil && m.Node.KeyCount > 0 {
 		m.Node.KeyCount--
-		// Also update in the nodes map
-		if node, exists := m.Nodes[m.Node.ID]; exists && node.KeyCount > 0 {
+		// Also update in the nodes map, unless it is the same *Node
+		if node, exists := m.Nodes[m.Node.ID]; exists && node != m.Node && node.KeyCount > 0 {
 			node.KeyCount--
 		}
 	}
@@ -182,8 +182,8 @@ func (m *Manager) AddByteSize(keySize, valueSize int) {
 	if m.Node != nil {
 		bytes := int64(keySize + valueSize)
 		m.Node.ByteSize += bytes
-		// Also update in the nodes map
-		if node, exists := m.Nodes[m.Node.ID]; exists {
+		// Also update in the nodes map, unless it is the same *Node
+		if node, exists := m.Nodes[m.Node.ID]; exists && node != m.Node {
 			node.ByteSize += bytes
 		}
 	}
@@ -199,8 +199,8 @@ func (m *Manager) SubtractByteSize(keySize, valueSize int) {
 		} else {
 			m.Node.ByteSize = 0
 		}
-		// Also update in the nodes map
-		if node, exists := m.Nodes[m.Node.ID]; exists {
+		// Also update in the nodes map, unless it is the same *Node
+		if node, exists := m.Nodes[m.Node.ID]; exists && node != m.Node {
 			if node.ByteSize >= bytes {
 				node.ByteSize -= bytes
 			} else {
@@ -0,0 +1,95 @@
+// Package datadir manages the directory that holds a node's persistent state.
+// Every on-disk file a node owns (the WAL, snapshots, config) lives under one
+// locked directory, so several nodes on a host can never write to the same files.
+package datadir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WALDirName is the subdirectory holding the write-ahead log's segments and manifest.
+const WALDirName = "wal"
+
+// LegacyWALFileName is the single-file log used before the WAL was segmented.
+// It is only read so existing data directories can be migrated.
+const LegacyWALFileName = "reredis.wal"
+
+// lockFileName is held open and locked for as long as the directory is in use.
+const lockFileName = "LOCK"
+
+// ErrLocked is returned when another process already owns the data directory.
+var ErrLocked = errors.New("data directory is locked by another process")
+
+// Dir is an exclusively locked data directory.
+// It resolves the paths of the files stored inside it and releases the lock on Close.
+type Dir struct {
+	path string   // Absolute path to the directory
+	lock *os.File // Open handle to the lock file, holding the OS-level lock
+}
+
+// Open creates the directory if needed and takes an exclusive lock on it.
+// The lock is advisory and tied to the process, so it is released automatically
+// if the node crashes instead of leaving a stale lock behind.
+func Open(path string) (*Dir, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve data directory %q: %w", path, err)
+	}
+
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory %q: %w", abs, err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(abs, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("%w: %s", ErrLocked, abs)
+	}
+
+	// Record the owner to make "who holds this directory?" easy to answer
+	if err := lock.Truncate(0); err == nil {
+		fmt.Fprintf(lock, "%d\n", os.Getpid())
+	}
+
+	return &Dir{path: abs, lock: lock}, nil
+}
+
+// Path returns the absolute path of the data directory.
+func (d *Dir) Path() string {
+	return d.path
+}
+
+// Join returns the path of a file stored inside the data directory.
+func (d *Dir) Join(name string) string {
+	return filepath.Join(d.path, name)
+}
+
+// WALDir returns the directory holding the write-ahead log.
+func (d *Dir) WALDir() string {
+	return d.Join(WALDirName)
+}
+
+// LegacyWALPath returns where a pre-segmentation log would live.
+func (d *Dir) LegacyWALPath() string {
+	return d.Join(LegacyWALFileName)
+}
+
+// Close releases the directory lock so another process may open it.
+func (d *Dir) Close() error {
+	if d.lock == nil {
+		return nil
+	}
+
+	unlockFile(d.lock)
+	err := d.lock.Close()
+	d.lock = nil
+
+	return err
+}
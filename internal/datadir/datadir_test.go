@@ -0,0 +1,36 @@
+package datadir
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLocksDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node-6379")
+
+	dir, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open data directory: %v", err)
+	}
+
+	if dir.WALDir() != filepath.Join(path, WALDirName) {
+		t.Errorf("Expected WAL directory inside data directory, got %s", dir.WALDir())
+	}
+
+	// A second owner must be refused while the first holds the lock
+	if _, err := Open(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked when opening a locked directory, got %v", err)
+	}
+
+	if err := dir.Close(); err != nil {
+		t.Fatalf("Failed to close data directory: %v", err)
+	}
+
+	// Once released, the directory can be reopened
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen released data directory: %v", err)
+	}
+	reopened.Close()
+}
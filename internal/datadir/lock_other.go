@@ -0,0 +1,15 @@
+//go:build !unix
+
+package datadir
+
+import "os"
+
+// lockFile is a no-op on platforms without flock; the directory is not protected there.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile is a no-op on platforms without flock.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,78 @@
+package observer
+
+import (
+	"github.com/121watts/reredis/internal/pubsub"
+	"github.com/gorilla/websocket"
+)
+
+// PubSubMessage carries a published message to a WebSocket client subscribed to its
+// channel, mirroring the message and pmessage pushes RESP subscribers receive.
+type PubSubMessage struct {
+	Action  string `json:"action"` // "message", or "pmessage" when a pattern matched
+	Pattern string `json:"pattern,omitempty"`
+	Channel string `json:"channel"`
+	Payload string `json:"payload"`
+}
+
+// Bridge subscribes one WebSocket client to pub/sub channels and patterns and forwards
+// what is published to them through the hub. This lets browser clients follow the same
+// channels as RESP subscribers, under the same rule that a client falling more than
+// the buffer limit behind is disconnected.
+type Bridge struct {
+	hub      *Hub
+	client   *websocket.Conn
+	registry *pubsub.Registry
+	mailbox  *pubsub.Mailbox
+}
+
+// Bridge connects a registered client to a pub/sub registry. limit bounds the bytes of
+// messages that may wait to be sent to it. Close the bridge when the client goes away.
+func (h *Hub) Bridge(client *websocket.Conn, registry *pubsub.Registry, limit int) *Bridge {
+	b := &Bridge{hub: h, client: client, registry: registry}
+	b.mailbox = pubsub.NewMailbox(limit, func() {
+		h.logger.Warn("closing websocket subscriber that exceeded its output buffer limit")
+		client.Close()
+	})
+	go b.forward()
+	return b
+}
+
+// Subscribe subscribes the client to a channel and returns its subscription count.
+func (b *Bridge) Subscribe(channel string) int {
+	return b.registry.Subscribe(b.mailbox, channel)
+}
+
+// PSubscribe subscribes the client to a glob pattern and returns its subscription count.
+func (b *Bridge) PSubscribe(pattern string) int {
+	return b.registry.PSubscribe(b.mailbox, pattern)
+}
+
+// Unsubscribe removes the client from a channel and returns its subscription count.
+func (b *Bridge) Unsubscribe(channel string) int {
+	return b.registry.Unsubscribe(b.mailbox, channel)
+}
+
+// PUnsubscribe removes the client from a pattern and returns its subscription count.
+func (b *Bridge) PUnsubscribe(pattern string) int {
+	return b.registry.PUnsubscribe(b.mailbox, pattern)
+}
+
+// Close drops every subscription and stops forwarding.
+func (b *Bridge) Close() {
+	b.registry.UnsubscribeAll(b.mailbox)
+	b.mailbox.Close()
+}
+
+// forward sends queued messages to the client through the hub until the bridge is
+// closed.
+func (b *Bridge) forward() {
+	for range b.mailbox.Ready() {
+		for _, msg := range b.mailbox.Take() {
+			out := PubSubMessage{Action: "message", Channel: msg.Channel, Payload: msg.Payload}
+			if msg.ViaPattern {
+				out.Action, out.Pattern = "pmessage", msg.Pattern
+			}
+			b.hub.Send(b.client, out)
+		}
+	}
+}
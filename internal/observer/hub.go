@@ -29,6 +29,24 @@ type UpdateMessage struct {
 	Value  string `json:"value,omitempty"`
 }
 
+// ErrorMessage reports a failed command back to the WebSocket client that sent it.
+// This lets the UI show why an edit was rejected instead of silently dropping it.
+type ErrorMessage struct {
+	Action string `json:"action"` // Always "error"
+	Key    string `json:"key,omitempty"`
+	Error  string `json:"error"`
+}
+
+// MovedMessage tells a WebSocket client that a key belongs to another cluster node.
+// This mirrors the RESP -MOVED redirect so dashboards can send the edit to the owner.
+type MovedMessage struct {
+	Action string `json:"action"` // Always "moved"
+	Key    string `json:"key"`
+	Slot   int32  `json:"slot"`
+	Host   string `json:"host"`
+	Port   string `json:"port"`
+}
+
 // ClusterStatsMessage represents cluster-wide statistics sent to clients.
 // This provides real-time monitoring data for cluster health, key distribution,
 // and node status updates without requiring polling from the frontend.
@@ -64,6 +82,14 @@ type Hub struct {
 	logger     *slog.Logger             // Structured logging for debugging and monitoring
 	register   chan *websocket.Conn     // Channel for adding new client connections
 	unregister chan *websocket.Conn     // Channel for removing disconnected clients
+	direct     chan directMessage       // Channel for messages meant for one client
+}
+
+// directMessage is a message for a single client, such as a pub/sub message for a
+// client subscribed to its channel.
+type directMessage struct {
+	client *websocket.Conn
+	data   []byte
 }
 
 // NewHub creates a new WebSocket hub for managing real-time connections.
@@ -76,6 +102,7 @@ func NewHub(logger *slog.Logger) *Hub {
 		logger:     logger.With("component", "hub"),
 		register:   make(chan *websocket.Conn),
 		unregister: make(chan *websocket.Conn),
+		direct:     make(chan directMessage),
 	}
 }
 
@@ -106,6 +133,14 @@ func (h *Hub) Run() {
 				}
 			}
 			h.mu.Unlock()
+		case msg := <-h.direct:
+			h.mu.Lock()
+			if h.clients[msg.client] {
+				if err := msg.client.WriteMessage(websocket.TextMessage, msg.data); err != nil {
+					h.logger.Error("failed to send message", "error", err)
+				}
+			}
+			h.mu.Unlock()
 		}
 	}
 }
@@ -136,6 +171,19 @@ func (h *Hub) BroadcastClusterStats(stats ClusterStatsMessage) {
 	h.broadcast <- data
 }
 
+// Send delivers a message to a single client, such as the reply to its own command.
+// It goes through the hub's event loop like broadcasts do, since a WebSocket
+// connection must not be written by two goroutines at once.
+func (h *Hub) Send(client *websocket.Conn, msg any) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		h.logger.Error("failed to marshal message", "error", err)
+		return
+	}
+
+	h.direct <- directMessage{client: client, data: data}
+}
+
 // Register adds a new WebSocket connection to receive broadcasts.
 // This enables clients to subscribe to real-time updates and participate
 // in collaborative features by joining the notification system.
@@ -0,0 +1,77 @@
+package pubsub
+
+import "sync"
+
+// Mailbox is a Subscriber that queues messages for a goroutine of its owner to write
+// out, so a slow client never holds up PUBLISH. The queue is bounded: once the
+// messages waiting exceed the limit in bytes, the owner's overflow function is called
+// and everything after is dropped, the way Redis disconnects pub/sub clients that
+// exceed their output buffer limit.
+type Mailbox struct {
+	mu         sync.Mutex
+	queue      []Message
+	size       int           // Bytes held by queue
+	limit      int           // Bytes queue may hold
+	overflow   func()        // Called once when queue would exceed limit
+	overflowed bool          // Deliveries stopped because queue overflowed
+	closed     bool          // Close was called
+	ready      chan struct{} // Signalled when queue becomes non-empty; closed by Close
+}
+
+// NewMailbox returns a mailbox holding at most limit bytes of waiting messages.
+// overflow must not block; it typically closes the connection being written to.
+func NewMailbox(limit int, overflow func()) *Mailbox {
+	return &Mailbox{limit: limit, overflow: overflow, ready: make(chan struct{}, 1)}
+}
+
+// Deliver queues a message, or reports an overflow if it does not fit.
+func (m *Mailbox) Deliver(msg Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed || m.overflowed {
+		return
+	}
+
+	if m.size+msg.size() > m.limit {
+		m.overflowed = true
+		m.queue, m.size = nil, 0
+		m.overflow()
+		return
+	}
+
+	m.queue = append(m.queue, msg)
+	m.size += msg.size()
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready returns a channel that receives a value when messages are waiting to be
+// taken, and is closed once the mailbox is.
+func (m *Mailbox) Ready() <-chan struct{} {
+	return m.ready
+}
+
+// Take removes and returns every waiting message, oldest first.
+func (m *Mailbox) Take() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := m.queue
+	m.queue, m.size = nil, 0
+	return msgs
+}
+
+// Close stops deliveries and closes the Ready channel. Messages still waiting can be
+// taken afterwards.
+func (m *Mailbox) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		close(m.ready)
+	}
+}
@@ -0,0 +1,250 @@
+// Package pubsub routes published messages to the subscribers of channels and glob
+// patterns. It knows nothing about how messages reach a client, so RESP connections
+// and the WebSocket hub subscribe through the same registry and see the same traffic.
+package pubsub
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/121watts/reredis/internal/query"
+)
+
+// Message is a published message as delivered to one subscriber.
+type Message struct {
+	Channel    string
+	Payload    string
+	ViaPattern bool   // Delivered through a pattern subscription rather than the channel itself
+	Pattern    string // The pattern that matched, when ViaPattern is set
+}
+
+// size is roughly how many bytes a queued message holds.
+func (m Message) size() int {
+	return len(m.Channel) + len(m.Payload) + len(m.Pattern)
+}
+
+// Subscriber receives the messages published to the channels and patterns it is
+// subscribed to. Deliver is called while the registry is locked, so it must not block
+// or call back into the registry.
+type Subscriber interface {
+	Deliver(Message)
+}
+
+// subscriptions is what one subscriber is subscribed to.
+type subscriptions struct {
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+// Registry maps channels and patterns to their subscribers. It is safe for concurrent
+// use.
+type Registry struct {
+	mu       sync.RWMutex
+	channels map[string]map[Subscriber]struct{}
+	patterns map[string]map[Subscriber]struct{}
+	subs     map[Subscriber]*subscriptions
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		channels: make(map[string]map[Subscriber]struct{}),
+		patterns: make(map[string]map[Subscriber]struct{}),
+		subs:     make(map[Subscriber]*subscriptions),
+	}
+}
+
+// Subscribe subscribes s to a channel and returns how many channels and patterns s is
+// now subscribed to. Subscribing twice has no further effect.
+func (r *Registry) Subscribe(s Subscriber, channel string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.add(r.channels, s, channel, r.entry(s).channels)
+	return r.countLocked(s)
+}
+
+// PSubscribe subscribes s to every channel matching a glob pattern and returns how
+// many channels and patterns s is now subscribed to.
+func (r *Registry) PSubscribe(s Subscriber, pattern string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.add(r.patterns, s, pattern, r.entry(s).patterns)
+	return r.countLocked(s)
+}
+
+// Unsubscribe removes s from a channel and returns how many channels and patterns s
+// is still subscribed to.
+func (r *Registry) Unsubscribe(s Subscriber, channel string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e := r.subs[s]; e != nil {
+		r.remove(r.channels, s, channel, e.channels)
+	}
+	return r.countLocked(s)
+}
+
+// PUnsubscribe removes s from a pattern and returns how many channels and patterns s
+// is still subscribed to.
+func (r *Registry) PUnsubscribe(s Subscriber, pattern string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e := r.subs[s]; e != nil {
+		r.remove(r.patterns, s, pattern, e.patterns)
+	}
+	return r.countLocked(s)
+}
+
+// Subscriptions returns the channels and the patterns s is subscribed to, each sorted.
+func (r *Registry) Subscriptions(s Subscriber) (channels, patterns []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e := r.subs[s]
+	if e == nil {
+		return nil, nil
+	}
+	return sortedKeys(e.channels), sortedKeys(e.patterns)
+}
+
+// Count returns how many channels and patterns s is subscribed to.
+func (r *Registry) Count(s Subscriber) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.countLocked(s)
+}
+
+// UnsubscribeAll removes s from every channel and pattern, as when its client goes away.
+func (r *Registry) UnsubscribeAll(s Subscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := r.subs[s]
+	if e == nil {
+		return
+	}
+	for channel := range e.channels {
+		r.remove(r.channels, s, channel, e.channels)
+	}
+	for pattern := range e.patterns {
+		r.remove(r.patterns, s, pattern, e.patterns)
+	}
+}
+
+// Publish delivers a message to the subscribers of the channel and of every pattern
+// matching it, and returns how many deliveries were made. A subscriber to both the
+// channel and a matching pattern receives the message once for each.
+func (r *Registry) Publish(channel, payload string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := 0
+	for s := range r.channels[channel] {
+		s.Deliver(Message{Channel: channel, Payload: payload})
+		n++
+	}
+	for pattern, subs := range r.patterns {
+		if !query.Match(pattern, channel) {
+			continue
+		}
+		for s := range subs {
+			s.Deliver(Message{Channel: channel, Payload: payload, ViaPattern: true, Pattern: pattern})
+			n++
+		}
+	}
+
+	return n
+}
+
+// Channels returns the sorted channels that have at least one subscriber, limited to
+// those matching a glob pattern unless the pattern is empty. Pattern subscriptions are
+// not counted.
+func (r *Registry) Channels(pattern string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	channels := []string{}
+	for channel := range r.channels {
+		if pattern == "" || query.Match(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// NumSub returns how many subscribers a channel has, not counting pattern subscribers.
+func (r *Registry) NumSub(channel string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.channels[channel])
+}
+
+// NumPat returns how many distinct patterns have at least one subscriber.
+func (r *Registry) NumPat() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.patterns)
+}
+
+// entry returns the subscriptions of s, creating them if needed.
+func (r *Registry) entry(s Subscriber) *subscriptions {
+	e := r.subs[s]
+	if e == nil {
+		e = &subscriptions{channels: make(map[string]struct{}), patterns: make(map[string]struct{})}
+		r.subs[s] = e
+	}
+	return e
+}
+
+// add records s under name in index and in its own set of names.
+func (r *Registry) add(index map[string]map[Subscriber]struct{}, s Subscriber, name string, own map[string]struct{}) {
+	subs := index[name]
+	if subs == nil {
+		subs = make(map[Subscriber]struct{})
+		index[name] = subs
+	}
+	subs[s] = struct{}{}
+	own[name] = struct{}{}
+}
+
+// remove undoes add, dropping names and subscribers that are left with nothing.
+func (r *Registry) remove(index map[string]map[Subscriber]struct{}, s Subscriber, name string, own map[string]struct{}) {
+	if _, ok := own[name]; !ok {
+		return
+	}
+	delete(own, name)
+
+	subs := index[name]
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(index, name)
+	}
+
+	if e := r.subs[s]; e != nil && len(e.channels) == 0 && len(e.patterns) == 0 {
+		delete(r.subs, s)
+	}
+}
+
+func (r *Registry) countLocked(s Subscriber) int {
+	e := r.subs[s]
+	if e == nil {
+		return 0
+	}
+	return len(e.channels) + len(e.patterns)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
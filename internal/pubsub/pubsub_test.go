@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"reflect"
+	"testing"
+)
+
+// recorder is a Subscriber that keeps every message it receives.
+type recorder struct {
+	got []Message
+}
+
+func (r *recorder) Deliver(msg Message) {
+	r.got = append(r.got, msg)
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	a, b := &recorder{}, &recorder{}
+
+	if n := r.Subscribe(a, "news"); n != 1 {
+		t.Errorf("expected 1 subscription, got %d", n)
+	}
+	if n := r.Subscribe(a, "news"); n != 1 {
+		t.Errorf("expected subscribing twice to change nothing, got %d", n)
+	}
+	if n := r.PSubscribe(a, "news.*"); n != 2 {
+		t.Errorf("expected 2 subscriptions, got %d", n)
+	}
+	r.Subscribe(b, "sports")
+	r.PSubscribe(b, "news.*")
+
+	if n := r.Publish("news.tech", "launch"); n != 2 {
+		t.Errorf("expected 2 deliveries, got %d", n)
+	}
+	if n := r.Publish("news", "hello"); n != 1 {
+		t.Errorf("expected 1 delivery, got %d", n)
+	}
+
+	want := []Message{
+		{Channel: "news.tech", Payload: "launch", ViaPattern: true, Pattern: "news.*"},
+		{Channel: "news", Payload: "hello"},
+	}
+	if !reflect.DeepEqual(a.got, want) {
+		t.Errorf("expected %+v, got %+v", want, a.got)
+	}
+
+	if got := r.Channels(""); !reflect.DeepEqual(got, []string{"news", "sports"}) {
+		t.Errorf("unexpected channels %v", got)
+	}
+	if got := r.Channels("s*"); !reflect.DeepEqual(got, []string{"sports"}) {
+		t.Errorf("unexpected channels matching s* %v", got)
+	}
+	if n := r.NumSub("news"); n != 1 {
+		t.Errorf("expected 1 subscriber, got %d", n)
+	}
+	if n := r.NumPat(); n != 1 {
+		t.Errorf("expected 1 distinct pattern, got %d", n)
+	}
+
+	channels, patterns := r.Subscriptions(a)
+	if !reflect.DeepEqual(channels, []string{"news"}) || !reflect.DeepEqual(patterns, []string{"news.*"}) {
+		t.Errorf("unexpected subscriptions %v %v", channels, patterns)
+	}
+
+	if n := r.Unsubscribe(a, "missing"); n != 2 {
+		t.Errorf("expected unsubscribing from an unknown channel to change nothing, got %d", n)
+	}
+	r.UnsubscribeAll(a)
+	if n := r.Count(a); n != 0 {
+		t.Errorf("expected no subscriptions, got %d", n)
+	}
+	if got := r.Channels(""); !reflect.DeepEqual(got, []string{"sports"}) {
+		t.Errorf("expected empty channels to be dropped, got %v", got)
+	}
+	if n := r.PUnsubscribe(b, "news.*"); n != 1 || r.NumPat() != 0 {
+		t.Errorf("expected the pattern to be dropped, got count %d and %d patterns", n, r.NumPat())
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	overflows := 0
+	m := NewMailbox(10, func() { overflows++ })
+
+	m.Deliver(Message{Channel: "ch", Payload: "abc"})
+	m.Deliver(Message{Channel: "ch", Payload: "def"})
+	select {
+	case <-m.Ready():
+	default:
+		t.Fatal("expected the mailbox to be ready")
+	}
+	if got := m.Take(); len(got) != 2 || got[0].Payload != "abc" || got[1].Payload != "def" {
+		t.Errorf("unexpected messages %+v", got)
+	}
+
+	// Taking messages frees their space
+	m.Deliver(Message{Channel: "ch", Payload: "12345678"})
+	if overflows != 0 {
+		t.Fatalf("expected room after Take, got %d overflows", overflows)
+	}
+	m.Take()
+
+	m.Deliver(Message{Channel: "ch", Payload: "1234"})
+	m.Deliver(Message{Channel: "ch", Payload: "5678"})
+	m.Deliver(Message{Channel: "ch", Payload: "9"})
+	if overflows != 1 {
+		t.Errorf("expected one overflow, got %d", overflows)
+	}
+	if got := m.Take(); len(got) != 0 {
+		t.Errorf("expected an overflowed mailbox to drop its messages, got %+v", got)
+	}
+
+	m.Close()
+	for range m.Ready() {
+	}
+}
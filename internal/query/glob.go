@@ -0,0 +1,94 @@
+package query
+
+// Match reports whether s matches the glob pattern used by KEYS and SCAN MATCH.
+// This follows Redis' stringmatchlen byte for byte so clients see the same keys
+// they would from Redis:
+//
+//   - * matches any run of bytes, including none
+//   - ? matches any single byte
+//   - [abc] matches one of the listed bytes, [a-z] a range and [^...] the complement
+//   - \ makes the next byte literal, inside or outside brackets
+func Match(pattern, s string) bool {
+	p, i := 0, 0
+
+	// Where to resume after the most recent star if the rest fails to match: the
+	// star may then swallow one more byte of s
+	starP, starI := -1, 0
+
+	for i < len(s) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				starP, starI = p, i
+				p++
+				continue
+			}
+			if next, ok := matchByte(pattern, p, s[i]); ok {
+				p, i = next, i+1
+				continue
+			}
+		}
+
+		if starP < 0 {
+			return false
+		}
+		starI++
+		p, i = starP+1, starI
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte matches c against the single-byte pattern element at p and returns the
+// position after that element.
+func matchByte(pattern string, p int, c byte) (int, bool) {
+	switch pattern[p] {
+	case '?':
+		return p + 1, true
+	case '\\':
+		if p+1 < len(pattern) {
+			return p + 2, pattern[p+1] == c
+		}
+		return p + 1, c == '\\'
+	case '[':
+		return matchClass(pattern, p+1, c)
+	default:
+		return p + 1, pattern[p] == c
+	}
+}
+
+// matchClass matches c against a bracket expression whose contents start at p and
+// returns the position after its closing bracket. An unterminated class runs to the
+// end of the pattern, as in Redis.
+func matchClass(pattern string, p int, c byte) (int, bool) {
+	negate := p < len(pattern) && pattern[p] == '^'
+	if negate {
+		p++
+	}
+
+	matched := false
+	for p < len(pattern) && pattern[p] != ']' {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			matched = matched || pattern[p+1] == c
+			p += 2
+		case p+2 < len(pattern) && pattern[p+1] == '-':
+			lo, hi := pattern[p], pattern[p+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= c && c <= hi)
+			p += 3
+		default:
+			matched = matched || pattern[p] == c
+			p++
+		}
+	}
+
+	if p < len(pattern) {
+		p++
+	}
+	return p, matched != negate
+}
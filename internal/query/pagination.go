@@ -4,11 +4,15 @@
 package query
 
 import (
-	"sort"
+	"errors"
+	"strconv"
 
 	"github.com/121watts/reredis/internal/store"
 )
 
+// ErrInvalidCursor is returned for a cursor that no earlier page handed out.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 // PaginationResult represents a page of keys with navigation metadata.
 // This enables clients to efficiently iterate through large key sets
 // while maintaining stateless operation and predictable memory usage.
@@ -19,35 +23,35 @@ type PaginationResult struct {
 }
 
 // HandleCursorPagination provides efficient key listing with cursor-based navigation.
-// This enables administrative tools to browse large datasets without overwhelming
-// server memory or network bandwidth, supporting scalable operations.
-func HandleCursorPagination(s *store.Store, cursor string, limit int) PaginationResult {
-	allKeys := s.GetAllKeys()
-	sort.Strings(allKeys)
-
-	var cidx int
-
-	if cursor == "" {
-		cidx = 0
-	} else {
-		cidx = sort.SearchStrings(allKeys, cursor)
-		cidx++
+// It walks the store with the same cursor as SCAN, so each page costs time in
+// proportion to its size rather than to the whole keyspace, and a key that exists
+// throughout the listing appears on some page even if keys are added meanwhile.
+// An empty cursor starts from the beginning. Keys come in no particular order, and a
+// page may hold a few more than limit because the store's buckets are never split.
+func HandleCursorPagination(s *store.Store, cursor string, limit int) (PaginationResult, error) {
+	var pos uint64
+	if cursor != "" {
+		var err error
+		if pos, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return PaginationResult{}, ErrInvalidCursor
+		}
 	}
 
 	keys := make([]string, 0, limit)
-
-	for i := cidx; i < cidx+limit && i < len(allKeys); i++ {
-		k := allKeys[i]
-		keys = append(keys, k)
+	for {
+		var batch []string
+		batch, pos = s.Scan(pos, limit-len(keys))
+		keys = append(keys, batch...)
+
+		if pos == 0 || len(keys) >= limit {
+			break
+		}
 	}
 
-	endIdx := cidx + limit
-	nextCursor := ""
-	hasMore := endIdx < len(allKeys)
-
-	if hasMore {
-		nextCursor = allKeys[endIdx-1]
+	result := PaginationResult{Keys: keys, HasMore: pos != 0}
+	if result.HasMore {
+		result.NextCursor = strconv.FormatUint(pos, 10)
 	}
 
-	return PaginationResult{Keys: keys, NextCursor: nextCursor, HasMore: hasMore}
+	return result, nil
 }
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/121watts/reredis/internal/pubsub"
+)
+
+// serverVersion is the Redis version whose behavior Reredis follows. HELLO reports
+// it so clients enable the features they would use against that version.
+const serverVersion = "7.2.0"
+
+// client is the state of one RESP connection.
+// Everything a command may change about the connection itself lives here.
+type client struct {
+	id     int64
+	name   string       // Set with HELLO SETNAME
+	user   *user        // ACL user the connection runs commands as
+	conn   net.Conn     // Underlying connection
+	w      *ReplyWriter // Encodes replies in the protocol negotiated with HELLO
+	logger *slog.Logger
+
+	// mu is held while a command runs and while pub/sub messages are written, since
+	// those are written from another goroutine
+	mu      sync.Mutex
+	mailbox *pubsub.Mailbox // Receives pub/sub messages; nil until the first subscription
+
+	tx            *transaction // Commands queued since MULTI; nil outside a transaction
+	watched       []string     // Keys passed to WATCH since the last EXEC, DISCARD or UNWATCH
+	watchVersions []uint64     // Version of each watched key when WATCH ran
+}
+
+// newClient assigns the next connection ID and sets up the reply writer.
+func (c *CommandHandler) newClient(conn net.Conn, logger *slog.Logger) *client {
+	return &client{
+		id:     c.nextClientID.Add(1),
+		user:   defaultUser,
+		conn:   conn,
+		w:      NewReplyWriter(conn),
+		logger: logger,
+	}
+}
+
+// user is an ACL user. Only the default user exists so far and it may run every
+// command, but dispatch already asks the user before running each one, so access
+// rules only need to fill in denied.
+type user struct {
+	name   string
+	denied commandFlag // Commands with any of these flags are refused
+}
+
+// defaultUser is the user every connection starts as.
+var defaultUser = &user{name: "default"}
+
+// canRun reports whether the user may run a command.
+func (u *user) canRun(spec *commandSpec) bool {
+	return spec.flags&u.denied == 0
+}
+
+// handleHelloCommand implements HELLO [protover [AUTH username password] [SETNAME name]].
+// It switches the connection's protocol and replies with a map describing the server,
+// which RESP2 clients receive as a flat array.
+func handleHelloCommand(parts []string, cl *client, handler *CommandHandler) {
+	proto := cl.w.Protocol()
+	var name *string
+
+	if len(parts) > 1 {
+		v, err := strconv.Atoi(parts[1])
+		if err != nil {
+			cl.w.Error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v < 2 || v > 3 {
+			cl.w.Error("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+
+	for i := 2; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "AUTH":
+			if i+2 >= len(parts) {
+				cl.w.Error("ERR Syntax error in HELLO option 'auth'")
+				return
+			}
+			// There are no ACLs yet, so only the default user exists and it has no password
+			if parts[i+1] != "default" {
+				cl.w.Error("WRONGPASS invalid username-password pair or user is disabled.")
+				return
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(parts) {
+				cl.w.Error("ERR Syntax error in HELLO option 'setname'")
+				return
+			}
+			if !validClientName(parts[i+1]) {
+				cl.w.Error("ERR Client names cannot contain spaces, newlines or special characters.")
+				return
+			}
+			name = &parts[i+1]
+			i++
+		default:
+			cl.w.Error("ERR Syntax error in HELLO option '" + parts[i] + "'")
+			return
+		}
+	}
+
+	// Options are only applied once the whole command is known to be valid
+	cl.w.SetProtocol(proto)
+	if name != nil {
+		cl.name = *name
+	}
+
+	mode := "standalone"
+	if handler.clusterManager != nil && len(handler.clusterManager.Nodes) >= 3 {
+		mode = "cluster"
+	}
+
+	cl.w.MapHeader(7)
+	cl.w.Bulk("server")
+	cl.w.Bulk("redis")
+	cl.w.Bulk("version")
+	cl.w.Bulk(serverVersion)
+	cl.w.Bulk("proto")
+	cl.w.Integer(int64(proto))
+	cl.w.Bulk("id")
+	cl.w.Integer(cl.id)
+	cl.w.Bulk("mode")
+	cl.w.Bulk(mode)
+	cl.w.Bulk("role")
+	cl.w.Bulk("master")
+	cl.w.Bulk("modules")
+	cl.w.ArrayHeader(0)
+}
+
+// handlePingCommand implements PING [message]. A RESP2 connection in subscribed mode
+// gets the reply as a "pong" array, as in Redis, so it cannot be mistaken for a
+// status reply among the messages.
+func handlePingCommand(parts []string, cl *client, handler *CommandHandler) {
+	if len(parts) > 2 {
+		cl.w.WriteError(wrongArgs("ping"))
+		return
+	}
+
+	if cl.w.Protocol() < 3 && handler.subscribed(cl) {
+		cl.w.ArrayHeader(2)
+		cl.w.Bulk("pong")
+		if len(parts) == 2 {
+			cl.w.Bulk(parts[1])
+		} else {
+			cl.w.Bulk("")
+		}
+		return
+	}
+
+	if len(parts) == 2 {
+		cl.w.Bulk(parts[1])
+	} else {
+		cl.w.SimpleString("PONG")
+	}
+}
+
+// validClientName reports whether name only holds printable ASCII without spaces,
+// the characters Redis allows in a client name.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
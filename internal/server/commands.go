@@ -0,0 +1,451 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// commandFlag describes how a command behaves. Flags decide which ACL categories
+// commands belong to, what COMMAND reports about them and their keys, and which
+// queued commands EXEC sizes its record by. They do not decide what is logged: each
+// write handler logs its own record through logAndApply or applyAndLog.
+type commandFlag uint16
+
+const (
+	flagWrite    commandFlag = 1 << iota // Modifies the keyspace; its handler logs the change
+	flagReadonly                         // Only reads keys
+	flagAdmin                            // Administrative, such as persistence control
+	flagPubSub                           // Part of publish/subscribe
+	flagBlocking                         // May block the client
+	flagFast                             // Runs in constant or logarithmic time
+	flagNoMulti                          // Refused between MULTI and EXEC
+)
+
+// commandFlagNames lists the flags in the order COMMAND reports them.
+var commandFlagNames = []struct {
+	flag commandFlag
+	name string
+}{
+	{flagWrite, "write"},
+	{flagReadonly, "readonly"},
+	{flagAdmin, "admin"},
+	{flagPubSub, "pubsub"},
+	{flagBlocking, "blocking"},
+	{flagFast, "fast"},
+	{flagNoMulti, "no_multi"},
+}
+
+// keySpec gives the positions of a command's key arguments the way COMMAND reports
+// them: the first and last key index and the step between keys. A negative last
+// index counts from the end of the arguments, so -1 is the last one. Commands that
+// take no keys leave it zero.
+type keySpec struct {
+	first, last, step int
+}
+
+// commandSpec declares one command. Everything that depends on which command is
+// running, from dispatch and arity checks to MOVED redirects, WAL replay, ACL checks
+// and the COMMAND introspection replies, is driven from these declarations.
+type commandSpec struct {
+	name  string // Lowercase name; subcommands are written "container|sub"
+	arity int    // Argument count including the name; negative means at least -arity
+	flags commandFlag
+	keys  keySpec
+
+	// handler serves the command over RESP. A subcommand without one is served by its
+	// container's handler.
+	handler func(parts []string, cl *client, handler *CommandHandler)
+
+	// replay applies a logged instance of the command during WAL recovery. Only the
+	// write commands that are logged as themselves have one; EXPIRE, for example, is
+	// logged as PEXPIREAT. EXEC also has one, since a transaction's writes are logged
+	// together as an EXEC record.
+	replay func(c *CommandHandler, cmd []string) error
+
+	subcommands []*commandSpec
+}
+
+// commandTable is every command the server knows, in the order COMMAND lists them.
+// It is filled in by init because the COMMAND handler reads it back.
+var commandTable []*commandSpec
+
+// commands indexes commandTable by name.
+var commands map[string]*commandSpec
+
+func init() {
+	commandTable = []*commandSpec{
+		{name: "get", arity: 2, flags: flagReadonly | flagFast, keys: keySpec{1, 1, 1}, handler: handleGetCommand},
+		{name: "set", arity: -3, flags: flagWrite, keys: keySpec{1, 1, 1}, handler: handleSetCommand, replay: (*CommandHandler).replaySet},
+		{name: "del", arity: -2, flags: flagWrite, keys: keySpec{1, -1, 1}, handler: handleDeleteCommand, replay: (*CommandHandler).replayDelete},
+		{name: "mget", arity: -2, flags: flagReadonly | flagFast, keys: keySpec{1, -1, 1}, handler: handleMGetCommand},
+		{name: "mset", arity: -3, flags: flagWrite, keys: keySpec{1, -1, 2}, handler: handleMSetCommand, replay: (*CommandHandler).replayMSet},
+		{name: "msetnx", arity: -3, flags: flagWrite, keys: keySpec{1, -1, 2}, handler: handleMSetCommand},
+		{name: "getset", arity: 3, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleGetSetCommand},
+		{name: "getdel", arity: 2, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleGetDelCommand},
+		{name: "getex", arity: -2, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleGetExCommand},
+		{name: "append", arity: 3, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleAppendCommand},
+		{name: "strlen", arity: 2, flags: flagReadonly | flagFast, keys: keySpec{1, 1, 1}, handler: handleStrlenCommand},
+		{name: "getrange", arity: 4, flags: flagReadonly, keys: keySpec{1, 1, 1}, handler: handleGetRangeCommand},
+		{name: "setrange", arity: 4, flags: flagWrite, keys: keySpec{1, 1, 1}, handler: handleSetRangeCommand},
+		{name: "incr", arity: 2, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleIncrCommand},
+		{name: "decr", arity: 2, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleIncrCommand},
+		{name: "incrby", arity: 3, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleIncrCommand},
+		{name: "decrby", arity: 3, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleIncrCommand},
+		{name: "incrbyfloat", arity: 3, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleIncrByFloatCommand},
+		{name: "expire", arity: -3, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleExpireCommand},
+		{name: "pexpire", arity: -3, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleExpireCommand},
+		{name: "expireat", arity: -3, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleExpireCommand},
+		{name: "pexpireat", arity: -3, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handleExpireCommand, replay: (*CommandHandler).replayExpireAt},
+		{name: "ttl", arity: 2, flags: flagReadonly | flagFast, keys: keySpec{1, 1, 1}, handler: handleTTLCommand},
+		{name: "pttl", arity: 2, flags: flagReadonly | flagFast, keys: keySpec{1, 1, 1}, handler: handleTTLCommand},
+		{name: "expiretime", arity: 2, flags: flagReadonly | flagFast, keys: keySpec{1, 1, 1}, handler: handleTTLCommand},
+		{name: "pexpiretime", arity: 2, flags: flagReadonly | flagFast, keys: keySpec{1, 1, 1}, handler: handleTTLCommand},
+		{name: "persist", arity: 2, flags: flagWrite | flagFast, keys: keySpec{1, 1, 1}, handler: handlePersistCommand, replay: (*CommandHandler).replayPersist},
+		{name: "exists", arity: -2, flags: flagReadonly | flagFast, keys: keySpec{1, -1, 1}, handler: handleExistsCommand},
+		{name: "touch", arity: -2, flags: flagReadonly | flagFast, keys: keySpec{1, -1, 1}, handler: handleExistsCommand},
+		{name: "type", arity: 2, flags: flagReadonly | flagFast, keys: keySpec{1, 1, 1}, handler: handleTypeCommand},
+		{name: "randomkey", arity: 1, flags: flagReadonly, handler: handleRandomKeyCommand},
+		{name: "unlink", arity: -2, flags: flagWrite | flagFast, keys: keySpec{1, -1, 1}, handler: handleUnlinkCommand},
+		{name: "rename", arity: 3, flags: flagWrite, keys: keySpec{1, 2, 1}, handler: handleRenameCommand, replay: (*CommandHandler).replayRename},
+		{name: "renamenx", arity: 3, flags: flagWrite | flagFast, keys: keySpec{1, 2, 1}, handler: handleRenameCommand},
+		{name: "copy", arity: -3, flags: flagWrite, keys: keySpec{1, 2, 1}, handler: handleCopyCommand, replay: (*CommandHandler).replayCopy},
+		{name: "scan", arity: -2, flags: flagReadonly, handler: handleScanCommand},
+		{name: "keys", arity: 2, flags: flagReadonly, handler: handleKeysCommand},
+		{name: "info", arity: -1, handler: handleInfoCommand},
+		{name: "multi", arity: 1, flags: flagFast, handler: handleMultiCommand},
+		{name: "exec", arity: 1, handler: handleExecCommand, replay: (*CommandHandler).replayExec},
+		{name: "discard", arity: 1, flags: flagFast, handler: handleDiscardCommand},
+		{name: "watch", arity: -2, flags: flagFast | flagNoMulti, keys: keySpec{1, -1, 1}, handler: handleWatchCommand},
+		{name: "unwatch", arity: 1, flags: flagFast, handler: handleUnwatchCommand},
+		{name: "bgrewriteaof", arity: 1, flags: flagAdmin | flagNoMulti, handler: handleBGRewriteAOFCommand},
+		{name: "save", arity: 1, flags: flagAdmin | flagNoMulti, handler: handleSaveCommand},
+		{name: "bgsave", arity: 1, flags: flagAdmin | flagNoMulti, handler: handleBGSaveCommand},
+		{name: "lastsave", arity: 1, flags: flagAdmin | flagFast, handler: handleLastSaveCommand},
+		{name: "hello", arity: -1, flags: flagFast, handler: handleHelloCommand},
+		{name: "ping", arity: -1, flags: flagFast, handler: handlePingCommand},
+		{name: "subscribe", arity: -2, flags: flagPubSub | flagNoMulti, handler: handleSubscribeCommand},
+		{name: "psubscribe", arity: -2, flags: flagPubSub | flagNoMulti, handler: handleSubscribeCommand},
+		{name: "unsubscribe", arity: -1, flags: flagPubSub | flagNoMulti, handler: handleUnsubscribeCommand},
+		{name: "punsubscribe", arity: -1, flags: flagPubSub | flagNoMulti, handler: handleUnsubscribeCommand},
+		{name: "publish", arity: 3, flags: flagPubSub | flagFast, handler: handlePublishCommand},
+		{name: "pubsub", arity: -2, handler: handlePubSubCommand, subcommands: []*commandSpec{
+			{name: "pubsub|channels", arity: -2, flags: flagPubSub, handler: handlePubSubChannelsCommand},
+			{name: "pubsub|numsub", arity: -2, flags: flagPubSub, handler: handlePubSubNumSubCommand},
+			{name: "pubsub|numpat", arity: 2, flags: flagPubSub, handler: handlePubSubNumPatCommand},
+		}},
+		{name: "config", arity: -2, handler: handleConfigCommand, subcommands: []*commandSpec{
+			{name: "config|get", arity: -3, flags: flagAdmin, handler: handleConfigGetCommand},
+			{name: "config|set", arity: -4, flags: flagAdmin, handler: handleConfigSetCommand},
+		}},
+		{name: "cluster", arity: -2, handler: handleClusterCommand, subcommands: []*commandSpec{
+			{name: "cluster|meet", arity: 4, flags: flagAdmin},
+			{name: "cluster|nodes", arity: 2},
+			{name: "cluster|info", arity: 2},
+		}},
+		{name: "command", arity: -1, handler: handleCommandCommand, subcommands: []*commandSpec{
+			{name: "command|count", arity: 2, handler: handleCommandCountCommand},
+			{name: "command|info", arity: -2, handler: handleCommandInfoCommand},
+			{name: "command|getkeys", arity: -3, handler: handleCommandGetKeysCommand},
+		}},
+	}
+
+	commands = make(map[string]*commandSpec, len(commandTable))
+	for _, spec := range commandTable {
+		commands[spec.name] = spec
+		for _, sub := range spec.subcommands {
+			if sub.handler == nil {
+				sub.handler = spec.handler
+			}
+		}
+	}
+}
+
+// lookupCommand returns the declaration a request runs under, or nil for an unknown
+// command. Requests naming a declared subcommand resolve to the subcommand; any other
+// request for a container resolves to the container, whose handler reports the error.
+func lookupCommand(parts []string) *commandSpec {
+	spec := commands[strings.ToLower(parts[0])]
+	if spec == nil || len(spec.subcommands) == 0 || len(parts) < 2 {
+		return spec
+	}
+
+	if sub := lookupCommandName(spec.name + "|" + parts[1]); sub != nil {
+		return sub
+	}
+	return spec
+}
+
+// lookupCommandName returns the declaration of a command or "container|sub" name, as
+// COMMAND INFO accepts them, or nil if there is none.
+func lookupCommandName(name string) *commandSpec {
+	name = strings.ToLower(name)
+	container, _, isSub := strings.Cut(name, "|")
+
+	spec := commands[container]
+	if spec == nil || !isSub {
+		return spec
+	}
+
+	for _, sub := range spec.subcommands {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// arityOK reports whether a request with n arguments, counting the name, fits the
+// declared arity.
+func (s *commandSpec) arityOK(n int) bool {
+	if s.arity < 0 {
+		return n >= -s.arity
+	}
+	return n == s.arity
+}
+
+// keyArgs returns the key arguments of a request, which must already fit the arity.
+func (s *commandSpec) keyArgs(parts []string) []string {
+	if s.keys.step == 0 {
+		return nil
+	}
+
+	last := s.keys.last
+	if last < 0 {
+		last += len(parts)
+	}
+
+	var keys []string
+	for i := s.keys.first; i <= last && i < len(parts); i += s.keys.step {
+		keys = append(keys, parts[i])
+	}
+	return keys
+}
+
+// aclCategories returns the ACL categories the command belongs to. They are derived
+// from its flags, and commands that are not fast are in @slow, as in Redis.
+func (s *commandSpec) aclCategories() []string {
+	var categories []string
+	if s.flags&flagWrite != 0 {
+		categories = append(categories, "@write")
+	}
+	if s.flags&flagReadonly != 0 {
+		categories = append(categories, "@read")
+	}
+	if s.flags&flagAdmin != 0 {
+		categories = append(categories, "@admin", "@dangerous")
+	}
+	if s.flags&flagPubSub != 0 {
+		categories = append(categories, "@pubsub")
+	}
+	if s.flags&flagBlocking != 0 {
+		categories = append(categories, "@blocking")
+	}
+	if s.flags&flagFast != 0 {
+		categories = append(categories, "@fast")
+	} else {
+		categories = append(categories, "@slow")
+	}
+	return categories
+}
+
+// checkCommand validates a request against the command table before it runs: the
+// command must exist and fit its arity, and the keys it names must be served by this
+// node. It returns the declaration the request runs under.
+func (c *CommandHandler) checkCommand(parts []string) (*commandSpec, error) {
+	spec := lookupCommand(parts)
+	if spec == nil {
+		return nil, unknownCommand(parts)
+	}
+
+	if !spec.arityOK(len(parts)) {
+		return nil, wrongArgs(spec.name)
+	}
+
+	if err := c.checkKeys(spec.keyArgs(parts)); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// handleCommand dispatches a RESP request through the command table, checking it and
+// the client's permissions before the command's handler runs. RESP2 connections in
+// subscribed mode are limited to pub/sub commands. After MULTI, commands are queued
+// for EXEC instead, once the same checks pass.
+func handleCommand(parts []string, cl *client, handler *CommandHandler) {
+	spec, err := handler.checkCommand(parts)
+	if err == nil && !cl.user.canRun(spec) {
+		err = &CodedError{Code: "NOPERM", Msg: fmt.Sprintf("User %s has no permissions to run the '%s' command", cl.user.name, spec.name)}
+	}
+
+	// RESP3 keeps messages apart from replies as pushes, so only RESP2 connections are
+	// restricted while subscribed
+	if err == nil && cl.w.Protocol() < 3 && !allowedWhileSubscribed(spec) && handler.subscribed(cl) {
+		err = errSubscribedMode(spec)
+	}
+
+	if cl.tx != nil && !controlsTransaction(spec) {
+		handler.queueCommand(cl, spec, parts, err)
+		return
+	}
+
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	// The transaction commands only change the client's own state, except EXEC, which
+	// takes execMu exclusively itself
+	if controlsTransaction(spec) {
+		spec.handler(parts, cl, handler)
+		return
+	}
+
+	handler.execMu.RLock()
+	defer handler.execMu.RUnlock()
+	spec.handler(parts, cl, handler)
+}
+
+// unknownCommand returns Redis' error for a command name it does not recognize.
+func unknownCommand(parts []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "unknown command '%s', with args beginning with: ", parts[0])
+	for _, arg := range parts[1:] {
+		fmt.Fprintf(&b, "'%s' ", arg)
+	}
+	return errors.New(b.String())
+}
+
+// handleCommandCommand implements COMMAND, which describes every command, and reports
+// unknown COMMAND subcommands.
+func handleCommandCommand(parts []string, cl *client, handler *CommandHandler) {
+	if len(parts) > 1 {
+		cl.w.Error(fmt.Sprintf("ERR unknown subcommand '%s'. Try COMMAND HELP.", parts[1]))
+		return
+	}
+
+	cl.w.ArrayHeader(len(commandTable))
+	for _, spec := range commandTable {
+		writeCommandInfo(cl.w, spec)
+	}
+}
+
+// handleCommandCountCommand implements COMMAND COUNT.
+func handleCommandCountCommand(parts []string, cl *client, handler *CommandHandler) {
+	cl.w.Integer(int64(len(commandTable)))
+}
+
+// handleCommandInfoCommand implements COMMAND INFO name [name ...]. Unknown names get
+// a null entry so replies line up with the names asked for.
+func handleCommandInfoCommand(parts []string, cl *client, handler *CommandHandler) {
+	names := parts[2:]
+	cl.w.ArrayHeader(len(names))
+	for _, name := range names {
+		spec := lookupCommandName(name)
+		if spec == nil {
+			cl.w.NullArray()
+			continue
+		}
+		writeCommandInfo(cl.w, spec)
+	}
+}
+
+// handleCommandGetKeysCommand implements COMMAND GETKEYS, which returns the keys a
+// full command line would touch.
+func handleCommandGetKeysCommand(parts []string, cl *client, handler *CommandHandler) {
+	args := parts[2:]
+	spec := lookupCommand(args)
+	switch {
+	case spec == nil:
+		cl.w.Error("ERR Invalid command specified")
+	case !spec.arityOK(len(args)):
+		cl.w.Error("ERR Invalid number of arguments specified for command")
+	case spec.keys.step == 0:
+		cl.w.Error("ERR The command has no key arguments")
+	default:
+		cl.w.BulkArray(spec.keyArgs(args))
+	}
+}
+
+// writeCommandInfo writes a command's description in the layout of Redis 7's COMMAND
+// INFO: name, arity, flags, first key, last key, key step, ACL categories, tips, key
+// specifications and subcommands.
+func writeCommandInfo(w *ReplyWriter, spec *commandSpec) {
+	w.ArrayHeader(10)
+	w.Bulk(spec.name)
+	w.Integer(int64(spec.arity))
+
+	var flags []string
+	for _, f := range commandFlagNames {
+		if spec.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	writeStatusSet(w, flags)
+
+	w.Integer(int64(spec.keys.first))
+	w.Integer(int64(spec.keys.last))
+	w.Integer(int64(spec.keys.step))
+	writeStatusSet(w, spec.aclCategories())
+	w.ArrayHeader(0) // No command tips
+
+	if spec.keys.step == 0 {
+		w.ArrayHeader(0)
+	} else {
+		writeKeySpec(w, spec)
+	}
+
+	w.ArrayHeader(len(spec.subcommands))
+	for _, sub := range spec.subcommands {
+		writeCommandInfo(w, sub)
+	}
+}
+
+// writeKeySpec writes a one-element list of Redis 7 key specifications describing the
+// command's key range. lastkey is relative to the first key, as in Redis.
+func writeKeySpec(w *ReplyWriter, spec *commandSpec) {
+	access := "RO"
+	if spec.flags&flagWrite != 0 {
+		access = "RW"
+	}
+
+	lastKey := spec.keys.last
+	if lastKey >= 0 {
+		lastKey -= spec.keys.first
+	}
+
+	w.ArrayHeader(1)
+	w.MapHeader(3)
+	w.Bulk("flags")
+	writeStatusSet(w, []string{access})
+	w.Bulk("begin_search")
+	w.MapHeader(2)
+	w.Bulk("type")
+	w.Bulk("index")
+	w.Bulk("spec")
+	w.MapHeader(1)
+	w.Bulk("index")
+	w.Integer(int64(spec.keys.first))
+	w.Bulk("find_keys")
+	w.MapHeader(2)
+	w.Bulk("type")
+	w.Bulk("range")
+	w.Bulk("spec")
+	w.MapHeader(3)
+	w.Bulk("lastkey")
+	w.Integer(int64(lastKey))
+	w.Bulk("keystep")
+	w.Integer(int64(spec.keys.step))
+	w.Bulk("limit")
+	w.Integer(0)
+}
+
+// writeStatusSet writes a set of status strings, the type Redis uses for flags and
+// ACL categories in COMMAND replies.
+func writeStatusSet(w *ReplyWriter, items []string) {
+	w.SetHeader(len(items))
+	for _, item := range items {
+		w.SimpleString(item)
+	}
+}
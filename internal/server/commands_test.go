@@ -0,0 +1,70 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommandTable(t *testing.T) {
+	for _, spec := range commandTable {
+		if spec.handler == nil {
+			t.Errorf("%s has no handler", spec.name)
+		}
+		// EXEC records hold the writes of a transaction
+		if spec.replay != nil && spec.flags&flagWrite == 0 && spec.name != "exec" {
+			t.Errorf("%s can be replayed from the WAL but is not a write command", spec.name)
+		}
+		for _, sub := range spec.subcommands {
+			if !strings.HasPrefix(sub.name, spec.name+"|") {
+				t.Errorf("subcommand %s is not named after %s", sub.name, spec.name)
+			}
+			if sub.handler == nil {
+				t.Errorf("%s has no handler", sub.name)
+			}
+		}
+	}
+}
+
+func TestLookupCommand(t *testing.T) {
+	tests := []struct {
+		parts []string
+		want  string
+	}{
+		{[]string{"GET", "k"}, "get"},
+		{[]string{"Cluster", "meet", "h", "p"}, "cluster|meet"},
+		{[]string{"CLUSTER", "RESET"}, "cluster"},
+		{[]string{"COMMAND"}, "command"},
+		{[]string{"NOPE"}, ""},
+	}
+
+	for _, tt := range tests {
+		spec := lookupCommand(tt.parts)
+		got := ""
+		if spec != nil {
+			got = spec.name
+		}
+		if got != tt.want {
+			t.Errorf("lookupCommand(%q): expected %q, got %q", tt.parts, tt.want, got)
+		}
+	}
+}
+
+func TestKeyArgs(t *testing.T) {
+	tests := []struct {
+		keys  keySpec
+		parts []string
+		want  []string
+	}{
+		{keySpec{}, []string{"INFO"}, nil},
+		{keySpec{1, 1, 1}, []string{"SET", "k", "v"}, []string{"k"}},
+		{keySpec{1, -1, 1}, []string{"DEL", "a", "b", "c"}, []string{"a", "b", "c"}},
+		{keySpec{1, -1, 2}, []string{"MSET", "a", "1", "b", "2"}, []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		spec := &commandSpec{keys: tt.keys}
+		if got := spec.keyArgs(tt.parts); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("keyArgs(%q) with %+v: expected %q, got %q", tt.parts, tt.keys, tt.want, got)
+		}
+	}
+}
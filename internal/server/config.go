@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/121watts/reredis/internal/query"
+)
+
+// configParam is a setting CONFIG GET and CONFIG SET can reach while the server runs.
+// parse checks a new value and returns the function that applies it, so CONFIG SET
+// can refuse a bad value before changing anything.
+type configParam struct {
+	name  string
+	get   func(c *CommandHandler) string
+	parse func(c *CommandHandler, value string) (apply func(), err error)
+}
+
+// configParams is every parameter CONFIG knows. The rest of the configuration is only
+// read at startup.
+var configParams = []configParam{
+	{
+		name: "notify-keyspace-events",
+		get: func(c *CommandHandler) string {
+			return notifyClass(c.notifyClasses.Load()).String()
+		},
+		parse: func(c *CommandHandler, value string) (func(), error) {
+			classes, err := parseNotifyClasses(value)
+			if err != nil {
+				return nil, err
+			}
+			return func() { c.notifyClasses.Store(uint32(classes)) }, nil
+		},
+	},
+}
+
+// lookupConfigParam returns the parameter with the given name, or nil.
+func lookupConfigParam(name string) *configParam {
+	for i := range configParams {
+		if strings.EqualFold(configParams[i].name, name) {
+			return &configParams[i]
+		}
+	}
+	return nil
+}
+
+// handleConfigCommand reports unknown CONFIG subcommands.
+func handleConfigCommand(parts []string, cl *client, handler *CommandHandler) {
+	cl.w.Error(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", parts[1]))
+}
+
+// handleConfigGetCommand implements CONFIG GET pattern [pattern ...], replying with
+// every parameter whose name matches one of the glob patterns and its value.
+func handleConfigGetCommand(parts []string, cl *client, handler *CommandHandler) {
+	var matched []*configParam
+	for i := range configParams {
+		for _, pattern := range parts[2:] {
+			if query.Match(strings.ToLower(pattern), configParams[i].name) {
+				matched = append(matched, &configParams[i])
+				break
+			}
+		}
+	}
+
+	cl.w.MapHeader(len(matched))
+	for _, p := range matched {
+		cl.w.Bulk(p.name)
+		cl.w.Bulk(p.get(handler))
+	}
+}
+
+// handleConfigSetCommand implements CONFIG SET parameter value [parameter value ...].
+// Every pair is checked before any is applied, so a bad one changes nothing.
+func handleConfigSetCommand(parts []string, cl *client, handler *CommandHandler) {
+	args := parts[2:]
+	if len(args)%2 != 0 {
+		cl.w.WriteError(wrongArgs("config|set"))
+		return
+	}
+
+	changes := make([]func(), 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		p := lookupConfigParam(args[i])
+		if p == nil {
+			cl.w.Error(fmt.Sprintf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[i]))
+			return
+		}
+
+		apply, err := p.parse(handler, args[i+1])
+		if err != nil {
+			cl.w.Error(fmt.Sprintf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", p.name, err))
+			return
+		}
+		changes = append(changes, apply)
+	}
+
+	for _, apply := range changes {
+		apply()
+	}
+	cl.w.SimpleString("OK")
+}
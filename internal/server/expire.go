@@ -0,0 +1,216 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/121watts/reredis/internal/store"
+)
+
+// expireUnits maps each EXPIRE-style command to the unit of its time argument, named
+// after the SET option that takes the same kind of value.
+var expireUnits = map[string]string{
+	"EXPIRE":    "EX",
+	"PEXPIRE":   "PX",
+	"EXPIREAT":  "EXAT",
+	"PEXPIREAT": "PXAT",
+}
+
+// HandleExpire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT with their NX, XX,
+// GT and LT options, and reports whether the expiration was set. Every variant is
+// logged as PEXPIREAT with an absolute deadline, or as DEL when the deadline has
+// already passed and the key is deleted.
+func (c *CommandHandler) HandleExpire(parts []string) (bool, error) {
+	cmd := strings.ToUpper(parts[0])
+	k := parts[1]
+
+	n, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return false, errNotInteger
+	}
+
+	cond, err := parseExpireCondition(parts[3:])
+	if err != nil {
+		return false, err
+	}
+
+	expiration, ok := absoluteExpiration(expireUnits[cmd], n, time.Now())
+	if !ok {
+		return false, invalidExpireTime(cmd)
+	}
+
+	var res store.ExpireResult
+	err = c.applyAndLog(parts, func() []string {
+		res = c.applyExpire(k, expiration, cond)
+		switch {
+		case res.Removed:
+			return []string{"DEL", k}
+		case res.Set:
+			return []string{"PEXPIREAT", k, strconv.FormatInt(expiration.UnixMilli(), 10)}
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+
+	needsStats := c.clusterManager != nil && len(c.clusterManager.Nodes) > 1
+	switch {
+	case res.Removed:
+		c.broadcast(&OperationResult{Key: k, Action: "del", NeedsStats: needsStats})
+		c.notify(notifyGeneric, "del", k)
+	case res.Set:
+		c.broadcast(&OperationResult{Key: k, Value: strconv.FormatInt(expiration.UnixMilli(), 10), Action: "expire"})
+		c.notify(notifyGeneric, "expire", k)
+	}
+
+	return res.Set, nil
+}
+
+// parseExpireCondition parses the options that follow EXPIRE key time. XX may be
+// combined with GT or LT, but NX excludes the others.
+func parseExpireCondition(args []string) (store.ExpireCondition, error) {
+	var cond store.ExpireCondition
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case "NX":
+			cond.NX = true
+		case "XX":
+			cond.XX = true
+		case "GT":
+			cond.GT = true
+		case "LT":
+			cond.LT = true
+		default:
+			return cond, fmt.Errorf("Unsupported option %s", arg)
+		}
+	}
+
+	switch {
+	case cond.NX && (cond.XX || cond.GT || cond.LT):
+		return cond, errors.New("NX and XX, GT or LT options at the same time are not compatible")
+	case cond.GT && cond.LT:
+		return cond, errors.New("GT and LT options at the same time are not compatible")
+	}
+
+	return cond, nil
+}
+
+// applyExpire sets a key's expiration and, if that deleted the key, updates the
+// cluster statistics. This is shared by live commands and WAL replay.
+func (c *CommandHandler) applyExpire(k string, expiration time.Time, cond store.ExpireCondition) store.ExpireResult {
+	res := c.store.Expire(k, expiration, cond)
+	if res.Removed && c.clusterManager != nil {
+		c.clusterManager.DecrementKeyCount()
+		c.clusterManager.SubtractByteSize(len(k), len(res.Value))
+	}
+	return res
+}
+
+// HandleTTL implements TTL, PTTL, EXPIRETIME and PEXPIRETIME. Like Redis it returns
+// -2 for a missing key and -1 for a key without an expiration; otherwise TTL and PTTL
+// give the time left and EXPIRETIME and PEXPIRETIME the absolute Unix deadline.
+func (c *CommandHandler) HandleTTL(parts []string) (int64, error) {
+	expiration, ok := c.store.Expiration(parts[1])
+	switch {
+	case !ok:
+		return -2, nil
+	case expiration.IsZero():
+		return -1, nil
+	}
+
+	switch strings.ToUpper(parts[0]) {
+	case "TTL":
+		// Rounded to the nearest second, as Redis does
+		return (time.Until(expiration).Milliseconds() + 500) / 1000, nil
+	case "PTTL":
+		return time.Until(expiration).Milliseconds(), nil
+	case "EXPIRETIME":
+		return expiration.Unix(), nil
+	default:
+		return expiration.UnixMilli(), nil
+	}
+}
+
+// HandlePersist implements PERSIST and reports whether an expiration was removed.
+func (c *CommandHandler) HandlePersist(parts []string) (bool, error) {
+	k := parts[1]
+
+	var persisted bool
+	err := c.applyAndLog(parts, func() []string {
+		if persisted = c.store.Persist(k); !persisted {
+			return nil
+		}
+		return []string{"PERSIST", k}
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if persisted {
+		c.broadcast(&OperationResult{Key: k, Action: "persist"})
+		c.notify(notifyGeneric, "persist", k)
+	}
+
+	return persisted, nil
+}
+
+// replayExpireAt applies a logged PEXPIREAT, which live EXPIRE commands of every
+// form are logged as.
+func (c *CommandHandler) replayExpireAt(cmd []string) error {
+	if len(cmd) != 3 {
+		return wrongArgs("PEXPIREAT")
+	}
+
+	ms, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expire time in 'PEXPIREAT': %q", cmd[2])
+	}
+
+	c.applyExpire(cmd[1], time.UnixMilli(ms), store.ExpireCondition{})
+	return nil
+}
+
+// replayPersist applies a logged PERSIST.
+func (c *CommandHandler) replayPersist(cmd []string) error {
+	if len(cmd) != 2 {
+		return wrongArgs("PERSIST")
+	}
+
+	c.store.Persist(cmd[1])
+	return nil
+}
+
+func handleExpireCommand(parts []string, cl *client, handler *CommandHandler) {
+	set, err := handler.HandleExpire(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Integer(int64(boolToInt(set)))
+}
+
+func handleTTLCommand(parts []string, cl *client, handler *CommandHandler) {
+	ttl, err := handler.HandleTTL(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Integer(ttl)
+}
+
+func handlePersistCommand(parts []string, cl *client, handler *CommandHandler) {
+	persisted, err := handler.HandlePersist(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Integer(int64(boolToInt(persisted)))
+}
@@ -1,12 +1,20 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/121watts/reredis/internal/cluster"
+	"github.com/121watts/reredis/internal/datadir"
 	"github.com/121watts/reredis/internal/observer"
+	"github.com/121watts/reredis/internal/pubsub"
 	"github.com/121watts/reredis/internal/store"
 	"github.com/121watts/reredis/internal/wal"
 )
@@ -17,18 +25,96 @@ type CommandHandler struct {
 	walWriter      *wal.Writer
 	clusterManager *cluster.Manager
 	logger         *slog.Logger
+	dataDir        *datadir.Dir
+	writeMu        sync.Mutex // Keeps WAL order identical to the order writes reach the store
+
+	// execMu is held shared by every running command and exclusively by EXEC, so a
+	// transaction's commands run without others in between
+	execMu sync.RWMutex
+
+	// txRecords collects the WAL records of the transaction EXEC is running, which are
+	// logged together once it ends. It is nil outside EXEC and only changes while EXEC
+	// holds execMu exclusively and writeMu.
+	txRecords [][]string
+
+	autoRewritePercentage int
+	autoRewriteMinSize    int64
+	maxBulkLen            int64 // Largest request argument accepted from clients
+	walMaxRecordSize      int64 // Largest WAL record appended or replayed
+
+	pubsub      *pubsub.Registry // Channels and patterns PUBLISH delivers to
+	pubsubLimit int              // Bytes of messages that may wait for one subscriber
+
+	notifyClasses atomic.Uint32 // Keyspace notifications to publish, a notifyClass set by notify-keyspace-events
+
+	nextClientID atomic.Int64 // Source of the IDs HELLO reports for each connection
 }
 
+// NewCommandHandler returns a handler serving commands against the store. It asks the
+// store to report expired and evicted keys, which it announces as keyspace
+// notifications.
 func NewCommandHandler(store *store.Store, hub *observer.Hub, ww *wal.Writer, cm *cluster.Manager, logger *slog.Logger) *CommandHandler {
-	return &CommandHandler{
+	c := &CommandHandler{
 		store:          store,
 		hub:            hub,
 		walWriter:      ww,
 		clusterManager: cm,
 		logger:         logger,
+		pubsub:         pubsub.NewRegistry(),
 	}
+
+	store.OnExpire(func(key string) { c.notify(notifyExpired, "expired", key) })
+	store.OnEvict(func(key string) { c.notify(notifyEvicted, "evicted", key) })
+
+	return c
+}
+
+// errKeyNotFound is returned by HandleGet for a missing key.
+var errKeyNotFound = errors.New("key not found")
+
+// errSyntax is Redis' error for options it does not understand or that conflict.
+var errSyntax = errors.New("syntax error")
+
+// errNotInteger is returned for arguments that must be 64-bit integers.
+var errNotInteger = errors.New("value is not an integer or out of range")
+
+// wrongArgs returns the error Redis gives for a command called with the wrong arity.
+func wrongArgs(cmd string) error {
+	return fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(cmd))
+}
+
+// invalidExpireTime returns the error for an expiration that is out of range.
+func invalidExpireTime(cmd string) error {
+	return fmt.Errorf("invalid expire time in '%s' command", strings.ToLower(cmd))
+}
+
+// MovedError reports that a key's slot is served by another cluster node.
+// Each transport renders it in its own way, e.g. as a -MOVED reply over RESP.
+type MovedError struct {
+	Slot int32
+	Host string
+	Port string
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("MOVED %d %s:%s", e.Slot, e.Host, e.Port)
+}
+
+// CodedError is an error RESP clients receive under its own error code, such as
+// CROSSSLOT, instead of the generic ERR.
+type CodedError struct {
+	Code string
+	Msg  string
+}
+
+func (e *CodedError) Error() string {
+	return e.Code + " " + e.Msg
 }
 
+// errCrossSlot is returned for multi-key commands whose keys hash to different slots,
+// which a cluster cannot serve from one node.
+var errCrossSlot = &CodedError{Code: "CROSSSLOT", Msg: "Keys in request don't hash to the same slot"}
+
 type OperationResult struct {
 	Key        string
 	Value      string
@@ -36,80 +122,247 @@ type OperationResult struct {
 	NeedsStats bool
 }
 
-func (c *CommandHandler) HandleSet(parts []string) (*OperationResult, error) {
-	const expectedParts = 3
-	if len(parts) != expectedParts {
-		return nil, fmt.Errorf("wrong number of arguments for 'SET'")
+// SetReply is what SET tells the client: whether the value was stored and, when the
+// GET option was given, the value it replaced.
+type SetReply struct {
+	Written bool   // Whether the NX or XX condition held and the value was stored
+	Get     bool   // GET was given, so the old value is returned instead of OK
+	Old     string // Previous value, valid when Existed is set
+	Existed bool   // Whether the key held a value before
+}
+
+// HandleSet is the single mutation path for SET, shared by the RESP and WebSocket
+// servers: it redirects keys owned by other nodes, logs to the WAL, updates the
+// cluster counters and broadcasts the change to WebSocket clients. It accepts the
+// EX, PX, EXAT, PXAT, KEEPTTL, NX, XX and GET options. The NX and XX conditions are
+// decided by the store in the same step as the write, and the WAL records the write
+// that resulted, with its expiration as PXAT.
+func (c *CommandHandler) HandleSet(parts []string) (SetReply, *OperationResult, error) {
+	if _, err := c.checkCommand(parts); err != nil {
+		return SetReply{}, nil, err
 	}
 
 	k, v := parts[1], parts[2]
 
-	// Write to WAL first
-	err := c.walWriter.WriteCommand(parts)
+	opts, get, err := parseSetOptions(parts[3:], time.Now())
 	if err != nil {
-		c.logger.Error("failed to write to WAL", "error", err)
-		return nil, fmt.Errorf("failed to write to WAL: %w", err)
+		return SetReply{}, nil, err
 	}
 
-	// Check if this is a new key to update cluster statistics
-	oldValue, existsBefore := c.store.Get(k)
-
-	c.store.Set(k, v)
-
-	// Update cluster statistics
-	if c.clusterManager != nil {
-		if !existsBefore {
-			// New key: increment count and add byte size
-			c.clusterManager.IncrementKeyCount()
-			c.clusterManager.AddByteSize(len(k), len(v))
-		} else {
-			// Existing key: update byte size (subtract old, add new)
-			c.clusterManager.SubtractByteSize(len(k), len(oldValue))
-			c.clusterManager.AddByteSize(len(k), len(v))
+	var res store.SetResult
+	err = c.applyAndLog(parts, func() []string {
+		res = c.applySetOptions(k, v, opts)
+		if !res.Written || (res.Removed && !res.Existed) {
+			return nil
 		}
+		return setCommand(k, v, res.Expiration)
+	})
+	if err != nil {
+		return SetReply{}, nil, err
 	}
 
-	return &OperationResult{
+	reply := SetReply{Written: res.Written, Get: get, Old: res.Old, Existed: res.Existed}
+	if !res.Written || (res.Removed && !res.Existed) {
+		return reply, nil, nil
+	}
+
+	result := &OperationResult{
 		Key:        k,
 		Value:      v,
 		Action:     "set",
 		NeedsStats: c.clusterManager != nil && len(c.clusterManager.Nodes) > 1,
-	}, nil
+	}
+	if res.Removed {
+		result.Value, result.Action = "", "del"
+	}
+	c.broadcast(result)
+
+	switch {
+	case res.Removed:
+		c.notify(notifyGeneric, "del", k)
+	case !opts.Expiration.IsZero():
+		c.notify(notifyString, "set", k)
+		c.notify(notifyGeneric, "expire", k)
+	default:
+		c.notify(notifyString, "set", k)
+	}
+
+	return reply, result, nil
 }
 
-func (c *CommandHandler) HandleGet(parts []string) (string, error) {
-	const expectedParts = 2
+// parseSetOptions parses the options that follow SET key value. At most one of EX,
+// PX, EXAT, PXAT and KEEPTTL may be given, and NX and XX exclude each other.
+func parseSetOptions(args []string, now time.Time) (opts store.SetOptions, get bool, err error) {
+	hasExpiration := false
+
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX", "XX":
+			cond := store.SetIfNotExists
+			if opt == "XX" {
+				cond = store.SetIfExists
+			}
+			if opts.Condition != store.SetAlways && opts.Condition != cond {
+				return opts, false, errSyntax
+			}
+			opts.Condition = cond
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			if hasExpiration {
+				return opts, false, errSyntax
+			}
+			opts.KeepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpiration || opts.KeepTTL || i+1 >= len(args) {
+				return opts, false, errSyntax
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return opts, false, errNotInteger
+			}
+			expiration, ok := absoluteExpiration(opt, n, now)
+			if n <= 0 || !ok {
+				return opts, false, invalidExpireTime("SET")
+			}
+			opts.Expiration, hasExpiration = expiration, true
+			i++
+		default:
+			return opts, false, errSyntax
+		}
+	}
+
+	return opts, get, nil
+}
+
+// absoluteExpiration converts the argument of an EX, PX, EXAT or PXAT option to the
+// absolute time it names. ok is false if that time does not fit in Unix milliseconds.
+func absoluteExpiration(unit string, n int64, now time.Time) (time.Time, bool) {
+	ms := n
+	if unit == "EX" || unit == "EXAT" {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return time.Time{}, false
+		}
+		ms = n * 1000
+	}
+
+	if unit == "EX" || unit == "PX" {
+		base := now.UnixMilli()
+		if (ms > 0 && base > math.MaxInt64-ms) || (ms < 0 && base < math.MinInt64-ms) {
+			return time.Time{}, false
+		}
+		ms += base
+	}
+
+	return time.UnixMilli(ms), true
+}
 
-	if len(parts) != expectedParts {
-		return "", fmt.Errorf("wrong number of arguments for 'GET'")
+// setCommand returns the WAL record for a SET. An expiration is logged as an absolute
+// Unix time in milliseconds, like Redis' PXAT, so replay restores the key's remaining
+// lifetime no matter how long after the write it runs.
+func setCommand(k, v string, expiration time.Time) []string {
+	if expiration.IsZero() {
+		return []string{"SET", k, v}
 	}
 
-	k := parts[1]
-	v, ok := c.store.Get(k)
+	return []string{"SET", k, v, "PXAT", strconv.FormatInt(expiration.UnixMilli(), 10)}
+}
+
+// applySet stores a value and keeps the cluster key and byte counters in step.
+// This is shared by live SET commands and WAL replay so both produce the same state.
+func (c *CommandHandler) applySet(k, v string) {
+	c.applySetOptions(k, v, store.SetOptions{})
+}
+
+// applySetWithExpiration is applySet for a key that expires at an absolute time.
+// A deadline that has already passed deletes the key instead, which is how keys that
+// expired while the node was down are dropped during replay.
+func (c *CommandHandler) applySetWithExpiration(k, v string, expiration time.Time) {
+	c.applySetOptions(k, v, store.SetOptions{Expiration: expiration})
+}
+
+// applySetOptions stores a value with SET's options and updates the cluster
+// statistics according to what the store did.
+func (c *CommandHandler) applySetOptions(k, v string, opts store.SetOptions) store.SetResult {
+	res := c.store.SetWithOptions(k, v, opts)
+	if c.clusterManager == nil || !res.Written {
+		return res
+	}
+
+	if res.Removed {
+		if res.Existed {
+			c.clusterManager.DecrementKeyCount()
+			c.clusterManager.SubtractByteSize(len(k), len(res.Old))
+		}
+		return res
+	}
+
+	c.countSet(k, v, res.Old, res.Existed)
+	return res
+}
+
+// countSet updates the cluster statistics after a key was set to v, replacing old
+// if the key existed.
+func (c *CommandHandler) countSet(k, v, old string, existed bool) {
+	if c.clusterManager == nil {
+		return
+	}
+
+	if existed {
+		// Existing key: update byte size (subtract old, add new)
+		c.clusterManager.SubtractByteSize(len(k), len(old))
+		c.clusterManager.AddByteSize(len(k), len(v))
+	} else {
+		// New key: increment count and add byte size
+		c.clusterManager.IncrementKeyCount()
+		c.clusterManager.AddByteSize(len(k), len(v))
+	}
+}
+
+func (c *CommandHandler) HandleGet(parts []string) (string, error) {
+	if _, err := c.checkCommand(parts); err != nil {
+		return "", err
+	}
+
+	v, ok := c.store.Get(parts[1])
 
 	if !ok {
-		return "", fmt.Errorf("key not found")
+		return "", errKeyNotFound
 	}
 
 	return v, nil
 }
 
-func (c *CommandHandler) HandleDelete(parts []string) (bool, *OperationResult, error) {
-	const expectedParts = 2
+// HandleDelete implements DEL and returns how many of the keys were removed.
+func (c *CommandHandler) HandleDelete(parts []string) (int64, error) {
+	if _, err := c.checkCommand(parts); err != nil {
+		return 0, err
+	}
+
+	return c.deleteKeys(parts[1:])
+}
 
-	if len(parts) != expectedParts {
-		return false, nil, fmt.Errorf("wrong number of arguments for 'DEL'")
+// broadcast tells WebSocket clients about a completed write and, in a multi-node
+// cluster, sends them fresh cluster statistics.
+func (c *CommandHandler) broadcast(result *OperationResult) {
+	if c.hub == nil {
+		return
 	}
 
-	k := parts[1]
+	c.hub.BroadcastMessage(observer.UpdateMessage{
+		Action: result.Action,
+		Key:    result.Key,
+		Value:  result.Value,
+	})
 
-	// Write to WAL first
-	err := c.walWriter.WriteCommand(parts)
-	if err != nil {
-		c.logger.Error("failed to write to WAL", "error", err)
-		return false, nil, fmt.Errorf("failed to write to WAL: %w", err)
+	if result.NeedsStats {
+		broadcastClusterStats(c.hub, c.store, c.clusterManager)
 	}
+}
 
+// applyDelete removes a key and updates the cluster statistics if it existed.
+// This is shared by live DEL commands and WAL replay so both produce the same state.
+func (c *CommandHandler) applyDelete(k string) bool {
 	// Get the value before deletion to track byte size
 	oldValue, existed := c.store.Get(k)
 	ok := c.store.Delete(k)
@@ -122,33 +375,291 @@ func (c *CommandHandler) HandleDelete(parts []string) (bool, *OperationResult, e
 				c.clusterManager.SubtractByteSize(len(k), len(oldValue))
 			}
 		}
+	}
+
+	return ok
+}
+
+// logAndApply appends a write command to the WAL and then applies it to the store.
+// Both steps happen under writeMu so replay sees writes in the order clients did,
+// but the wait for durability happens afterwards so concurrent writers can share
+// one fsync under the "always" policy. Inside EXEC the command is kept for the
+// transaction's record instead.
+func (c *CommandHandler) logAndApply(cmd []string, applyFn func()) error {
+	if c.txRecords != nil {
+		applyFn()
+		c.txRecords = append(c.txRecords, cmd)
+		return nil
+	}
+
+	c.writeMu.Lock()
+	pos, err := c.walWriter.Append(cmd)
+	if err != nil {
+		c.writeMu.Unlock()
+		c.logger.Error("failed to write to WAL", "error", err)
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	applyFn()
+	c.writeMu.Unlock()
+
+	return c.syncWAL(pos)
+}
+
+// applyAndLog runs a write whose effect depends on the keys it finds, such as SET NX,
+// and then logs the command fn returns, which reproduces that effect. Logging the
+// outcome rather than the request keeps replay from deciding conditions again against
+// keys that have since expired. fn runs under writeMu like logAndApply's applyFn and
+// returns nil when it changed nothing, in which case nothing is logged. Before fn runs,
+// the writer is asked whether it would take a record as large as parts can produce,
+// so a write the WAL would refuse is never applied. Inside EXEC the command is kept for
+// the transaction's record instead, which EXEC has checked already.
+func (c *CommandHandler) applyAndLog(parts []string, fn func() []string) error {
+	if c.txRecords != nil {
+		if cmd := fn(); cmd != nil {
+			c.txRecords = append(c.txRecords, cmd)
+		}
+		return nil
+	}
+
+	c.writeMu.Lock()
+	if err := c.walWriter.Check(c.recordBound([][]string{parts})); err != nil {
+		c.writeMu.Unlock()
+		c.logger.Error("failed to write to WAL", "error", err)
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	cmd := fn()
+	if cmd == nil {
+		c.writeMu.Unlock()
+		return nil
+	}
+
+	pos, err := c.walWriter.Append(cmd)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.logger.Error("failed to write to WAL", "error", err)
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+
+	return c.syncWAL(pos)
+}
+
+// recordSlack is how much larger than its request a logged record may be. Logging
+// adds PXAT deadlines, turns commands such as INCR into the SET they amount to and
+// writes numbers in full, which for INCRBYFLOAT can take a few hundred digits.
+const recordSlack = 512
+
+// recordBound returns an upper bound on the payload size of the WAL records the write
+// commands in cmds produce when run in order. A record restates its request, give or
+// take recordSlack, except that APPEND and SETRANGE log the whole value they leave
+// behind. No command joins two stored values, so no value can grow past the longest
+// one the commands touch plus every byte of their arguments and the largest SETRANGE
+// offset. It must be called under writeMu, so that other writes cannot grow values
+// before the commands run.
+func (c *CommandHandler) recordBound(cmds [][]string) int64 {
+	var size, args, offset, rewrites int64
+	for _, cmd := range cmds {
+		n := wal.EncodedSize(cmd)
+		size += n + recordSlack
+		args += n
+
+		switch spec := lookupCommand(cmd); {
+		case spec == nil:
+		case spec.name == "append":
+			rewrites++
+		case spec.name == "setrange":
+			rewrites++
+			if n, err := strconv.ParseInt(cmd[2], 10, 64); err == nil {
+				offset = max(offset, n)
+			}
+		}
+	}
+	if rewrites == 0 {
+		return size
+	}
 
-		return true, &OperationResult{
-			Key:        k,
-			Value:      "",
-			Action:     "del",
-			NeedsStats: c.clusterManager != nil && len(c.clusterManager.Nodes) > 1,
-		}, nil
+	var longest int64
+	for _, cmd := range cmds {
+		if spec := lookupCommand(cmd); spec != nil {
+			for _, k := range spec.keyArgs(cmd) {
+				v, _ := c.store.Get(k)
+				longest = max(longest, int64(len(v)))
+			}
+		}
 	}
 
-	return false, nil, nil
+	return size + rewrites*min(longest+args+offset, c.maxValueLen())
 }
 
-// checkSlotOwnership returns the key for the given key, or nil if current node owns it
-func (c *CommandHandler) checkSlotOwnership(key string) string {
-	// Defensive check: if cluster manager is nil, allow all operations
-	if c.clusterManager == nil {
-		return ""
+// syncWAL waits until the WAL is durable up to pos, as the fsync policy requires,
+// and then checks whether the log has grown enough to be rewritten.
+func (c *CommandHandler) syncWAL(pos int64) error {
+	if err := c.walWriter.Sync(pos); err != nil {
+		c.logger.Error("failed to sync WAL", "error", err)
+		return fmt.Errorf("failed to sync WAL: %w", err)
+	}
+
+	c.maybeAutoRewrite()
+
+	return nil
+}
+
+// apply executes a logged write command without appending it to the WAL again.
+// This lets recovery stream the log through the same logic as live commands; only
+// commands the command table gives a replay function may appear in the log.
+func (c *CommandHandler) apply(cmd []string) error {
+	if len(cmd) == 0 {
+		return fmt.Errorf("empty command")
 	}
 
-	// If cluster is not initialized (< 3 nodes), current node handles all slots
-	if len(c.clusterManager.Nodes) < 3 {
-		return ""
+	spec := lookupCommand(cmd)
+	if spec == nil || spec.replay == nil {
+		return fmt.Errorf("unknown command '%s'", cmd[0])
 	}
 
-	// Defensive check: if current node is nil, allow all operations
-	if c.clusterManager.Node == nil {
-		return ""
+	return spec.replay(c, cmd)
+}
+
+// replaySet applies a logged SET, which carries its expiration as PXAT.
+func (c *CommandHandler) replaySet(cmd []string) error {
+	switch {
+	case len(cmd) == 3:
+		c.applySet(cmd[1], cmd[2])
+	case len(cmd) == 5 && strings.EqualFold(cmd[3], "PXAT"):
+		ms, err := strconv.ParseInt(cmd[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid expire time in 'SET': %q", cmd[4])
+		}
+		c.applySetWithExpiration(cmd[1], cmd[2], time.UnixMilli(ms))
+	default:
+		return wrongArgs("SET")
+	}
+
+	return nil
+}
+
+// replayDelete applies a logged DEL, which UNLINK is also logged as and which may
+// therefore name several keys.
+func (c *CommandHandler) replayDelete(cmd []string) error {
+	if len(cmd) < 2 {
+		return wrongArgs("DEL")
+	}
+
+	c.applyDeleteMany(cmd[1:])
+	return nil
+}
+
+// Close releases the write-ahead log and the data directory held by the handler.
+func (c *CommandHandler) Close() error {
+	var err error
+	if c.walWriter != nil {
+		err = c.walWriter.Close()
+	}
+
+	if c.dataDir != nil {
+		if dirErr := c.dataDir.Close(); err == nil {
+			err = dirErr
+		}
+	}
+
+	return err
+}
+
+// HandleInfo renders server information in the Redis INFO text format.
+// Only the persistence section exists so far; it reports the WAL fsync policy, how
+// much written data is not yet durable, and the state of rewrites and snapshots.
+func (c *CommandHandler) HandleInfo(parts []string) (string, error) {
+	if len(parts) > 2 {
+		return "", wrongArgs("INFO")
+	}
+
+	section := "persistence"
+	if len(parts) == 2 {
+		section = strings.ToLower(parts[1])
+	}
+
+	var b strings.Builder
+
+	switch section {
+	case "persistence", "all", "default", "everything":
+		stats := c.walWriter.Stats()
+		lastFsync := int64(-1)
+		if !stats.LastFsync.IsZero() {
+			lastFsync = stats.LastFsync.Unix()
+		}
+
+		b.WriteString("# Persistence\r\n")
+		b.WriteString("aof_enabled:1\r\n")
+		fmt.Fprintf(&b, "aof_fsync_policy:%s\r\n", stats.Policy)
+		fmt.Fprintf(&b, "aof_written_bytes:%d\r\n", stats.WrittenBytes)
+		fmt.Fprintf(&b, "aof_pending_bytes:%d\r\n", stats.PendingBytes)
+		fmt.Fprintf(&b, "aof_fsync_lag_ms:%d\r\n", stats.FsyncLag/time.Millisecond)
+		fmt.Fprintf(&b, "aof_last_fsync_time:%d\r\n", lastFsync)
+		fmt.Fprintf(&b, "aof_fsyncs:%d\r\n", stats.Fsyncs)
+		fmt.Fprintf(&b, "aof_current_size:%d\r\n", stats.Size)
+		fmt.Fprintf(&b, "aof_base_size:%d\r\n", stats.BaseSize)
+		fmt.Fprintf(&b, "aof_segments:%d\r\n", stats.Segments)
+		fmt.Fprintf(&b, "aof_active_segment:%d\r\n", stats.ActiveSegment)
+		fmt.Fprintf(&b, "aof_rewrite_in_progress:%d\r\n", boolToInt(stats.RewriteInProgress))
+		fmt.Fprintf(&b, "aof_rewrites:%d\r\n", stats.Rewrites)
+		fmt.Fprintf(&b, "aof_last_bgrewrite_status:%s\r\n", statusString(stats.LastRewriteFailed))
+		fmt.Fprintf(&b, "rdb_bgsave_in_progress:%d\r\n", boolToInt(stats.SnapshotInProgress))
+		fmt.Fprintf(&b, "rdb_saves:%d\r\n", stats.Snapshots)
+		fmt.Fprintf(&b, "rdb_last_save_time:%d\r\n", stats.LastSnapshot.Unix())
+		fmt.Fprintf(&b, "rdb_last_bgsave_status:%s\r\n", statusString(stats.LastSnapshotFailed))
+	}
+
+	return b.String(), nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// statusString renders a failure flag the way Redis reports background job status.
+func statusString(failed bool) string {
+	if failed {
+		return "err"
+	}
+	return "ok"
+}
+
+// checkKeys checks that a command's keys can be served by this node: in a cluster
+// they must all hash to one slot, or a CROSSSLOT error is returned, and that slot
+// must be owned by this node, or a *MovedError is returned.
+func (c *CommandHandler) checkKeys(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if c.clustered() {
+		slot := cluster.CalculateSlot(keys[0])
+		for _, k := range keys[1:] {
+			if cluster.CalculateSlot(k) != slot {
+				return errCrossSlot
+			}
+		}
+	}
+
+	return c.checkMoved(keys[0])
+}
+
+// clustered reports whether keys are partitioned between nodes. Until a cluster has
+// formed, with at least three nodes, the current node handles all slots.
+func (c *CommandHandler) clustered() bool {
+	// Defensive checks: without a cluster manager or current node, allow all operations
+	return c.clusterManager != nil && len(c.clusterManager.Nodes) >= 3 && c.clusterManager.Node != nil
+}
+
+// checkMoved returns a *MovedError if another node owns the key's slot, or nil if
+// this node should serve it.
+func (c *CommandHandler) checkMoved(key string) error {
+	if !c.clustered() {
+		return nil
 	}
 
 	slot := cluster.CalculateSlot(key)
@@ -157,16 +668,15 @@ func (c *CommandHandler) checkSlotOwnership(key string) string {
 	if slot < node.Slot.Start || slot > node.Slot.End {
 		ownerNode := c.clusterManager.GetNodeForSlots(slot)
 		if ownerNode != nil {
-			// Return the key for MOVED response
-			return key
+			return &MovedError{Slot: slot, Host: ownerNode.Host, Port: ownerNode.Port}
 		}
 	}
-	return ""
+	return nil
 }
 
 func (c *CommandHandler) HandleCluster(parts []string) error {
 	if len(parts) < 2 {
-		return fmt.Errorf("wrong number of arguments for 'CLUSTER'")
+		return wrongArgs("CLUSTER")
 	}
 
 	subcommand := strings.ToUpper(parts[1])
@@ -185,7 +695,7 @@ func (c *CommandHandler) HandleCluster(parts []string) error {
 
 func (c *CommandHandler) handleClusterMeet(parts []string) error {
 	if len(parts) != 4 {
-		return fmt.Errorf("wrong number of arguments for 'CLUSTER MEET'")
+		return wrongArgs("CLUSTER|MEET")
 	}
 
 	host := parts[2]
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"strconv"
@@ -65,7 +66,11 @@ type ClusterEventResponse struct {
 // handleWsConnection manages individual WebSocket connections for real-time operations.
 // This enables web clients to perform Redis commands and receive live updates,
 // bridging the gap between traditional Redis clients and modern web applications.
-func handleWsConnection(hub *observer.Hub, s *store.Store, cm *cluster.Manager, w http.ResponseWriter, r *http.Request) {
+// Writes go through the same CommandHandler path as RESP, so they are logged to the
+// WAL, counted in the cluster statistics and redirected when another node owns the key.
+func handleWsConnection(handler *CommandHandler, w http.ResponseWriter, r *http.Request) {
+	hub, s, cm := handler.hub, handler.store, handler.clusterManager
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
@@ -77,6 +82,14 @@ func handleWsConnection(hub *observer.Hub, s *store.Store, cm *cluster.Manager,
 	hub.Register(ws)
 	defer hub.Unregister(ws)
 
+	// Created on the first subscription; it forwards pub/sub messages to this client
+	var bridge *observer.Bridge
+	defer func() {
+		if bridge != nil {
+			bridge.Close()
+		}
+	}()
+
 	for {
 		_, msgBytes, err := ws.ReadMessage()
 		if err != nil {
@@ -95,19 +108,23 @@ func handleWsConnection(hub *observer.Hub, s *store.Store, cm *cluster.Manager,
 
 		switch strings.ToUpper(cmd.Action) {
 		case "SET":
-			s.Set(cmd.Key, cmd.Value)
-			hub.BroadcastMessage(observer.UpdateMessage{
-				Action: "set", Key: cmd.Key, Value: cmd.Value,
-			})
+			// Like RESP commands, writes wait for a running transaction to finish
+			handler.execMu.RLock()
+			_, _, err := handler.HandleSet([]string{"SET", cmd.Key, cmd.Value})
+			handler.execMu.RUnlock()
+			if err != nil {
+				writeWsError(hub, ws, cmd.Key, err)
+			}
 		case "GET":
-			val, ok := s.Get(cmd.Key)
-			if !ok {
+			val, err := handler.HandleGet([]string{"GET", cmd.Key})
+			if errors.Is(err, errKeyNotFound) {
 				val = "(nil)" // Or some other indicator of not found
+			} else if err != nil {
+				writeWsError(hub, ws, cmd.Key, err)
+				continue
 			}
 			resp := observer.UpdateMessage{Action: "get_resp", Key: cmd.Key, Value: val}
-			if err := ws.WriteJSON(resp); err != nil {
-				slog.Error("failed to send GET response", "error", err)
-			}
+			hub.Send(ws, resp)
 		case "GET_ALL":
 			allData := s.GetAll()
 			resp := struct {
@@ -115,15 +132,37 @@ func handleWsConnection(hub *observer.Hub, s *store.Store, cm *cluster.Manager,
 				Data   map[string]string `json:"data"`
 			}{Action: "sync", Data: allData}
 
-			if err := ws.WriteJSON(resp); err != nil {
-				slog.Error("failed to send sync response", "error", err)
-			}
+			hub.Send(ws, resp)
 		case "DEL":
-			if s.Delete(cmd.Key) {
-				hub.BroadcastMessage(observer.UpdateMessage{
-					Action: "del", Key: cmd.Key,
-				})
+			handler.execMu.RLock()
+			_, err := handler.HandleDelete([]string{"DEL", cmd.Key})
+			handler.execMu.RUnlock()
+			if err != nil {
+				writeWsError(hub, ws, cmd.Key, err)
+			}
+		case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+			if bridge == nil {
+				bridge = hub.Bridge(ws, handler.pubsub, handler.pubsubBufferLimit())
 			}
+
+			var n int
+			switch strings.ToUpper(cmd.Action) {
+			case "SUBSCRIBE":
+				n = bridge.Subscribe(cmd.Key)
+			case "PSUBSCRIBE":
+				n = bridge.PSubscribe(cmd.Key)
+			case "UNSUBSCRIBE":
+				n = bridge.Unsubscribe(cmd.Key)
+			default:
+				n = bridge.PUnsubscribe(cmd.Key)
+			}
+
+			resp := observer.UpdateMessage{Action: strings.ToLower(cmd.Action) + "_resp", Key: cmd.Key, Value: strconv.Itoa(n)}
+			hub.Send(ws, resp)
+		case "PUBLISH":
+			n := handler.pubsub.Publish(cmd.Key, cmd.Value)
+			resp := observer.UpdateMessage{Action: "publish_resp", Key: cmd.Key, Value: strconv.Itoa(n)}
+			hub.Send(ws, resp)
 		case "CLUSTER_INFO":
 			// Create cluster info response
 			nodes := make([]ClusterNodeInfo, 0, len(cm.Nodes))
@@ -166,13 +205,24 @@ func handleWsConnection(hub *observer.Hub, s *store.Store, cm *cluster.Manager,
 				ClusterSize:   len(cm.Nodes),
 			}
 
-			if err := ws.WriteJSON(resp); err != nil {
-				slog.Error("failed to send cluster info response", "error", err)
-			}
+			hub.Send(ws, resp)
 		}
 	}
 }
 
+// writeWsError reports a failed command to the WebSocket client that sent it, as a
+// "moved" message when another node owns the key and an "error" message otherwise.
+func writeWsError(hub *observer.Hub, ws *websocket.Conn, key string, err error) {
+	var resp any = observer.ErrorMessage{Action: "error", Key: key, Error: err.Error()}
+
+	var moved *MovedError
+	if errors.As(err, &moved) {
+		resp = observer.MovedMessage{Action: "moved", Key: key, Slot: moved.Slot, Host: moved.Host, Port: moved.Port}
+	}
+
+	hub.Send(ws, resp)
+}
+
 // handleGetKeys provides paginated key listing via HTTP REST API.
 // This supports administrative tools and debugging by enabling efficient
 // iteration over large key sets without overwhelming client or server memory.
@@ -200,7 +250,11 @@ func handleGetKeys(s *store.Store, w http.ResponseWriter, r *http.Request) {
 		limit = 20
 	}
 
-	resp := query.HandleCursorPagination(s, cursor, limit)
+	resp, err := query.HandleCursorPagination(s, cursor, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -271,10 +325,13 @@ func getHTTPPort(tcpPort string) string {
 // NewHTTPHandler creates the main HTTP handler with WebSocket and REST endpoints.
 // This provides a unified interface for both real-time WebSocket operations
 // and traditional HTTP APIs, supporting diverse client needs and integration patterns.
-func NewHTTPHandler(hub *observer.Hub, s *store.Store, cm *cluster.Manager, logger *slog.Logger) http.Handler {
+// Mutations are served by the given CommandHandler so they share the RESP server's path.
+func NewHTTPHandler(handler *CommandHandler, logger *slog.Logger) http.Handler {
+	s := handler.store
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		handleWsConnection(hub, s, cm, w, r)
+		handleWsConnection(handler, w, r)
 	})
 
 	mux.HandleFunc("GET /api/v1/keys", func(w http.ResponseWriter, r *http.Request) {
@@ -301,8 +358,8 @@ func NewHTTPHandler(hub *observer.Hub, s *store.Store, cm *cluster.Manager, logg
 // StartWebServer launches the HTTP server for WebSocket and REST API access.
 // This enables web-based clients and dashboards to interact with the Redis-compatible
 // store through modern protocols while maintaining compatibility with existing tools.
-func StartWebServer(addr string, hub *observer.Hub, logger *slog.Logger, s *store.Store, cm *cluster.Manager) error {
-	handler := NewHTTPHandler(hub, s, cm, logger)
+func StartWebServer(addr string, handler *CommandHandler, logger *slog.Logger) error {
+	httpHandler := NewHTTPHandler(handler, logger)
 	logger.Info("starting web server for websockets", "addr", addr)
-	return http.ListenAndServe(addr, handler)
+	return http.ListenAndServe(addr, httpHandler)
 }
@@ -0,0 +1,391 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/121watts/reredis/internal/query"
+	"github.com/121watts/reredis/internal/store"
+)
+
+// errNoSuchKey is returned when RENAME's source key does not exist.
+var errNoSuchKey = errors.New("no such key")
+
+// HandleExists implements EXISTS and counts how many of the keys exist. A key named
+// more than once is counted each time, as in Redis.
+func (c *CommandHandler) HandleExists(parts []string) (int64, error) {
+	return int64(c.store.Exists(parts[1:])), nil
+}
+
+// HandleTouch implements TOUCH, which marks the keys as recently used so LRU eviction
+// spares them, and counts how many of them exist.
+func (c *CommandHandler) HandleTouch(parts []string) (int64, error) {
+	return int64(c.store.Touch(parts[1:])), nil
+}
+
+// HandleType implements TYPE. Every value is a string, so a key is either "string"
+// or, when missing, "none".
+func (c *CommandHandler) HandleType(parts []string) (string, error) {
+	if c.store.Exists(parts[1:2]) == 0 {
+		return "none", nil
+	}
+	return "string", nil
+}
+
+// HandleRandomKey implements RANDOMKEY and returns a key chosen at random, or false
+// if there are no keys.
+func (c *CommandHandler) HandleRandomKey(parts []string) (string, bool, error) {
+	k, ok := c.store.RandomKey()
+	return k, ok, nil
+}
+
+// HandleUnlink implements UNLINK and returns how many of the keys were removed. It is
+// the same as DEL: unlike Redis, which frees large values on a background thread,
+// nothing is left to do here, as the garbage collector reclaims the values
+// concurrently once the store drops them.
+func (c *CommandHandler) HandleUnlink(parts []string) (int64, error) {
+	return c.deleteKeys(parts[1:])
+}
+
+// deleteKeys logs the keys as a single DEL record, removes the ones that exist in one
+// step and returns how many there were. Replaying a DEL removes the same keys whatever
+// it finds, so the record is written before the keys go, and a DEL the WAL refuses
+// leaves them all in place. When none of the keys exist nothing is logged; a key
+// written after that check is simply treated as written after the DEL.
+func (c *CommandHandler) deleteKeys(keys []string) (int64, error) {
+	if c.store.Exists(keys) == 0 {
+		return 0, nil
+	}
+
+	var removed []store.Item
+	err := c.logAndApply(append([]string{"DEL"}, keys...), func() {
+		removed = c.applyDeleteMany(keys)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	needsStats := c.clusterManager != nil && len(c.clusterManager.Nodes) > 1
+	for _, item := range removed {
+		c.broadcast(&OperationResult{Key: item.Key, Action: "del", NeedsStats: needsStats})
+		c.notify(notifyGeneric, "del", item.Key)
+	}
+
+	return int64(len(removed)), nil
+}
+
+// applyDeleteMany removes several keys at once and updates the cluster statistics.
+// It returns the items that existed.
+func (c *CommandHandler) applyDeleteMany(keys []string) []store.Item {
+	removed := c.store.DeleteMany(keys)
+	if c.clusterManager != nil {
+		for _, item := range removed {
+			c.clusterManager.DecrementKeyCount()
+			c.clusterManager.SubtractByteSize(len(item.Key), len(item.Value))
+		}
+	}
+	return removed
+}
+
+// HandleRename implements RENAME and RENAMENX and reports whether the key was renamed,
+// which RENAMENX only does if the new name is free. The value keeps its expiration.
+// It returns errNoSuchKey if the key does not exist.
+func (c *CommandHandler) HandleRename(parts []string) (bool, error) {
+	src, dst := parts[1], parts[2]
+	replace := !strings.EqualFold(parts[0], "RENAMENX")
+
+	var res store.TransferResult
+	err := c.applyAndLog(parts, func() []string {
+		res = c.applyTransfer(src, dst, replace, true)
+		if !res.Written || src == dst {
+			return nil
+		}
+		return []string{"RENAME", src, dst}
+	})
+	if err != nil {
+		return false, err
+	}
+	if !res.Found {
+		return false, errNoSuchKey
+	}
+
+	if res.Written && src != dst {
+		// Report the move as the pair of changes the dashboard already understands
+		c.broadcast(&OperationResult{Key: src, Action: "del"})
+		c.broadcast(&OperationResult{
+			Key:        dst,
+			Value:      res.Value,
+			Action:     "set",
+			NeedsStats: c.clusterManager != nil && len(c.clusterManager.Nodes) > 1,
+		})
+		c.notify(notifyGeneric, "rename_from", src)
+		c.notify(notifyGeneric, "rename_to", dst)
+	}
+
+	return res.Written, nil
+}
+
+// HandleCopy implements COPY with its DB and REPLACE options and reports whether the
+// value was copied, which without REPLACE only happens if the destination is free.
+// The copy keeps the source's expiration. Only database 0 exists.
+func (c *CommandHandler) HandleCopy(parts []string) (bool, error) {
+	src, dst := parts[1], parts[2]
+
+	var replace bool
+	for i := 3; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(parts) {
+				return false, errSyntax
+			}
+			db, err := strconv.ParseInt(parts[i+1], 10, 64)
+			if err != nil {
+				return false, errNotInteger
+			}
+			if db != 0 {
+				return false, errors.New("DB index is out of range")
+			}
+			i++
+		default:
+			return false, errSyntax
+		}
+	}
+
+	if src == dst {
+		return false, errors.New("source and destination objects are the same")
+	}
+
+	var res store.TransferResult
+	err := c.applyAndLog(parts, func() []string {
+		if res = c.applyTransfer(src, dst, replace, false); !res.Written {
+			return nil
+		}
+		return []string{"COPY", src, dst, "REPLACE"}
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if res.Written {
+		c.broadcast(&OperationResult{
+			Key:        dst,
+			Value:      res.Value,
+			Action:     "set",
+			NeedsStats: c.clusterManager != nil && len(c.clusterManager.Nodes) > 1,
+		})
+		c.notify(notifyGeneric, "copy_to", dst)
+	}
+
+	return res.Written, nil
+}
+
+// applyTransfer renames or copies a key and updates the cluster statistics. This is
+// shared by live commands and WAL replay.
+func (c *CommandHandler) applyTransfer(src, dst string, replace, remove bool) store.TransferResult {
+	var res store.TransferResult
+	if remove {
+		res = c.store.Rename(src, dst, replace)
+	} else {
+		res = c.store.Copy(src, dst, replace)
+	}
+
+	if c.clusterManager == nil || !res.Written || src == dst {
+		return res
+	}
+
+	if remove {
+		c.clusterManager.DecrementKeyCount()
+		c.clusterManager.SubtractByteSize(len(src), len(res.Value))
+	}
+	c.countSet(dst, res.Value, res.Old, res.Replaced)
+
+	return res
+}
+
+// replayRename applies a logged RENAME, which RENAMENX is also logged as once it
+// succeeds. The source existed when the rename was logged, so if replay finds it
+// missing it has expired since, and the destination, which took over its
+// expiration, would have expired with it.
+func (c *CommandHandler) replayRename(cmd []string) error {
+	if len(cmd) != 3 {
+		return wrongArgs("RENAME")
+	}
+
+	if res := c.applyTransfer(cmd[1], cmd[2], true, true); !res.Found {
+		c.applyDelete(cmd[2])
+	}
+	return nil
+}
+
+// replayCopy applies a logged COPY, which always carries REPLACE. As with RENAME, a
+// missing source means it expired and took the copy with it.
+func (c *CommandHandler) replayCopy(cmd []string) error {
+	if len(cmd) != 4 || !strings.EqualFold(cmd[3], "REPLACE") {
+		return wrongArgs("COPY")
+	}
+
+	if res := c.applyTransfer(cmd[1], cmd[2], true, false); !res.Found {
+		c.applyDelete(cmd[2])
+	}
+	return nil
+}
+
+// HandleScan implements SCAN cursor [MATCH pattern] [COUNT n] [TYPE type] and returns
+// the cursor to continue from, 0 once the iteration is complete, along with a batch
+// of keys. COUNT is a hint for how many keys to examine; MATCH and TYPE filter the
+// keys examined, so a batch may be empty before the iteration ends.
+func (c *CommandHandler) HandleScan(parts []string) (uint64, []string, error) {
+	cursor, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, nil, errors.New("invalid cursor")
+	}
+
+	count := 10
+	var pattern, keyType string
+	var filterType bool
+	for i := 2; i < len(parts); i += 2 {
+		if i+1 >= len(parts) {
+			return 0, nil, errSyntax
+		}
+		switch strings.ToUpper(parts[i]) {
+		case "MATCH":
+			pattern = parts[i+1]
+		case "COUNT":
+			n, err := strconv.ParseInt(parts[i+1], 10, 64)
+			if err != nil {
+				return 0, nil, errNotInteger
+			}
+			if n < 1 {
+				return 0, nil, errSyntax
+			}
+			count = int(min(n, maxMultiBulkLen))
+		case "TYPE":
+			keyType, filterType = parts[i+1], true
+		default:
+			return 0, nil, errSyntax
+		}
+	}
+
+	keys, next := c.store.Scan(cursor, count)
+
+	// Every value is a string, so TYPE either keeps every key or none
+	if filterType && !strings.EqualFold(keyType, "string") {
+		return next, []string{}, nil
+	}
+	if pattern != "" && pattern != "*" {
+		matched := keys[:0]
+		for _, k := range keys {
+			if query.Match(pattern, k) {
+				matched = append(matched, k)
+			}
+		}
+		keys = matched
+	}
+
+	return next, keys, nil
+}
+
+// HandleKeys implements KEYS and returns every key matching a glob pattern. It
+// examines the whole keyspace at once, so SCAN is the better choice for large ones.
+func (c *CommandHandler) HandleKeys(parts []string) ([]string, error) {
+	pattern := parts[1]
+	return c.store.Keys(func(k string) bool {
+		return query.Match(pattern, k)
+	}), nil
+}
+
+func handleExistsCommand(parts []string, cl *client, handler *CommandHandler) {
+	var n int64
+	var err error
+	if strings.EqualFold(parts[0], "TOUCH") {
+		n, err = handler.HandleTouch(parts)
+	} else {
+		n, err = handler.HandleExists(parts)
+	}
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Integer(n)
+}
+
+func handleTypeCommand(parts []string, cl *client, handler *CommandHandler) {
+	t, err := handler.HandleType(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.SimpleString(t)
+}
+
+func handleRandomKeyCommand(parts []string, cl *client, handler *CommandHandler) {
+	k, ok, err := handler.HandleRandomKey(parts)
+	switch {
+	case err != nil:
+		cl.w.WriteError(err)
+	case !ok:
+		cl.w.Null()
+	default:
+		cl.w.Bulk(k)
+	}
+}
+
+func handleUnlinkCommand(parts []string, cl *client, handler *CommandHandler) {
+	n, err := handler.HandleUnlink(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Integer(n)
+}
+
+func handleRenameCommand(parts []string, cl *client, handler *CommandHandler) {
+	renamed, err := handler.HandleRename(parts)
+	switch {
+	case err != nil:
+		cl.w.WriteError(err)
+	case strings.EqualFold(parts[0], "RENAMENX"):
+		cl.w.Integer(int64(boolToInt(renamed)))
+	default:
+		cl.w.SimpleString("OK")
+	}
+}
+
+func handleCopyCommand(parts []string, cl *client, handler *CommandHandler) {
+	copied, err := handler.HandleCopy(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Integer(int64(boolToInt(copied)))
+}
+
+func handleScanCommand(parts []string, cl *client, handler *CommandHandler) {
+	next, keys, err := handler.HandleScan(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	// The cursor is a bulk string, since it may not fit a signed 64-bit integer
+	cl.w.ArrayHeader(2)
+	cl.w.Bulk(strconv.FormatUint(next, 10))
+	cl.w.BulkArray(keys)
+}
+
+func handleKeysCommand(parts []string, cl *client, handler *CommandHandler) {
+	keys, err := handler.HandleKeys(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.BulkArray(keys)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/121watts/reredis/internal/cluster"
+	"github.com/121watts/reredis/internal/wal"
+)
+
+// errExecAbort is EXEC's reply when a command failed to queue after MULTI.
+var errExecAbort = &CodedError{Code: "EXECABORT", Msg: "Transaction discarded because of previous errors."}
+
+// transaction is a client's state between MULTI and EXEC.
+type transaction struct {
+	queued  [][]string
+	specs   []*commandSpec // Declaration each queued command runs under
+	aborted bool           // A command failed to queue, so EXEC will refuse to run
+	slot    int32          // Slot every queued key hashes to in a cluster; -1 before the first key
+}
+
+// controlsTransaction reports whether a command acts on the transaction itself, and so
+// runs at once after MULTI instead of being queued.
+func controlsTransaction(spec *commandSpec) bool {
+	return spec != nil && (spec.name == "multi" || spec.name == "exec" || spec.name == "discard")
+}
+
+// queueCommand queues a command sent after MULTI, or reports why it cannot be queued
+// and marks the transaction aborted. err is what checking the command found wrong.
+func (c *CommandHandler) queueCommand(cl *client, spec *commandSpec, parts []string, err error) {
+	tx := cl.tx
+	if err == nil && spec.flags&flagNoMulti != 0 {
+		err = errors.New("Command not allowed inside a transaction")
+	}
+
+	// A transaction runs on one node, so in a cluster all its keys must share a slot
+	if err == nil && c.clustered() {
+		if keys := spec.keyArgs(parts); len(keys) > 0 {
+			slot := cluster.CalculateSlot(keys[0])
+			if tx.slot >= 0 && slot != tx.slot {
+				err = errCrossSlot
+			}
+			tx.slot = slot
+		}
+	}
+
+	if err != nil {
+		tx.aborted = true
+		cl.w.WriteError(err)
+		return
+	}
+
+	tx.queued = append(tx.queued, parts)
+	tx.specs = append(tx.specs, spec)
+	cl.w.SimpleString("QUEUED")
+}
+
+// exec runs a transaction's commands as one atomic batch and writes their replies as
+// an array. No other command runs until the batch is done, and the writes it makes are
+// logged as a single EXEC record, so clients and WAL replay both see all of them or
+// none. If a watched key was modified, nothing runs and the reply is a null array; if
+// the WAL would refuse the record, nothing runs and the reply is EXECABORT.
+func (c *CommandHandler) exec(cl *client, tx *transaction) {
+	c.execMu.Lock()
+
+	if len(cl.watched) > 0 && c.store.Modified(cl.watched, cl.watchVersions) {
+		c.execMu.Unlock()
+		cl.w.NullArray()
+		return
+	}
+
+	// writeMu is held from the first write to the append, like logAndApply holds it
+	// for one command, so a rewrite or snapshot starting meanwhile copies either none
+	// of the batch or all of it along with its record
+	c.writeMu.Lock()
+
+	// Nothing can be undone once the batch has run, so a record the WAL would refuse
+	// discards the transaction up front
+	if err := c.checkExec(tx); err != nil {
+		c.writeMu.Unlock()
+		c.execMu.Unlock()
+		c.logger.Error("failed to write to WAL", "error", err)
+		cl.w.WriteError(&CodedError{Code: "EXECABORT", Msg: "Transaction discarded because of: failed to write to WAL: " + err.Error()})
+		return
+	}
+
+	// Hold the replies back until the batch is durable, so a WAL failure can be
+	// reported in their place
+	out := cl.w
+	var buf bytes.Buffer
+	cl.w = NewReplyWriter(&buf)
+	cl.w.SetProtocol(out.Protocol())
+
+	c.txRecords = [][]string{}
+	cl.w.ArrayHeader(len(tx.queued))
+	for i, parts := range tx.queued {
+		tx.specs[i].handler(parts, cl, c)
+	}
+	records := c.txRecords
+	c.txRecords = nil
+
+	var pos int64
+	var err error
+	if len(records) > 0 {
+		pos, err = c.walWriter.Append(execRecord(records))
+	}
+	c.writeMu.Unlock()
+	c.execMu.Unlock()
+
+	// HELLO may have changed the protocol partway through the batch
+	cl.w.Flush()
+	out.SetProtocol(cl.w.Protocol())
+	cl.w = out
+
+	switch {
+	case err != nil:
+		c.logger.Error("failed to write to WAL", "error", err)
+		err = fmt.Errorf("failed to write to WAL: %w", err)
+	case len(records) > 0:
+		err = c.syncWAL(pos)
+	}
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.writeRaw(buf.Bytes())
+}
+
+// checkExec asks the writer whether it would take the EXEC record tx can produce, an
+// upper bound on which is the bound on its writes plus the EXEC header. Each write's
+// argument count stands in for its array header within the slack recordBound allows.
+// A transaction without writes logs nothing and is never refused.
+func (c *CommandHandler) checkExec(tx *transaction) error {
+	var writes [][]string
+	for i, parts := range tx.queued {
+		if tx.specs[i].flags&flagWrite != 0 {
+			writes = append(writes, parts)
+		}
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+
+	return c.walWriter.Check(c.recordBound(writes) + wal.EncodedSize([]string{"EXEC"}) + recordSlack)
+}
+
+// execRecord encodes the writes of a transaction as one WAL record: EXEC followed,
+// for each write, by its argument count and its arguments.
+func execRecord(records [][]string) []string {
+	cmd := []string{"EXEC"}
+	for _, record := range records {
+		cmd = append(cmd, strconv.Itoa(len(record)))
+		cmd = append(cmd, record...)
+	}
+	return cmd
+}
+
+// replayExec applies a logged EXEC by applying each write it holds in turn.
+func (c *CommandHandler) replayExec(cmd []string) error {
+	for i := 1; i < len(cmd); {
+		n, err := strconv.Atoi(cmd[i])
+		if err != nil || n < 1 || i+1+n > len(cmd) {
+			return fmt.Errorf("malformed 'EXEC' record at argument %d", i)
+		}
+
+		record := cmd[i+1 : i+1+n]
+		if lookupCommand(record) == lookupCommandName("exec") {
+			return fmt.Errorf("nested 'EXEC' record")
+		}
+		if err := c.apply(record); err != nil {
+			return err
+		}
+		i += 1 + n
+	}
+
+	return nil
+}
+
+// unwatch forgets every key the client is watching.
+func (c *CommandHandler) unwatch(cl *client) {
+	if len(cl.watched) == 0 {
+		return
+	}
+
+	c.store.Unwatch(cl.watched)
+	cl.watched, cl.watchVersions = nil, nil
+}
+
+func handleMultiCommand(parts []string, cl *client, handler *CommandHandler) {
+	if cl.tx != nil {
+		cl.w.Error("ERR MULTI calls can not be nested")
+		return
+	}
+
+	cl.tx = &transaction{slot: -1}
+	cl.w.SimpleString("OK")
+}
+
+func handleExecCommand(parts []string, cl *client, handler *CommandHandler) {
+	tx := cl.tx
+	if tx == nil {
+		cl.w.Error("ERR EXEC without MULTI")
+		return
+	}
+	cl.tx = nil
+	defer handler.unwatch(cl)
+
+	if tx.aborted {
+		cl.w.WriteError(errExecAbort)
+		return
+	}
+
+	handler.exec(cl, tx)
+}
+
+func handleDiscardCommand(parts []string, cl *client, handler *CommandHandler) {
+	if cl.tx == nil {
+		cl.w.Error("ERR DISCARD without MULTI")
+		return
+	}
+
+	cl.tx = nil
+	handler.unwatch(cl)
+	cl.w.SimpleString("OK")
+}
+
+func handleWatchCommand(parts []string, cl *client, handler *CommandHandler) {
+	keys := parts[1:]
+	cl.watched = append(cl.watched, keys...)
+	cl.watchVersions = append(cl.watchVersions, handler.store.Watch(keys)...)
+	cl.w.SimpleString("OK")
+}
+
+func handleUnwatchCommand(parts []string, cl *client, handler *CommandHandler) {
+	handler.unwatch(cl)
+	cl.w.SimpleString("OK")
+}
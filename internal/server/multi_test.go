@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/121watts/reredis/internal/cluster"
+	"github.com/121watts/reredis/internal/observer"
+	"github.com/121watts/reredis/internal/store"
+)
+
+func TestExecDuringRewrite(t *testing.T) {
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	hub := observer.NewHub(logger)
+	go hub.Run()
+	open := func(s *store.Store) *CommandHandler {
+		c, err := Open(Config{Dir: dir}, s, logger, hub, cluster.NewManager("localhost", "6379"))
+		if err != nil {
+			t.Fatalf("failed to open server: %v", err)
+		}
+		return c
+	}
+
+	c := open(store.NewStore())
+	cl := &client{user: defaultUser, w: NewReplyWriter(&bytes.Buffer{})}
+	handleCommand([]string{"SET", "a", "value"}, cl, c)
+
+	// The second queued command starts a rewrite the way another client's EXEC would
+	// after releasing execMu, once the RENAME before it has been applied
+	rewriteStarted := make(chan error, 1)
+	startRewrite := &commandSpec{name: "startrewrite", handler: func(parts []string, cl *client, c *CommandHandler) {
+		go func() { rewriteStarted <- c.startRewrite() }()
+		select {
+		case err := <-rewriteStarted:
+			rewriteStarted <- err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}}
+	c.exec(cl, &transaction{
+		queued: [][]string{{"RENAME", "a", "b"}, {"STARTREWRITE"}},
+		specs:  []*commandSpec{lookupCommandName("rename"), startRewrite},
+	})
+
+	if err := <-rewriteStarted; err != nil {
+		t.Fatalf("failed to start rewrite: %v", err)
+	}
+	for c.walWriter.Stats().RewriteInProgress {
+		time.Sleep(time.Millisecond)
+	}
+	c.Close()
+
+	s := store.NewStore()
+	open(s).Close()
+	if got, ok := s.Get("b"); !ok || got != "value" {
+		t.Errorf("expected b=value after restart, got ok=%v value=%q", ok, got)
+	}
+	if _, ok := s.Get("a"); ok {
+		t.Errorf("expected a to be gone after restart")
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// notifyClass is a set of keyspace notification classes, as chosen with Redis'
+// notify-keyspace-events. K and E pick the channels events are published to, and
+// the other classes pick which events are published.
+type notifyClass uint32
+
+const (
+	notifyKeyspace notifyClass = 1 << iota // K: __keyspace@0__:<key> carries the event name
+	notifyKeyevent                         // E: __keyevent@0__:<event> carries the key
+	notifyGeneric                          // g: del, expire, persist, rename and copy
+	notifyString                           // $: set and the other string commands
+	notifyExpired                          // x: keys removed because they expired
+	notifyEvicted                          // e: keys evicted by the LRU limit
+
+	// notifyAll is what the A alias stands for: every event class there is
+	notifyAll = notifyGeneric | notifyString | notifyExpired | notifyEvicted
+)
+
+// notifyClassChars maps each class to its character, in the order Redis prints them.
+var notifyClassChars = []struct {
+	class notifyClass
+	char  byte
+}{
+	{notifyGeneric, 'g'},
+	{notifyString, '$'},
+	{notifyExpired, 'x'},
+	{notifyEvicted, 'e'},
+	{notifyKeyspace, 'K'},
+	{notifyKeyevent, 'E'},
+}
+
+// errNotifyClass is returned for a notify-keyspace-events value naming a class that
+// does not exist. The classes for data types Reredis lacks are refused rather than
+// silently never firing.
+var errNotifyClass = errors.New("Invalid event class character. Use 'Ag$xeKE'.")
+
+// parseNotifyClasses parses a notify-keyspace-events value such as "Ex" or "KA".
+// The empty string turns notifications off.
+func parseNotifyClasses(s string) (notifyClass, error) {
+	var classes notifyClass
+	for i := 0; i < len(s); i++ {
+		if s[i] == 'A' {
+			classes |= notifyAll
+			continue
+		}
+
+		found := false
+		for _, c := range notifyClassChars {
+			if c.char == s[i] {
+				classes |= c.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, errNotifyClass
+		}
+	}
+	return classes, nil
+}
+
+// String formats the classes the way CONFIG GET reports them, with A standing for
+// every event class.
+func (n notifyClass) String() string {
+	var b strings.Builder
+	for _, c := range notifyClassChars {
+		if n&notifyAll == notifyAll && c.class&notifyAll != 0 {
+			continue
+		}
+		if n&c.class != 0 {
+			b.WriteByte(c.char)
+		}
+	}
+	if n&notifyAll == notifyAll {
+		return "A" + b.String()
+	}
+	return b.String()
+}
+
+// notify publishes a keyspace notification for an event on a key, if its class is
+// enabled. Nothing is published unless K or E is also set, as in Redis.
+func (c *CommandHandler) notify(class notifyClass, event, key string) {
+	classes := notifyClass(c.notifyClasses.Load())
+	if classes&class == 0 {
+		return
+	}
+
+	if classes&notifyKeyspace != 0 {
+		c.pubsub.Publish("__keyspace@0__:"+key, event)
+	}
+	if classes&notifyKeyevent != 0 {
+		c.pubsub.Publish("__keyevent@0__:"+event, key)
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNotifyClasses(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // As CONFIG GET reports it
+	}{
+		{"", ""},
+		{"Ex", "xE"},
+		{"KEA", "AKE"},
+		{"g$xeKE", "AKE"},
+		{"K$g", "g$K"},
+		{"AA", "A"},
+	}
+
+	for _, tt := range tests {
+		classes, err := parseNotifyClasses(tt.in)
+		if err != nil {
+			t.Errorf("parseNotifyClasses(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got := classes.String(); got != tt.want {
+			t.Errorf("parseNotifyClasses(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	// Classes of data types that do not exist here are refused
+	for _, in := range []string{"Kl", "Eh", "z", "?"} {
+		if _, err := parseNotifyClasses(in); !errors.Is(err, errNotifyClass) {
+			t.Errorf("expected %q to be refused, got %v", in, err)
+		}
+	}
+}
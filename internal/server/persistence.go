@@ -0,0 +1,415 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/121watts/reredis/internal/cluster"
+	"github.com/121watts/reredis/internal/datadir"
+	"github.com/121watts/reredis/internal/observer"
+	"github.com/121watts/reredis/internal/snapshot"
+	"github.com/121watts/reredis/internal/store"
+	"github.com/121watts/reredis/internal/wal"
+)
+
+// Config describes where and how a node persists its data.
+// It is passed to Open so tests and multi-node setups can each use their own directory.
+type Config struct {
+	Dir                   string             // Data directory holding the WAL and any snapshot or config files
+	AppendFsync           wal.FsyncPolicy    // When WAL writes are fsynced (always, everysec, no)
+	AutoRewritePercentage int                // WAL growth since the last rewrite that triggers a new one; 0 disables
+	AutoRewriteMinSize    int64              // WAL size below which automatic rewrites never trigger
+	WALRecovery           wal.RecoveryPolicy // How replay treats corrupt records (fail, truncate, skip)
+	WALSegmentSize        int64              // Size at which the active WAL segment is rotated; 0 uses the default
+	MaxBulkLen            int64              // Largest request argument clients may send; 0 uses DefaultMaxBulkLen
+	WALMaxRecordSize      int64              // Largest WAL record written or replayed; 0 derives it from the request limits
+	PubSubBufferLimit     int                // Bytes of messages that may wait for a subscriber before it is disconnected; 0 uses DefaultPubSubBufferLimit
+	NotifyKeyspaceEvents  string             // Keyspace notification classes, as in Redis' notify-keyspace-events; empty disables them
+}
+
+// replayProgressInterval controls how often replay progress is logged.
+const replayProgressInterval = 100_000
+
+// Open locks the data directory, recovers the store from its write-ahead log and
+// returns a handler that appends to it. Replay finishes before this returns, so callers
+// can start the TCP and HTTP listeners knowing clients will never observe a partially
+// restored data set. Closing the handler releases the directory.
+func Open(cfg Config, s *store.Store, logger *slog.Logger, hub *observer.Hub, cm *cluster.Manager) (*CommandHandler, error) {
+	classes, err := parseNotifyClasses(cfg.NotifyKeyspaceEvents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notify-keyspace-events: %w", err)
+	}
+
+	dir, err := datadir.Open(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("using data directory", "dir", dir.Path(), "appendfsync", cfg.AppendFsync.String())
+
+	handler := NewCommandHandler(s, hub, nil, cm, logger)
+	handler.dataDir = dir
+	handler.autoRewritePercentage = cfg.AutoRewritePercentage
+	handler.autoRewriteMinSize = cfg.AutoRewriteMinSize
+	handler.maxBulkLen = cfg.MaxBulkLen
+	handler.walMaxRecordSize = cfg.WALMaxRecordSize
+	if handler.walMaxRecordSize <= 0 {
+		handler.walMaxRecordSize = wal.RecordSizeLimit(maxMultiBulkLen, handler.maxValueLen())
+	}
+	handler.pubsubLimit = cfg.PubSubBufferLimit
+	handler.notifyClasses.Store(uint32(classes))
+
+	if err := wal.AdoptLegacyLog(dir.WALDir(), dir.LegacyWALPath()); err != nil {
+		dir.Close()
+		return nil, err
+	}
+
+	skipped, err := handler.replay(dir.WALDir(), cfg.WALRecovery)
+	if err != nil {
+		dir.Close()
+		return nil, err
+	}
+
+	walWriter, err := wal.NewWriter(dir.WALDir(), wal.Options{
+		Fsync:         cfg.AppendFsync,
+		SegmentSize:   cfg.WALSegmentSize,
+		MaxRecordSize: handler.walMaxRecordSize,
+	})
+	if err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("failed to create WAL writer: %w", err)
+	}
+	handler.walWriter = walWriter
+
+	// Damaged regions passed over by replay are still on disk; rewriting the log
+	// from the recovered store leaves one that the strict policy can read again
+	if skipped > 0 {
+		logger.Warn("rewriting WAL to drop skipped corrupt records", "skipped", skipped)
+		if err := handler.startRewrite(); err != nil {
+			logger.Error("failed to start WAL rewrite after recovery", "error", err)
+		}
+	}
+
+	return handler, nil
+}
+
+// replay streams every logged command through the handler's apply path, following
+// the WAL manifest from the base through the active segment, and returns how many
+// damaged regions were skipped. A snapshot base is loaded directly into the store
+// before any segment is replayed.
+func (c *CommandHandler) replay(walDir string, policy wal.RecoveryPolicy) (int, error) {
+	start := time.Now()
+
+	manifest, err := wal.ReadManifest(walDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		c.logger.Info("no WAL found, starting with empty store", "dir", walDir)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read WAL manifest: %w", err)
+	}
+
+	files := manifest.Files()
+	c.logger.Info("replaying WAL", "dir", walDir, "files", len(files), "recovery", policy.String())
+
+	entries, skipped := 0, 0
+	for i, name := range files {
+		if name == manifest.Base && manifest.BaseFormat == wal.BaseSnapshot {
+			n, err := c.loadSnapshot(filepath.Join(walDir, name))
+			if err != nil {
+				return 0, err
+			}
+			entries += n
+			continue
+		}
+
+		n, s, err := c.replayFile(filepath.Join(walDir, name), policy, i == len(files)-1, entries, start)
+		if err != nil {
+			return 0, err
+		}
+		entries, skipped = n, skipped+s
+	}
+
+	c.logger.Info("WAL replay complete",
+		"entries", entries,
+		"files", len(files),
+		"skipped_regions", skipped,
+		"keys", len(c.store.GetAll()),
+		"bytes", c.store.GetTotalByteSize(),
+		"duration", time.Since(start),
+	)
+
+	return skipped, nil
+}
+
+// replayFile applies one file of the log and returns the running entry count and the
+// number of damaged regions it skipped. A torn record at the end of the active segment
+// is the expected result of a crash during an append, so it is truncated away under
+// every policy. Sealed files were fsynced before the next one was started, so damage
+// there is only cut away when the operator asked to skip past corruption.
+func (c *CommandHandler) replayFile(path string, policy wal.RecoveryPolicy, active bool, entries int, start time.Time) (int, int, error) {
+	reader, err := wal.NewReader(path, wal.ReaderOptions{Recovery: policy, MaxRecordSize: c.walMaxRecordSize})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open WAL for replay: %w", err)
+	}
+	defer reader.Close()
+
+	for {
+		entry, err := reader.ReadEntry()
+		if err == io.EOF {
+			break
+		}
+
+		if errors.Is(err, io.ErrUnexpectedEOF) && active {
+			if err := c.truncateWAL(path, reader.Offset(), err); err != nil {
+				return 0, 0, err
+			}
+			break
+		}
+
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to replay WAL (use --wal-recovery=truncate or skip to start anyway): %w", err)
+		}
+
+		if err := c.apply(entry.Command); err != nil {
+			return 0, 0, fmt.Errorf("failed to replay WAL entry %d: %w", entries+1, err)
+		}
+
+		entries++
+		if entries%replayProgressInterval == 0 {
+			c.logger.Info("WAL replay progress", "entries", entries, "file", filepath.Base(path), "offset", reader.Offset(), "elapsed", time.Since(start))
+		}
+	}
+
+	for _, damage := range reader.Skipped() {
+		c.logger.Warn("skipped corrupt WAL region", "file", filepath.Base(path), "offset", damage.Offset, "length", damage.Length, "error", damage.Err)
+	}
+
+	if damage := reader.Truncated(); damage != nil {
+		if !active && policy != wal.RecoverSkip {
+			return 0, 0, fmt.Errorf("failed to replay sealed WAL file %s (use --wal-recovery=skip to start anyway): %w", filepath.Base(path), damage)
+		}
+
+		if err := c.truncateWAL(path, reader.Offset(), damage); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return entries, len(reader.Skipped()), nil
+}
+
+// loadSnapshot applies every key in a snapshot base and returns how many it loaded.
+// Keys whose absolute expiration passed while the node was down are dropped. A
+// damaged snapshot always fails startup: unlike a log it has no valid prefix to keep.
+func (c *CommandHandler) loadSnapshot(path string) (int, error) {
+	start := time.Now()
+	loaded, expired := 0, 0
+
+	header, err := snapshot.Load(path, func(e snapshot.Entry) error {
+		if !e.Expiration.IsZero() && !e.Expiration.After(start) {
+			expired++
+			return nil
+		}
+
+		c.applySetWithExpiration(e.Key, e.Value, e.Expiration)
+		loaded++
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to load snapshot %s: %w", filepath.Base(path), err)
+	}
+
+	c.logger.Info("snapshot loaded",
+		"file", filepath.Base(path),
+		"created", header.Created,
+		"keys", loaded,
+		"expired", expired,
+		"duration", time.Since(start),
+	)
+
+	return loaded, nil
+}
+
+// truncateWAL cuts the log at the end of its valid prefix so new appends follow good data.
+func (c *CommandHandler) truncateWAL(walPath string, offset int64, cause error) error {
+	c.logger.Warn("truncating WAL at last valid record", "path", walPath, "offset", offset, "error", cause)
+
+	if err := os.Truncate(walPath, offset); err != nil {
+		return fmt.Errorf("failed to truncate WAL at offset %d: %w", offset, err)
+	}
+
+	return nil
+}
+
+// HandleBGRewriteAOF starts a background rewrite of the WAL.
+func (c *CommandHandler) HandleBGRewriteAOF(parts []string) error {
+	if len(parts) != 1 {
+		return wrongArgs("BGREWRITEAOF")
+	}
+
+	return c.startRewrite()
+}
+
+// startRewrite captures the current store contents and compacts the WAL from them in
+// the background. Holding writeMu while the rewrite begins guarantees every write is
+// either reflected in the copied data or captured by the writer for the new log.
+func (c *CommandHandler) startRewrite() error {
+	c.writeMu.Lock()
+	rewrite, err := c.walWriter.BeginRewrite()
+	if err != nil {
+		c.writeMu.Unlock()
+		return err
+	}
+	items := c.store.Items()
+	c.writeMu.Unlock()
+
+	go c.rewriteWAL(rewrite, items)
+
+	return nil
+}
+
+// rewriteWAL writes one SET per live key, replacing the full history of overwrites.
+// Expiring keys keep their absolute deadline.
+func (c *CommandHandler) rewriteWAL(rewrite *wal.Rewrite, items []store.Item) {
+	start := time.Now()
+	before := c.walWriter.Stats().Size
+	c.logger.Info("background WAL rewrite started", "keys", len(items), "size", before)
+
+	for _, item := range items {
+		if err := rewrite.WriteCommand(setCommand(item.Key, item.Value, item.Expiration)); err != nil {
+			rewrite.Abort()
+			c.logger.Error("background WAL rewrite failed", "error", err)
+			return
+		}
+	}
+
+	if err := rewrite.Commit(); err != nil {
+		c.logger.Error("background WAL rewrite failed", "error", err)
+		return
+	}
+
+	c.logger.Info("background WAL rewrite complete",
+		"keys", len(items),
+		"size_before", before,
+		"size_after", c.walWriter.Stats().Size,
+		"duration", time.Since(start),
+	)
+}
+
+// maybeAutoRewrite starts a rewrite once the WAL has grown by AutoRewritePercentage
+// since the last rewrite, mirroring Redis' auto-aof-rewrite-percentage.
+func (c *CommandHandler) maybeAutoRewrite() {
+	if c.autoRewritePercentage <= 0 {
+		return
+	}
+
+	stats := c.walWriter.Stats()
+	if stats.RewriteInProgress || stats.SnapshotInProgress || stats.Size < c.autoRewriteMinSize {
+		return
+	}
+
+	threshold := stats.BaseSize + stats.BaseSize*int64(c.autoRewritePercentage)/100
+	if stats.Size <= threshold {
+		return
+	}
+
+	c.logger.Info("starting automatic WAL rewrite", "size", stats.Size, "base_size", stats.BaseSize)
+	if err := c.startRewrite(); err != nil && !errors.Is(err, wal.ErrRewriteInProgress) {
+		c.logger.Error("failed to start automatic WAL rewrite", "error", err)
+	}
+}
+
+// HandleSave writes a snapshot in the foreground. Writes are held off until it is on
+// disk, so the snapshot reflects exactly the store at the time SAVE was received.
+func (c *CommandHandler) HandleSave(parts []string) error {
+	if len(parts) != 1 {
+		return wrongArgs("SAVE")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	rewrite, err := c.walWriter.BeginSnapshot()
+	if err != nil {
+		return err
+	}
+
+	return c.writeSnapshot(rewrite, c.store.Items(), time.Now())
+}
+
+// HandleBGSave starts writing a snapshot in the background.
+func (c *CommandHandler) HandleBGSave(parts []string) error {
+	if len(parts) != 1 {
+		return wrongArgs("BGSAVE")
+	}
+
+	return c.startSnapshot()
+}
+
+// HandleLastSave returns the Unix time of the last successful snapshot.
+func (c *CommandHandler) HandleLastSave(parts []string) (int64, error) {
+	if len(parts) != 1 {
+		return 0, wrongArgs("LASTSAVE")
+	}
+
+	return c.walWriter.Stats().LastSnapshot.Unix(), nil
+}
+
+// startSnapshot copies the store and writes it as the new WAL base in the background.
+// As with startRewrite, holding writeMu while the snapshot begins guarantees every
+// write is either in the copy or in the segment the snapshot is followed by.
+func (c *CommandHandler) startSnapshot() error {
+	c.writeMu.Lock()
+	rewrite, err := c.walWriter.BeginSnapshot()
+	if err != nil {
+		c.writeMu.Unlock()
+		return err
+	}
+	items := c.store.Items()
+	created := time.Now()
+	c.writeMu.Unlock()
+
+	go func() {
+		if err := c.writeSnapshot(rewrite, items, created); err != nil {
+			c.logger.Error("background save failed", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// writeSnapshot encodes items into the snapshot base and commits it, replacing the
+// log history it covers.
+func (c *CommandHandler) writeSnapshot(rewrite *wal.Rewrite, items []store.Item, created time.Time) error {
+	start := time.Now()
+	before := c.walWriter.Stats().Size
+
+	entries := make([]snapshot.Entry, len(items))
+	for i, item := range items {
+		entries[i] = snapshot.Entry{Key: item.Key, Value: item.Value, Expiration: item.Expiration}
+	}
+
+	if err := snapshot.Write(rewrite, entries, created); err != nil {
+		rewrite.Abort()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err := rewrite.Commit(); err != nil {
+		return err
+	}
+
+	c.logger.Info("snapshot saved",
+		"keys", len(entries),
+		"size_before", before,
+		"size_after", c.walWriter.Stats().Size,
+		"duration", time.Since(start),
+	)
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/121watts/reredis/internal/pubsub"
+)
+
+// DefaultPubSubBufferLimit bounds the messages waiting to be written to one
+// subscriber when Config leaves PubSubBufferLimit unset. It matches the hard limit of
+// Redis' default client-output-buffer-limit for pub/sub clients.
+const DefaultPubSubBufferLimit = 32 << 20
+
+// PubSub returns the registry PUBLISH delivers through. Anything that subscribes to it,
+// such as the WebSocket bridge, receives the same messages as RESP subscribers.
+func (c *CommandHandler) PubSub() *pubsub.Registry {
+	return c.pubsub
+}
+
+// pubsubBufferLimit returns how many bytes of messages may wait for one subscriber
+// before it is disconnected.
+func (c *CommandHandler) pubsubBufferLimit() int {
+	if c.pubsubLimit > 0 {
+		return c.pubsubLimit
+	}
+	return DefaultPubSubBufferLimit
+}
+
+// mailbox returns the client's mailbox, creating it and starting the goroutine that
+// writes out its messages when the client first subscribes.
+func (c *CommandHandler) mailbox(cl *client) *pubsub.Mailbox {
+	if cl.mailbox == nil {
+		cl.mailbox = pubsub.NewMailbox(c.pubsubBufferLimit(), func() {
+			cl.logger.Warn("closing subscriber that exceeded its output buffer limit")
+			cl.conn.Close()
+		})
+		go writeMessages(cl, cl.mailbox)
+	}
+	return cl.mailbox
+}
+
+// writeMessages writes the messages delivered to a client's mailbox as push replies
+// until the mailbox is closed. It takes the client's lock so messages never land in
+// the middle of a command's reply.
+func writeMessages(cl *client, mb *pubsub.Mailbox) {
+	for range mb.Ready() {
+		msgs := mb.Take()
+
+		cl.mu.Lock()
+		for _, msg := range msgs {
+			writeMessage(cl.w, msg)
+		}
+		cl.w.Flush()
+		cl.mu.Unlock()
+	}
+}
+
+// writeMessage writes a published message the way Redis does: as a "message" push, or
+// a "pmessage" push naming the pattern that matched.
+func writeMessage(w *ReplyWriter, msg pubsub.Message) {
+	if msg.ViaPattern {
+		w.PushHeader(4)
+		w.Bulk("pmessage")
+		w.Bulk(msg.Pattern)
+	} else {
+		w.PushHeader(3)
+		w.Bulk("message")
+	}
+	w.Bulk(msg.Channel)
+	w.Bulk(msg.Payload)
+}
+
+// subscribed reports whether the client is subscribed to any channel or pattern.
+func (c *CommandHandler) subscribed(cl *client) bool {
+	return cl.mailbox != nil && c.pubsub.Count(cl.mailbox) > 0
+}
+
+// unsubscribeAll drops every subscription of a client and stops writing its messages.
+func (c *CommandHandler) unsubscribeAll(cl *client) {
+	if cl.mailbox == nil {
+		return
+	}
+
+	c.pubsub.UnsubscribeAll(cl.mailbox)
+	cl.mailbox.Close()
+}
+
+// allowedWhileSubscribed reports whether a RESP2 connection in subscribed mode may
+// run a command. Such a connection carries messages as ordinary arrays, so only
+// commands whose replies cannot be confused with them are allowed.
+func allowedWhileSubscribed(spec *commandSpec) bool {
+	switch spec.name {
+	case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "ping":
+		return true
+	}
+	return false
+}
+
+// errSubscribedMode is returned for commands a RESP2 connection may not run while
+// subscribed.
+func errSubscribedMode(spec *commandSpec) error {
+	return fmt.Errorf("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context", spec.name)
+}
+
+// handleSubscribeCommand implements SUBSCRIBE and PSUBSCRIBE, confirming each channel
+// or pattern with a push that carries the client's new subscription count.
+func handleSubscribeCommand(parts []string, cl *client, handler *CommandHandler) {
+	kind := strings.ToLower(parts[0])
+	mb := handler.mailbox(cl)
+
+	for _, name := range parts[1:] {
+		var n int
+		if kind == "psubscribe" {
+			n = handler.pubsub.PSubscribe(mb, name)
+		} else {
+			n = handler.pubsub.Subscribe(mb, name)
+		}
+		writeSubscription(cl.w, kind, &name, n)
+	}
+}
+
+// handleUnsubscribeCommand implements UNSUBSCRIBE and PUNSUBSCRIBE. Without arguments
+// they drop every channel, or every pattern, the client is subscribed to, and a client
+// with nothing to drop still gets one confirmation with a null name.
+func handleUnsubscribeCommand(parts []string, cl *client, handler *CommandHandler) {
+	kind := strings.ToLower(parts[0])
+	names := parts[1:]
+
+	if cl.mailbox == nil {
+		for _, name := range names {
+			writeSubscription(cl.w, kind, &name, 0)
+		}
+		if len(names) == 0 {
+			writeSubscription(cl.w, kind, nil, 0)
+		}
+		return
+	}
+
+	if len(names) == 0 {
+		channels, patterns := handler.pubsub.Subscriptions(cl.mailbox)
+		if names = channels; kind == "punsubscribe" {
+			names = patterns
+		}
+		if len(names) == 0 {
+			writeSubscription(cl.w, kind, nil, handler.pubsub.Count(cl.mailbox))
+			return
+		}
+	}
+
+	for _, name := range names {
+		var n int
+		if kind == "punsubscribe" {
+			n = handler.pubsub.PUnsubscribe(cl.mailbox, name)
+		} else {
+			n = handler.pubsub.Unsubscribe(cl.mailbox, name)
+		}
+		writeSubscription(cl.w, kind, &name, n)
+	}
+}
+
+// writeSubscription writes the push confirming a subscription change. A nil name is
+// written as null.
+func writeSubscription(w *ReplyWriter, kind string, name *string, count int) {
+	w.PushHeader(3)
+	w.Bulk(kind)
+	if name == nil {
+		w.Null()
+	} else {
+		w.Bulk(*name)
+	}
+	w.Integer(int64(count))
+}
+
+// handlePublishCommand implements PUBLISH and replies with how many subscribers the
+// message was delivered to. Messages only reach subscribers connected to this node.
+func handlePublishCommand(parts []string, cl *client, handler *CommandHandler) {
+	cl.w.Integer(int64(handler.pubsub.Publish(parts[1], parts[2])))
+}
+
+// handlePubSubCommand reports unknown PUBSUB subcommands.
+func handlePubSubCommand(parts []string, cl *client, handler *CommandHandler) {
+	cl.w.Error(fmt.Sprintf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", parts[1]))
+}
+
+// handlePubSubChannelsCommand implements PUBSUB CHANNELS [pattern].
+func handlePubSubChannelsCommand(parts []string, cl *client, handler *CommandHandler) {
+	if len(parts) > 3 {
+		cl.w.WriteError(wrongArgs("pubsub|channels"))
+		return
+	}
+
+	var pattern string
+	if len(parts) == 3 {
+		pattern = parts[2]
+	}
+	cl.w.BulkArray(handler.pubsub.Channels(pattern))
+}
+
+// handlePubSubNumSubCommand implements PUBSUB NUMSUB [channel ...], replying with each
+// channel followed by its subscriber count.
+func handlePubSubNumSubCommand(parts []string, cl *client, handler *CommandHandler) {
+	channels := parts[2:]
+	cl.w.ArrayHeader(2 * len(channels))
+	for _, channel := range channels {
+		cl.w.Bulk(channel)
+		cl.w.Integer(int64(handler.pubsub.NumSub(channel)))
+	}
+}
+
+// handlePubSubNumPatCommand implements PUBSUB NUMPAT.
+func handlePubSubNumPatCommand(parts []string, cl *client, handler *CommandHandler) {
+	cl.w.Integer(int64(handler.pubsub.NumPat()))
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+)
+
+// writeBufferSize is how many bytes of replies are collected before they are sent
+// even without a Flush, bounding the memory a deep pipeline holds per connection.
+const writeBufferSize = 16 * 1024
+
+// ReplyWriter encodes RESP replies to a client. Replies are buffered until Flush,
+// so a reply made of several elements, such as an array, reaches the client in one
+// write, and handlers need not check for write errors after every call. Replies to
+// pipelined commands accumulate in the same buffer and are sent together.
+//
+// Handlers always describe replies with the richest type that fits, such as a map
+// or a double, and the writer encodes it for the protocol the client negotiated
+// with HELLO. Under RESP2 the RESP3-only types fall back to the encodings Redis uses:
+// maps and sets become flat arrays, doubles and big numbers become bulk strings and
+// booleans become integers.
+type ReplyWriter struct {
+	bw    *bufio.Writer
+	proto int    // RESP version in use; 2 until the client switches with HELLO
+	num   []byte // Scratch space for formatting integers
+}
+
+// NewReplyWriter returns a writer that sends RESP2 replies to w.
+func NewReplyWriter(w io.Writer) *ReplyWriter {
+	return &ReplyWriter{bw: bufio.NewWriterSize(w, writeBufferSize), proto: 2}
+}
+
+// Protocol returns the RESP version replies are encoded in.
+func (r *ReplyWriter) Protocol() int {
+	return r.proto
+}
+
+// SetProtocol switches the encoding of every following reply to RESP version proto.
+func (r *ReplyWriter) SetProtocol(proto int) {
+	r.proto = proto
+}
+
+// Flush sends every buffered reply to the client and returns the first write error.
+func (r *ReplyWriter) Flush() error {
+	return r.bw.Flush()
+}
+
+// SimpleString writes a status reply such as +OK.
+func (r *ReplyWriter) SimpleString(s string) {
+	r.bw.WriteByte('+')
+	r.bw.WriteString(s)
+	r.crlf()
+}
+
+// Error writes an error reply. msg starts with the error code, e.g. "ERR syntax error".
+func (r *ReplyWriter) Error(msg string) {
+	r.bw.WriteByte('-')
+	r.bw.WriteString(msg)
+	r.crlf()
+}
+
+// WriteError writes a handler error as an error reply. Keys owned by another node are
+// answered with -MOVED so cluster-aware clients can follow the redirect, a *CodedError
+// is sent under its own code, and every other error gets the generic ERR code.
+func (r *ReplyWriter) WriteError(err error) {
+	var moved *MovedError
+	if errors.As(err, &moved) {
+		r.Error(moved.Error())
+		return
+	}
+
+	var coded *CodedError
+	if errors.As(err, &coded) {
+		r.Error(coded.Error())
+		return
+	}
+
+	r.Error("ERR " + err.Error())
+}
+
+// Integer writes an integer reply.
+func (r *ReplyWriter) Integer(n int64) {
+	r.prefixed(':', n)
+}
+
+// Bulk writes a binary-safe bulk string reply.
+func (r *ReplyWriter) Bulk(s string) {
+	r.prefixed('$', int64(len(s)))
+	r.bw.WriteString(s)
+	r.crlf()
+}
+
+// Null writes the null bulk string, which Redis returns for missing keys.
+func (r *ReplyWriter) Null() {
+	if r.proto >= 3 {
+		r.bw.WriteString("_\r\n")
+		return
+	}
+	r.bw.WriteString("$-1\r\n")
+}
+
+// NullArray writes the null array, which Redis returns for aborted transactions
+// and timed-out blocking commands. RESP3 has a single null for both.
+func (r *ReplyWriter) NullArray() {
+	if r.proto >= 3 {
+		r.bw.WriteString("_\r\n")
+		return
+	}
+	r.bw.WriteString("*-1\r\n")
+}
+
+// ArrayHeader starts an array of n elements. The caller writes the elements next,
+// and they may themselves be arrays.
+func (r *ReplyWriter) ArrayHeader(n int) {
+	r.prefixed('*', int64(n))
+}
+
+// MapHeader starts a map of n key-value pairs. The caller writes 2n elements next,
+// alternating keys and values.
+func (r *ReplyWriter) MapHeader(n int) {
+	if r.proto >= 3 {
+		r.prefixed('%', int64(n))
+		return
+	}
+	r.ArrayHeader(2 * n)
+}
+
+// SetHeader starts a set of n unique elements.
+func (r *ReplyWriter) SetHeader(n int) {
+	if r.proto >= 3 {
+		r.prefixed('~', int64(n))
+		return
+	}
+	r.ArrayHeader(n)
+}
+
+// PushHeader starts an out-of-band push message of n elements, such as a pub/sub
+// message. RESP2 clients receive it as an ordinary array.
+func (r *ReplyWriter) PushHeader(n int) {
+	if r.proto >= 3 {
+		r.prefixed('>', int64(n))
+		return
+	}
+	r.ArrayHeader(n)
+}
+
+// Double writes a floating point reply.
+func (r *ReplyWriter) Double(f float64) {
+	if r.proto >= 3 {
+		r.bw.WriteByte(',')
+		r.bw.WriteString(formatDouble(f))
+		r.crlf()
+		return
+	}
+	r.Bulk(formatDouble(f))
+}
+
+// Boolean writes a true or false reply.
+func (r *ReplyWriter) Boolean(b bool) {
+	if r.proto >= 3 {
+		if b {
+			r.bw.WriteString("#t\r\n")
+		} else {
+			r.bw.WriteString("#f\r\n")
+		}
+		return
+	}
+
+	if b {
+		r.Integer(1)
+	} else {
+		r.Integer(0)
+	}
+}
+
+// BigNumber writes an integer too large for a 64-bit reply, given in decimal.
+func (r *ReplyWriter) BigNumber(n string) {
+	if r.proto >= 3 {
+		r.bw.WriteByte('(')
+		r.bw.WriteString(n)
+		r.crlf()
+		return
+	}
+	r.Bulk(n)
+}
+
+// Verbatim writes text meant to be shown to a user as is, such as INFO output.
+// format is a three-letter hint for how to display it, "txt" or "mkd".
+func (r *ReplyWriter) Verbatim(format, s string) {
+	if r.proto >= 3 {
+		r.prefixed('=', int64(len(format)+1+len(s)))
+		r.bw.WriteString(format)
+		r.bw.WriteByte(':')
+		r.bw.WriteString(s)
+		r.crlf()
+		return
+	}
+	r.Bulk(s)
+}
+
+// BulkArray writes an array of bulk strings.
+func (r *ReplyWriter) BulkArray(items []string) {
+	r.ArrayHeader(len(items))
+	for _, item := range items {
+		r.Bulk(item)
+	}
+}
+
+// writeRaw writes replies that were already encoded for this connection.
+func (r *ReplyWriter) writeRaw(p []byte) {
+	r.bw.Write(p)
+}
+
+// prefixed writes a type byte followed by an integer and CRLF, the shape shared by
+// integer replies and the length headers of bulk strings and arrays.
+func (r *ReplyWriter) prefixed(prefix byte, n int64) {
+	r.bw.WriteByte(prefix)
+	r.num = strconv.AppendInt(r.num[:0], n, 10)
+	r.bw.Write(r.num)
+	r.crlf()
+}
+
+func (r *ReplyWriter) crlf() {
+	r.bw.WriteString("\r\n")
+}
+
+// formatDouble renders a float the way Redis does, with the shortest representation
+// that reads back as the same value and inf, -inf and nan for the special values.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
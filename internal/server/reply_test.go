@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestReplyWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *ReplyWriter)
+		want  string
+	}{
+		{"simple string", func(w *ReplyWriter) { w.SimpleString("OK") }, "+OK\r\n"},
+		{"error", func(w *ReplyWriter) { w.Error("ERR syntax error") }, "-ERR syntax error\r\n"},
+		{"handler error", func(w *ReplyWriter) { w.WriteError(errors.New("boom")) }, "-ERR boom\r\n"},
+		{"moved", func(w *ReplyWriter) { w.WriteError(&MovedError{Slot: 3999, Host: "127.0.0.1", Port: "6381"}) }, "-MOVED 3999 127.0.0.1:6381\r\n"},
+		{"integer", func(w *ReplyWriter) { w.Integer(-42) }, ":-42\r\n"},
+		{"bulk", func(w *ReplyWriter) { w.Bulk("a\r\nb") }, "$4\r\na\r\nb\r\n"},
+		{"empty bulk", func(w *ReplyWriter) { w.Bulk("") }, "$0\r\n\r\n"},
+		{"null", func(w *ReplyWriter) { w.Null() }, "$-1\r\n"},
+		{"null array", func(w *ReplyWriter) { w.NullArray() }, "*-1\r\n"},
+		{"bulk array", func(w *ReplyWriter) { w.BulkArray([]string{"a", "bc"}) }, "*2\r\n$1\r\na\r\n$2\r\nbc\r\n"},
+		{"nested array", func(w *ReplyWriter) {
+			w.ArrayHeader(2)
+			w.Integer(1)
+			w.BulkArray(nil)
+		}, "*2\r\n:1\r\n*0\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewReplyWriter(&buf)
+			tt.write(w)
+
+			if buf.Len() != 0 {
+				t.Errorf("Expected nothing to be sent before Flush, got %q", buf.String())
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, buf.String())
+			}
+		})
+	}
+}
+
+func TestReplyWriterProtocols(t *testing.T) {
+	write := func(w *ReplyWriter) {
+		w.MapHeader(1)
+		w.Bulk("k")
+		w.Double(1.5)
+		w.SetHeader(1)
+		w.Boolean(true)
+		w.BigNumber("123456789012345678901234567890")
+		w.Verbatim("txt", "hi")
+		w.PushHeader(1)
+		w.Null()
+		w.NullArray()
+		w.Double(math.Inf(-1))
+	}
+
+	tests := []struct {
+		proto int
+		want  string
+	}{
+		{2, "*2\r\n$1\r\nk\r\n$3\r\n1.5\r\n*1\r\n:1\r\n$30\r\n123456789012345678901234567890\r\n$2\r\nhi\r\n*1\r\n$-1\r\n*-1\r\n$4\r\n-inf\r\n"},
+		{3, "%1\r\n$1\r\nk\r\n,1.5\r\n~1\r\n#t\r\n(123456789012345678901234567890\r\n=6\r\ntxt:hi\r\n>1\r\n_\r\n_\r\n,-inf\r\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := NewReplyWriter(&buf)
+		w.SetProtocol(tt.proto)
+		write(w)
+		w.Flush()
+
+		if buf.String() != tt.want {
+			t.Errorf("RESP%d: expected %q, got %q", tt.proto, tt.want, buf.String())
+		}
+	}
+}
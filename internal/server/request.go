@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// DefaultMaxBulkLen bounds a single request argument when RequestOptions leaves
+// MaxBulkLen unset. It matches Redis' proto-max-bulk-len.
+const DefaultMaxBulkLen = 512 << 20
+
+// maxMultiBulkLen is the most arguments a multi-bulk request may declare, as in Redis.
+const maxMultiBulkLen = 1024 * 1024
+
+// readBufferSize is how much of the client's input is read per syscall, so a whole
+// pipelined batch of small commands usually arrives in one read.
+const readBufferSize = 16 * 1024
+
+// maxInlineLen bounds an inline command line, as Redis' PROTO_INLINE_MAX_SIZE does.
+const maxInlineLen = 64 * 1024
+
+// ProtocolError reports a request that does not follow RESP. The stream cannot be
+// resynchronized after one, so the connection is answered and then closed.
+type ProtocolError struct {
+	Msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Msg
+}
+
+// RequestOptions configures a RequestReader.
+type RequestOptions struct {
+	MaxBulkLen int64 // Largest argument accepted; 0 means DefaultMaxBulkLen
+}
+
+// RequestReader decodes client requests from a RESP stream. It accepts both the
+// multi-bulk arrays sent by client libraries (*N\r\n$len\r\n...) and the inline
+// commands typed into telnet or redis-cli, reading bulk arguments by their declared
+// length so values may contain any bytes.
+type RequestReader struct {
+	br   *bufio.Reader
+	opts RequestOptions
+}
+
+// NewRequestReader returns a reader that decodes requests from r.
+func NewRequestReader(r io.Reader, opts RequestOptions) *RequestReader {
+	if opts.MaxBulkLen <= 0 {
+		opts.MaxBulkLen = DefaultMaxBulkLen
+	}
+
+	return &RequestReader{br: bufio.NewReaderSize(r, readBufferSize), opts: opts}
+}
+
+// ReadCommand returns the next request's arguments. Empty requests, such as blank
+// inline lines or *0 arrays, are skipped. It returns io.EOF when the client has
+// closed the connection between requests, and a *ProtocolError for malformed input.
+func (r *RequestReader) ReadCommand() ([]string, error) {
+	for {
+		first, err := r.br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		var parts []string
+		if first[0] == '*' {
+			parts, err = r.readMultiBulk()
+		} else {
+			parts, err = r.readInline()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(parts) > 0 {
+			return parts, nil
+		}
+	}
+}
+
+// readInline parses a space-separated command line, honoring double quotes.
+func (r *RequestReader) readInline() ([]string, error) {
+	line, err := r.readLine(maxInlineLen, "too big inline request")
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := parseRedisCommand(string(line))
+	if err != nil {
+		return nil, &ProtocolError{Msg: err.Error()}
+	}
+
+	return parts, nil
+}
+
+// readMultiBulk parses an array of bulk strings.
+func (r *RequestReader) readMultiBulk() ([]string, error) {
+	line, err := r.readLine(maxInlineLen, "too big mbulk count string")
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || count > maxMultiBulkLen {
+		return nil, &ProtocolError{Msg: "invalid multibulk length"}
+	}
+
+	if count <= 0 {
+		return nil, nil
+	}
+
+	parts := make([]string, 0, count)
+	for i := int64(0); i < count; i++ {
+		arg, err := r.readBulk()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, arg)
+	}
+
+	return parts, nil
+}
+
+// readBulk reads one $len\r\n<bytes>\r\n argument.
+func (r *RequestReader) readBulk() (string, error) {
+	line, err := r.readLine(maxInlineLen, "too big bulk count string")
+	if err != nil {
+		return "", err
+	}
+
+	if len(line) == 0 || line[0] != '$' {
+		return "", &ProtocolError{Msg: fmt.Sprintf("expected '$', got '%s'", firstByte(line))}
+	}
+
+	length, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || length < 0 || length > r.opts.MaxBulkLen {
+		return "", &ProtocolError{Msg: "invalid bulk length"}
+	}
+
+	// Grow the buffer as bytes arrive rather than trusting the declared length, so a
+	// client cannot make the server allocate proto-max-bulk-len without sending it
+	var buf bytes.Buffer
+	buf.Grow(int(min(length+2, maxInlineLen)))
+	if _, err := io.CopyN(&buf, r.br, length+2); err != nil {
+		return "", unexpectedEOF(err)
+	}
+
+	data := buf.Bytes()
+
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return "", &ProtocolError{Msg: "bulk string is not terminated by CRLF"}
+	}
+
+	return string(data[:length]), nil
+}
+
+// readLine returns the next line without its line ending, rejecting lines longer
+// than limit so a client cannot make the server buffer unbounded input.
+func (r *RequestReader) readLine(limit int, tooBig string) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.br.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return nil, &ProtocolError{Msg: tooBig}
+		}
+		line = append(line, chunk...)
+
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, unexpectedEOF(err)
+		}
+	}
+
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	return line, nil
+}
+
+// firstByte renders the first byte of a line for protocol error messages.
+func firstByte(line []byte) string {
+	if len(line) == 0 {
+		return ""
+	}
+	return string(line[:1])
+}
+
+// unexpectedEOF reports a connection closed partway through a request as such,
+// since ReadCommand reserves io.EOF for a clean close between requests.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
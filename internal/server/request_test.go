@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRequestReader(t *testing.T) {
+	input := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$11\r\nline\r\nbreak\r\n" +
+		"\r\n" +
+		"*0\r\n" +
+		"GET \"spaced key\"\n" +
+		"*2\r\n$3\r\nGET\r\n$0\r\n\r\n"
+	reader := NewRequestReader(strings.NewReader(input), RequestOptions{})
+
+	expected := [][]string{
+		{"SET", "key", "line\r\nbreak"},
+		{"GET", "spaced key"},
+		{"GET", ""},
+	}
+	for i, want := range expected {
+		got, err := reader.ReadCommand()
+		if err != nil {
+			t.Fatalf("Request %d: unexpected error %v", i, err)
+		}
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("Request %d: expected %q, got %q", i, want, got)
+		}
+	}
+
+	if _, err := reader.ReadCommand(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last request, got %v", err)
+	}
+}
+
+func TestRequestReaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"bulk over the size limit", "*1\r\n$11\r\nhello world\r\n", &ProtocolError{}},
+		{"negative bulk length", "*1\r\n$-1\r\n", &ProtocolError{}},
+		{"missing bulk header", "*1\r\nGET\r\n", &ProtocolError{}},
+		{"bad multibulk length", "*x\r\n", &ProtocolError{}},
+		{"too many arguments", "*2000000\r\n", &ProtocolError{}},
+		{"bulk without CRLF", "*1\r\n$3\r\nGETX\r\n", &ProtocolError{}},
+		{"unclosed quote", "GET \"key\r\n", &ProtocolError{}},
+		{"inline line too long", strings.Repeat("a", maxInlineLen+1) + "\r\n", &ProtocolError{}},
+		{"connection closed mid-request", "*2\r\n$3\r\nGET\r\n", io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := NewRequestReader(strings.NewReader(tt.input), RequestOptions{MaxBulkLen: 10})
+			_, err := reader.ReadCommand()
+
+			var protoErr *ProtocolError
+			if _, ok := tt.want.(*ProtocolError); ok {
+				if !errors.As(err, &protoErr) {
+					t.Errorf("Expected a protocol error, got %v", err)
+				}
+			} else if !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -1,8 +1,9 @@
 package server
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"strings"
@@ -10,39 +11,29 @@ import (
 	"github.com/121watts/reredis/internal/cluster"
 	"github.com/121watts/reredis/internal/observer"
 	"github.com/121watts/reredis/internal/store"
-	"github.com/121watts/reredis/internal/wal"
 )
 
 // Start launches the Redis-compatible TCP server on the specified address.
 // This provides the main Redis protocol interface, enabling existing Redis clients
 // to connect and operate with full compatibility for commands like SET, GET, DEL.
-func Start(address string, s *store.Store, logger *slog.Logger, hub *observer.Hub, cm *cluster.Manager) error {
+func Start(address string, handler *CommandHandler, logger *slog.Logger) error {
 	ln, err := net.Listen("tcp", address)
 
 	if err != nil {
 		return fmt.Errorf("failed to bind: %w", err)
 	}
 
-	return StartWithListener(ln, s, logger, hub, cm)
+	return StartWithListener(ln, handler, logger)
 }
 
 // StartWithListener runs the TCP server using an existing network listener.
 // This enables testing with dynamic ports and supports advanced deployment
-// scenarios where the listener is managed externally.
-func StartWithListener(ln net.Listener, s *store.Store, logger *slog.Logger, hub *observer.Hub, cm *cluster.Manager) error {
+// scenarios where the listener is managed externally. The handler should come
+// from Open so the WAL has been replayed before the first connection is accepted.
+func StartWithListener(ln net.Listener, handler *CommandHandler, logger *slog.Logger) error {
 	defer ln.Close()
 	logger.Info("listening on port", "addr", ln.Addr().String())
 
-	// Create WAL writer (placeholder for now)
-	walWriter, err := wal.NewWriter("reredis.wal")
-	if err != nil {
-		return fmt.Errorf("failed to create WAL writer: %w", err)
-	}
-	defer walWriter.Close()
-
-	// Create command handler
-	handler := NewCommandHandler(s, hub, walWriter, cm, logger)
-
 	for {
 		conn, err := ln.Accept()
 
@@ -57,76 +48,66 @@ func StartWithListener(ln net.Listener, s *store.Store, logger *slog.Logger, hub
 	}
 }
 
-// commandTable maps Redis command names to their handler functions.
-// This enables fast command dispatch and easy extension with new Redis-compatible
-// commands while maintaining clean separation of concerns.
-func handleCommand(cmd string, parts []string, conn net.Conn, logger *slog.Logger, handler *CommandHandler) {
-	// Check for redirect on key-based commands
-	if isKeyBasedCommand(cmd) && len(parts) >= 2 {
-		key := parts[1]
-		if redirectKey := handler.checkSlotOwnership(key); redirectKey != "" {
-			handleRedirect(redirectKey, conn, handler)
-			return
-		}
-	}
-
-	switch cmd {
-	case "SET":
-		handleSetCommand(parts, conn, logger, handler)
-	case "GET":
-		handleGetCommand(parts, conn, logger, handler)
-	case "DEL":
-		handleDeleteCommand(parts, conn, logger, handler)
-	case "CLUSTER":
-		handleClusterCommand(parts, conn, logger, handler)
-	default:
-		fmt.Fprintf(conn, "-ERR unknown command\r\n")
-	}
-}
-
-func isKeyBasedCommand(cmd string) bool {
-	switch cmd {
-	case "SET", "GET", "DEL":
-		return true
-	default:
-		return false
-	}
-}
-
 // handleConnection processes Redis protocol commands from a single client connection.
 // This implements the Redis wire protocol with proper parsing and response formatting,
-// enabling compatibility with existing Redis clients and tools.
+// enabling compatibility with existing Redis clients and tools. Pipelined commands
+// are executed in order as they are decoded, and their replies are flushed in one
+// write once every command already received has been answered.
 func handleConnection(conn net.Conn, logger *slog.Logger, handler *CommandHandler) {
 	defer conn.Close()
 
-	scanner := bufio.NewScanner(conn)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts, err := parseRedisCommand(line)
+	cl := handler.newClient(conn, logger)
+	defer handler.unwatch(cl)
+	defer handler.unsubscribeAll(cl)
+	reader := NewRequestReader(&flushingReader{r: conn, cl: cl}, RequestOptions{MaxBulkLen: handler.maxBulkLen})
 
+	for {
+		parts, err := reader.ReadCommand()
 		if err != nil {
-			fmt.Fprintf(conn, "-ERR %s\r\n", err.Error())
-			continue
-		}
-
-		if len(parts) == 0 {
-			fmt.Fprintf(conn, "-ERR empty command\r\n")
-			continue
+			var protoErr *ProtocolError
+			switch {
+			case errors.As(err, &protoErr):
+				cl.mu.Lock()
+				cl.w.WriteError(protoErr)
+				cl.w.Flush()
+				cl.mu.Unlock()
+				logger.Warn("closing connection after protocol error", "error", err)
+			case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+			default:
+				logger.Error("error reading from connection", "error", err)
+			}
+			return
 		}
 
-		cmd := strings.ToUpper(parts[0])
-		handleCommand(cmd, parts, conn, logger, handler)
+		cl.mu.Lock()
+		handleCommand(parts, cl, handler)
+		cl.mu.Unlock()
 	}
+}
 
-	if err := scanner.Err(); err != nil {
-		logger.Error("error reading from connection", "error", err)
+// flushingReader sends pending replies before each read from the connection. The
+// request reader only reads once it has decoded every command it already holds, so
+// this flushes exactly when the server would otherwise wait on the client with
+// replies still buffered: once per pipelined batch, and never mid-batch.
+type flushingReader struct {
+	r  io.Reader
+	cl *client
+}
+
+func (f *flushingReader) Read(p []byte) (int, error) {
+	f.cl.mu.Lock()
+	err := f.cl.w.Flush()
+	f.cl.mu.Unlock()
+	if err != nil {
+		return 0, err
 	}
+
+	return f.r.Read(p)
 }
 
-// parseRedisCommand parses a Redis command line, handling quoted strings with spaces.
-// This enables proper Redis protocol compatibility by correctly parsing arguments
-// that contain spaces when enclosed in double quotes.
+// parseRedisCommand parses an inline command line, handling quoted strings with spaces.
+// This keeps telnet and hand-typed commands working alongside multi-bulk requests,
+// correctly parsing arguments that contain spaces when enclosed in double quotes.
 func parseRedisCommand(line string) ([]string, error) {
 	var parts []string
 	var current strings.Builder
@@ -179,86 +160,82 @@ func parseRedisCommand(line string) ([]string, error) {
 	return parts, nil
 }
 
-func handleSetCommand(parts []string, conn net.Conn, logger *slog.Logger, handler *CommandHandler) {
-	result, err := handler.HandleSet(parts)
-	if err != nil {
-		fmt.Fprintf(conn, "-ERR %s\r\n", err.Error())
-		return
-	}
-
-	// Send response
-	fmt.Fprintf(conn, "+OK\r\n")
-
-	// Handle broadcasting
-	if result != nil {
-		handler.hub.BroadcastMessage(observer.UpdateMessage{
-			Action: result.Action,
-			Key:    result.Key,
-			Value:  result.Value,
-		})
-
-		if result.NeedsStats {
-			broadcastClusterStats(handler.hub, handler.store, handler.clusterManager)
-		}
+func handleSetCommand(parts []string, cl *client, handler *CommandHandler) {
+	reply, _, err := handler.HandleSet(parts)
+	switch {
+	case err != nil:
+		cl.w.WriteError(err)
+	case reply.Get && reply.Existed:
+		cl.w.Bulk(reply.Old)
+	case reply.Get, !reply.Written:
+		cl.w.Null()
+	default:
+		cl.w.SimpleString("OK")
 	}
 }
 
-func handleGetCommand(parts []string, conn net.Conn, _ *slog.Logger, handler *CommandHandler) {
+func handleGetCommand(parts []string, cl *client, handler *CommandHandler) {
 	value, err := handler.HandleGet(parts)
-	if err != nil {
-		fmt.Fprintf(conn, "-ERR %s\r\n", err.Error())
-	} else {
-		fmt.Fprintf(conn, "%s\r\n", value)
-	}
+	writeValue(cl, value, err)
 }
 
-func handleDeleteCommand(parts []string, conn net.Conn, _ *slog.Logger, handler *CommandHandler) {
-	deleted, result, err := handler.HandleDelete(parts)
+func handleDeleteCommand(parts []string, cl *client, handler *CommandHandler) {
+	n, err := handler.HandleDelete(parts)
 	if err != nil {
-		fmt.Fprintf(conn, "-ERR %s\r\n", err.Error())
+		cl.w.WriteError(err)
 		return
 	}
 
-	// Send response
-	if deleted {
-		fmt.Fprintf(conn, ":1\r\n")
+	cl.w.Integer(n)
+}
+
+func handleClusterCommand(parts []string, cl *client, handler *CommandHandler) {
+	if err := handler.HandleCluster(parts); err != nil {
+		cl.w.WriteError(err)
 	} else {
-		fmt.Fprintf(conn, ":0\r\n")
+		cl.w.SimpleString("OK")
 	}
+}
 
-	// Handle broadcasting
-	if result != nil {
-		handler.hub.BroadcastMessage(observer.UpdateMessage{
-			Action: result.Action,
-			Key:    result.Key,
-		})
+func handleInfoCommand(parts []string, cl *client, handler *CommandHandler) {
+	info, err := handler.HandleInfo(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+	} else {
+		cl.w.Verbatim("txt", info)
+	}
+}
 
-		if result.NeedsStats {
-			broadcastClusterStats(handler.hub, handler.store, handler.clusterManager)
-		}
+func handleBGRewriteAOFCommand(parts []string, cl *client, handler *CommandHandler) {
+	if err := handler.HandleBGRewriteAOF(parts); err != nil {
+		cl.w.WriteError(err)
+	} else {
+		cl.w.SimpleString("Background append only file rewriting started")
 	}
 }
 
-func handleClusterCommand(parts []string, conn net.Conn, logger *slog.Logger, handler *CommandHandler) {
-	err := handler.HandleCluster(parts)
-	if err != nil {
-		fmt.Fprintf(conn, "-ERR %s\r\n", err.Error())
+func handleSaveCommand(parts []string, cl *client, handler *CommandHandler) {
+	if err := handler.HandleSave(parts); err != nil {
+		cl.w.WriteError(err)
 	} else {
-		fmt.Fprintf(conn, "+OK\r\n")
+		cl.w.SimpleString("OK")
 	}
 }
 
-func handleRedirect(key string, conn net.Conn, handler *CommandHandler) {
-	if handler.clusterManager == nil {
-		return
+func handleBGSaveCommand(parts []string, cl *client, handler *CommandHandler) {
+	if err := handler.HandleBGSave(parts); err != nil {
+		cl.w.WriteError(err)
+	} else {
+		cl.w.SimpleString("Background saving started")
 	}
+}
 
-	slot := cluster.CalculateSlot(key)
-	ownerNode := handler.clusterManager.GetNodeForSlots(slot)
-	if ownerNode != nil {
-		fmt.Fprintf(conn, "-MOVED %d %s:%s\r\n", slot, ownerNode.Host, ownerNode.Port)
+func handleLastSaveCommand(parts []string, cl *client, handler *CommandHandler) {
+	lastSave, err := handler.HandleLastSave(parts)
+	if err != nil {
+		cl.w.WriteError(err)
 	} else {
-		fmt.Fprintf(conn, "-ERR no node found for slot %d\r\n", slot)
+		cl.w.Integer(lastSave)
 	}
 }
 
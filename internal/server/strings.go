@@ -0,0 +1,577 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/121watts/reredis/internal/store"
+)
+
+// errOverflow is returned when an increment would leave the 64-bit integer range.
+var errOverflow = errors.New("increment or decrement would overflow")
+
+// errNotFloat is returned for values and arguments that must be finite floats.
+var errNotFloat = errors.New("value is not a valid float")
+
+// HandleIncr implements INCR, DECR, INCRBY and DECRBY and returns the new value.
+// A missing key counts as 0, and the key keeps its expiration.
+func (c *CommandHandler) HandleIncr(parts []string) (int64, error) {
+	delta := int64(1)
+	switch cmd := strings.ToUpper(parts[0]); cmd {
+	case "DECR":
+		delta = -1
+	case "INCRBY", "DECRBY":
+		n, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return 0, errNotInteger
+		}
+		if cmd == "DECRBY" {
+			if n == math.MinInt64 {
+				return 0, errors.New("decrement would overflow")
+			}
+			n = -n
+		}
+		delta = n
+	}
+
+	var result int64
+	err := c.update(parts, "incrby", func(old string, exists bool) (string, error) {
+		var current int64
+		if exists {
+			n, err := strconv.ParseInt(old, 10, 64)
+			if err != nil {
+				return "", errNotInteger
+			}
+			current = n
+		}
+
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return "", errOverflow
+		}
+
+		result = current + delta
+		return strconv.FormatInt(result, 10), nil
+	})
+
+	return result, err
+}
+
+// HandleIncrByFloat implements INCRBYFLOAT and returns the new value as it is stored,
+// in plain decimal notation without an exponent.
+func (c *CommandHandler) HandleIncrByFloat(parts []string) (string, error) {
+	delta, ok := parseFloat(parts[2])
+	if !ok {
+		return "", errNotFloat
+	}
+
+	var result string
+	err := c.update(parts, "incrbyfloat", func(old string, exists bool) (string, error) {
+		var current float64
+		if exists {
+			if current, ok = parseFloat(old); !ok {
+				return "", errNotFloat
+			}
+		}
+
+		sum := current + delta
+		if math.IsInf(sum, 0) || math.IsNaN(sum) {
+			return "", errors.New("increment would produce NaN or Infinity")
+		}
+
+		result = strconv.FormatFloat(sum, 'f', -1, 64)
+		return result, nil
+	})
+
+	return result, err
+}
+
+// parseFloat parses a finite float the way Redis reads numeric string values.
+func parseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+// update runs a read-modify-write command: fn computes the key's new value from its
+// current one inside the store, so concurrent updates cannot be lost. The result is
+// logged as the SET it amounts to, with the key's expiration as PXAT, so replay
+// restores the value without repeating the computation. An error from fn leaves the
+// key unchanged and is returned as is. event names the change in keyspace
+// notifications.
+func (c *CommandHandler) update(parts []string, event string, fn func(old string, exists bool) (string, error)) error {
+	k := parts[1]
+	var value string
+	var fnErr error
+
+	err := c.applyAndLog(parts, func() []string {
+		res, err := c.store.Update(k, func(old string, exists bool) (string, error) {
+			v, err := fn(old, exists)
+			value = v
+			return v, err
+		})
+		if err != nil {
+			fnErr = err
+			return nil
+		}
+
+		c.countSet(k, value, res.Old, res.Existed)
+		return setCommand(k, value, res.Expiration)
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return err
+	}
+
+	c.broadcast(&OperationResult{
+		Key:        k,
+		Value:      value,
+		Action:     "set",
+		NeedsStats: c.clusterManager != nil && len(c.clusterManager.Nodes) > 1,
+	})
+	c.notify(notifyString, event, k)
+
+	return nil
+}
+
+func handleIncrCommand(parts []string, cl *client, handler *CommandHandler) {
+	n, err := handler.HandleIncr(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Integer(n)
+}
+
+func handleIncrByFloatCommand(parts []string, cl *client, handler *CommandHandler) {
+	value, err := handler.HandleIncrByFloat(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Bulk(value)
+}
+
+// HandleMGet implements MGET and returns the values of the keys in order; found
+// reports which keys exist.
+func (c *CommandHandler) HandleMGet(parts []string) (values []string, found []bool, err error) {
+	values, found = c.store.GetMany(parts[1:])
+	return values, found, nil
+}
+
+// HandleMSet implements MSET and MSETNX and reports whether the values were written,
+// which MSETNX only does if none of the keys exist. All pairs are applied in one step
+// and logged as a single MSET record, so a crash cannot leave some of them written.
+func (c *CommandHandler) HandleMSet(parts []string) (bool, error) {
+	if len(parts)%2 == 0 {
+		return false, wrongArgs(parts[0])
+	}
+
+	cond := store.SetAlways
+	if strings.EqualFold(parts[0], "MSETNX") {
+		cond = store.SetIfNotExists
+	}
+
+	items := make([]store.Item, 0, (len(parts)-1)/2)
+	for i := 1; i < len(parts); i += 2 {
+		items = append(items, store.Item{Key: parts[i], Value: parts[i+1]})
+	}
+
+	var written bool
+	err := c.applyAndLog(parts, func() []string {
+		written = c.applySetMany(items, cond)
+		if !written {
+			return nil
+		}
+		return append([]string{"MSET"}, parts[1:]...)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if written {
+		needsStats := c.clusterManager != nil && len(c.clusterManager.Nodes) > 1
+		for _, item := range items {
+			c.broadcast(&OperationResult{Key: item.Key, Value: item.Value, Action: "set", NeedsStats: needsStats})
+			c.notify(notifyString, "set", item.Key)
+		}
+	}
+
+	return written, nil
+}
+
+// applySetMany stores several permanent values at once and updates the cluster
+// statistics. It reports whether the condition held and the values were written.
+func (c *CommandHandler) applySetMany(items []store.Item, cond store.SetCondition) bool {
+	results := c.store.SetMany(items, cond)
+	if results == nil {
+		return false
+	}
+
+	for i, res := range results {
+		c.countSet(items[i].Key, items[i].Value, res.Old, res.Existed)
+	}
+	return true
+}
+
+// replayMSet applies a logged MSET, which MSETNX is also logged as once it succeeds.
+func (c *CommandHandler) replayMSet(cmd []string) error {
+	if len(cmd) < 3 || len(cmd)%2 == 0 {
+		return wrongArgs("MSET")
+	}
+
+	items := make([]store.Item, 0, (len(cmd)-1)/2)
+	for i := 1; i < len(cmd); i += 2 {
+		items = append(items, store.Item{Key: cmd[i], Value: cmd[i+1]})
+	}
+
+	c.applySetMany(items, store.SetAlways)
+	return nil
+}
+
+func handleMGetCommand(parts []string, cl *client, handler *CommandHandler) {
+	values, found, err := handler.HandleMGet(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.ArrayHeader(len(values))
+	for i, value := range values {
+		if found[i] {
+			cl.w.Bulk(value)
+		} else {
+			cl.w.Null()
+		}
+	}
+}
+
+func handleMSetCommand(parts []string, cl *client, handler *CommandHandler) {
+	written, err := handler.HandleMSet(parts)
+	switch {
+	case err != nil:
+		cl.w.WriteError(err)
+	case strings.EqualFold(parts[0], "MSETNX"):
+		cl.w.Integer(int64(boolToInt(written)))
+	default:
+		cl.w.SimpleString("OK")
+	}
+}
+
+// maxValueLen is the longest string APPEND and SETRANGE may produce, the same limit
+// proto-max-bulk-len puts on values sent by clients.
+func (c *CommandHandler) maxValueLen() int64 {
+	if c.maxBulkLen > 0 {
+		return c.maxBulkLen
+	}
+	return DefaultMaxBulkLen
+}
+
+// errValueTooLarge is returned when an edit would grow a string past maxValueLen.
+var errValueTooLarge = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+
+// HandleAppend implements APPEND and returns the length of the new value. A missing
+// key is created, and an existing one keeps its expiration.
+func (c *CommandHandler) HandleAppend(parts []string) (int64, error) {
+	suffix := parts[2]
+
+	var length int64
+	err := c.update(parts, "append", func(old string, exists bool) (string, error) {
+		if int64(len(old))+int64(len(suffix)) > c.maxValueLen() {
+			return "", errValueTooLarge
+		}
+		length = int64(len(old) + len(suffix))
+		return old + suffix, nil
+	})
+
+	return length, err
+}
+
+// HandleStrlen implements STRLEN, which is 0 for a missing key.
+func (c *CommandHandler) HandleStrlen(parts []string) (int64, error) {
+	v, _ := c.store.Get(parts[1])
+	return int64(len(v)), nil
+}
+
+// HandleGetRange implements GETRANGE. Offsets count bytes and may be negative to
+// count from the end; both ends are inclusive and clamped to the value.
+func (c *CommandHandler) HandleGetRange(parts []string) (string, error) {
+	start, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", errNotInteger
+	}
+	end, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return "", errNotInteger
+	}
+
+	v, _ := c.store.Get(parts[1])
+	n := int64(len(v))
+	if n == 0 || (start < 0 && end < 0 && start > end) {
+		return "", nil
+	}
+
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if end < 0 {
+		end = max(n+end, 0)
+	}
+	end = min(end, n-1)
+
+	if start > end {
+		return "", nil
+	}
+	return v[start : end+1], nil
+}
+
+// HandleSetRange implements SETRANGE and returns the length of the new value. Writing
+// past the end pads the value with zero bytes, as in Redis, and an empty value leaves
+// the key untouched.
+func (c *CommandHandler) HandleSetRange(parts []string) (int64, error) {
+	offset, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if offset < 0 {
+		return 0, errors.New("offset is out of range")
+	}
+
+	patch := parts[3]
+	if patch == "" {
+		return c.HandleStrlen(parts[:2])
+	}
+	if offset+int64(len(patch)) > c.maxValueLen() {
+		return 0, errValueTooLarge
+	}
+
+	var length int64
+	err = c.update(parts, "setrange", func(old string, exists bool) (string, error) {
+		end := int(offset) + len(patch)
+		buf := make([]byte, max(len(old), end))
+		copy(buf, old)
+		copy(buf[offset:], patch)
+
+		length = int64(len(buf))
+		return string(buf), nil
+	})
+
+	return length, err
+}
+
+// HandleGetDel implements GETDEL, which deletes a key and returns the value it held.
+// It returns errKeyNotFound for a missing key.
+func (c *CommandHandler) HandleGetDel(parts []string) (string, error) {
+	k := parts[1]
+
+	var value string
+	var found bool
+	err := c.applyAndLog(parts, func() []string {
+		if value, found = c.store.GetDel(k); !found {
+			return nil
+		}
+		if c.clusterManager != nil {
+			c.clusterManager.DecrementKeyCount()
+			c.clusterManager.SubtractByteSize(len(k), len(value))
+		}
+		return []string{"DEL", k}
+	})
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", errKeyNotFound
+	}
+
+	c.broadcast(&OperationResult{
+		Key:        k,
+		Action:     "del",
+		NeedsStats: c.clusterManager != nil && len(c.clusterManager.Nodes) > 1,
+	})
+	c.notify(notifyGeneric, "del", k)
+
+	return value, nil
+}
+
+// HandleGetEx implements GETEX, which returns a key's value and optionally changes its
+// expiration with EX, PX, EXAT or PXAT, or removes it with PERSIST. It returns
+// errKeyNotFound for a missing key.
+func (c *CommandHandler) HandleGetEx(parts []string) (string, error) {
+	k := parts[1]
+
+	var expiration time.Time
+	var change bool
+	for i := 2; i < len(parts); i++ {
+		switch opt := strings.ToUpper(parts[i]); opt {
+		case "PERSIST":
+			if change {
+				return "", errSyntax
+			}
+			change = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if change || i+1 >= len(parts) {
+				return "", errSyntax
+			}
+			n, err := strconv.ParseInt(parts[i+1], 10, 64)
+			if err != nil {
+				return "", errNotInteger
+			}
+			var ok bool
+			if expiration, ok = absoluteExpiration(opt, n, time.Now()); n <= 0 || !ok {
+				return "", invalidExpireTime("GETEX")
+			}
+			change = true
+			i++
+		default:
+			return "", errSyntax
+		}
+	}
+
+	if !change {
+		v, ok := c.store.Get(k)
+		if !ok {
+			return "", errKeyNotFound
+		}
+		return v, nil
+	}
+
+	if expiration.IsZero() {
+		return c.getPersist(parts)
+	}
+
+	var res store.ExpireResult
+	err := c.applyAndLog(parts, func() []string {
+		res = c.applyExpire(k, expiration, store.ExpireCondition{})
+		switch {
+		case !res.Set:
+			return nil
+		case res.Removed:
+			return []string{"DEL", k}
+		default:
+			return []string{"PEXPIREAT", k, strconv.FormatInt(expiration.UnixMilli(), 10)}
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if !res.Set {
+		return "", errKeyNotFound
+	}
+
+	switch {
+	case res.Removed:
+		c.broadcast(&OperationResult{Key: k, Action: "del", NeedsStats: c.clusterManager != nil && len(c.clusterManager.Nodes) > 1})
+		c.notify(notifyGeneric, "del", k)
+	default:
+		c.broadcast(&OperationResult{Key: k, Value: strconv.FormatInt(expiration.UnixMilli(), 10), Action: "expire"})
+		c.notify(notifyGeneric, "expire", k)
+	}
+
+	return res.Value, nil
+}
+
+// getPersist implements GETEX with PERSIST. Like PERSIST itself, it only logs the
+// change and announces it when the key had an expiration to remove.
+func (c *CommandHandler) getPersist(parts []string) (string, error) {
+	k := parts[1]
+
+	var value string
+	var found, persisted bool
+	err := c.applyAndLog(parts, func() []string {
+		if value, found = c.store.Get(k); !found {
+			return nil
+		}
+		if persisted = c.store.Persist(k); !persisted {
+			return nil
+		}
+		return []string{"PERSIST", k}
+	})
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", errKeyNotFound
+	}
+
+	if persisted {
+		c.broadcast(&OperationResult{Key: k, Action: "persist"})
+		c.notify(notifyGeneric, "persist", k)
+	}
+
+	return value, nil
+}
+
+func handleAppendCommand(parts []string, cl *client, handler *CommandHandler) {
+	n, err := handler.HandleAppend(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Integer(n)
+}
+
+func handleStrlenCommand(parts []string, cl *client, handler *CommandHandler) {
+	n, err := handler.HandleStrlen(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Integer(n)
+}
+
+func handleGetRangeCommand(parts []string, cl *client, handler *CommandHandler) {
+	v, err := handler.HandleGetRange(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Bulk(v)
+}
+
+func handleSetRangeCommand(parts []string, cl *client, handler *CommandHandler) {
+	n, err := handler.HandleSetRange(parts)
+	if err != nil {
+		cl.w.WriteError(err)
+		return
+	}
+
+	cl.w.Integer(n)
+}
+
+func handleGetDelCommand(parts []string, cl *client, handler *CommandHandler) {
+	v, err := handler.HandleGetDel(parts)
+	writeValue(cl, v, err)
+}
+
+func handleGetExCommand(parts []string, cl *client, handler *CommandHandler) {
+	v, err := handler.HandleGetEx(parts)
+	writeValue(cl, v, err)
+}
+
+// writeValue replies with a value read from a key, or null if the key is missing.
+func writeValue(cl *client, v string, err error) {
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		cl.w.Null()
+	case err != nil:
+		cl.w.WriteError(err)
+	default:
+		cl.w.Bulk(v)
+	}
+}
+
+// handleGetSetCommand implements GETSET, which is SET key value GET.
+func handleGetSetCommand(parts []string, cl *client, handler *CommandHandler) {
+	handleSetCommand([]string{"SET", parts[1], parts[2], "GET"}, cl, handler)
+}
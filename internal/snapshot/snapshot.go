@@ -0,0 +1,271 @@
+// Package snapshot implements Reredis' point-in-time snapshot format, similar to Redis' RDB.
+// A snapshot is a compact binary image of every key, value and absolute expiration,
+// so a node can load its data set directly instead of replaying every write since it
+// was created. Snapshots are self-contained and double as portable backups.
+//
+// The file starts with a fixed header followed by the encoded entries:
+//
+//	magic    [6]byte  "RRSNAP"
+//	version  uint16   format version, currently 1
+//	created  int64    Unix milliseconds when the snapshot was taken
+//	count    uint64   number of entries
+//	length   uint64   size of the entry section in bytes
+//	checksum uint32   CRC32-C of the entry section
+//
+// Each entry is a uvarint key length and key, a uvarint value length and value, and
+// a uvarint absolute expiration in Unix milliseconds, where 0 means none. All
+// fixed-size integers are big endian.
+package snapshot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// Version is the format version written by this package.
+const Version = 1
+
+// headerSize is the size in bytes of the fixed header that precedes the entries.
+const headerSize = 6 + 2 + 8 + 8 + 8 + 4
+
+var magic = [6]byte{'R', 'R', 'S', 'N', 'A', 'P'}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrInvalidFormat is returned for files that are not snapshots or are damaged.
+	ErrInvalidFormat = errors.New("invalid snapshot")
+	// ErrChecksumMismatch is returned when the entries do not match the header checksum.
+	ErrChecksumMismatch = errors.New("snapshot checksum mismatch")
+)
+
+// Entry is one key in a snapshot.
+type Entry struct {
+	Key        string
+	Value      string
+	Expiration time.Time // Zero means the key never expires
+}
+
+// Header describes a snapshot without loading its entries.
+type Header struct {
+	Version  uint16
+	Created  time.Time
+	Count    uint64
+	Length   uint64
+	Checksum uint32
+}
+
+// Write encodes entries as a snapshot taken at created.
+// The entries are encoded twice, once to compute the checksum and length for the
+// header and once to write them, so the snapshot can be streamed to w without
+// buffering it in memory.
+func Write(w io.Writer, entries []Entry, created time.Time) error {
+	crc := crc32.New(crcTable)
+	length, err := writeEntries(crc, entries)
+	if err != nil {
+		return err
+	}
+
+	var header [headerSize]byte
+	copy(header[0:6], magic[:])
+	binary.BigEndian.PutUint16(header[6:8], Version)
+	binary.BigEndian.PutUint64(header[8:16], uint64(created.UnixMilli()))
+	binary.BigEndian.PutUint64(header[16:24], uint64(len(entries)))
+	binary.BigEndian.PutUint64(header[24:32], uint64(length))
+	binary.BigEndian.PutUint32(header[32:36], crc.Sum32())
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(header[:]); err != nil {
+		return err
+	}
+
+	if _, err := writeEntries(bw, entries); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// writeEntries encodes every entry to w and returns the number of bytes written.
+func writeEntries(w io.Writer, entries []Entry) (int64, error) {
+	var written int64
+	buf := make([]byte, 0, 64)
+
+	for _, e := range entries {
+		var expiration uint64
+		if !e.Expiration.IsZero() {
+			expiration = uint64(e.Expiration.UnixMilli())
+		}
+
+		buf = binary.AppendUvarint(buf[:0], uint64(len(e.Key)))
+		buf = append(buf, e.Key...)
+		buf = binary.AppendUvarint(buf, uint64(len(e.Value)))
+		buf = append(buf, e.Value...)
+		buf = binary.AppendUvarint(buf, expiration)
+
+		n, err := w.Write(buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// ReadHeader reads and validates the fixed header at the start of r.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: reading header: %v", ErrInvalidFormat, err)
+	}
+
+	if [6]byte(header[0:6]) != magic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrInvalidFormat, header[0:6])
+	}
+
+	h := &Header{
+		Version:  binary.BigEndian.Uint16(header[6:8]),
+		Created:  time.UnixMilli(int64(binary.BigEndian.Uint64(header[8:16]))),
+		Count:    binary.BigEndian.Uint64(header[16:24]),
+		Length:   binary.BigEndian.Uint64(header[24:32]),
+		Checksum: binary.BigEndian.Uint32(header[32:36]),
+	}
+
+	if h.Version != Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidFormat, h.Version)
+	}
+
+	return h, nil
+}
+
+// Read decodes a snapshot from r, calling fn for each entry in order.
+// The checksum can only be confirmed after the last entry, so if Read returns an
+// error the caller must discard whatever fn has already received.
+func Read(r io.Reader, fn func(Entry) error) (*Header, error) {
+	br := bufio.NewReader(r)
+
+	h, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	crc := crc32.New(crcTable)
+	body := &entryReader{
+		r:     bufio.NewReader(io.TeeReader(io.LimitReader(br, int64(h.Length)), crc)),
+		limit: int64(h.Length),
+	}
+
+	for i := uint64(0); i < h.Count; i++ {
+		entry, err := body.next()
+		if err != nil {
+			return nil, fmt.Errorf("%w: entry %d: %v", ErrInvalidFormat, i, err)
+		}
+
+		if err := fn(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if body.n != int64(h.Length) {
+		return nil, fmt.Errorf("%w: %d bytes of entries, header says %d", ErrInvalidFormat, body.n, h.Length)
+	}
+
+	if crc.Sum32() != h.Checksum {
+		return nil, ErrChecksumMismatch
+	}
+
+	return h, nil
+}
+
+// Load reads the snapshot file at path, calling fn for each entry.
+func Load(path string, fn func(Entry) error) (*Header, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Read(file, fn)
+}
+
+// entryReader decodes entries and counts the bytes they occupy.
+type entryReader struct {
+	r     *bufio.Reader
+	n     int64
+	limit int64 // Size of the entry section, bounding any single string
+}
+
+func (e *entryReader) next() (Entry, error) {
+	key, err := e.readString()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	value, err := e.readString()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	expiration, err := e.readUvarint()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	entry := Entry{Key: key, Value: value}
+	if expiration != 0 {
+		entry.Expiration = time.UnixMilli(int64(expiration))
+	}
+
+	return entry, nil
+}
+
+func (e *entryReader) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(&countingByteReader{e})
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return v, err
+}
+
+func (e *entryReader) readString() (string, error) {
+	length, err := e.readUvarint()
+	if err != nil {
+		return "", err
+	}
+
+	// A damaged length must not make the loader allocate more than the file holds
+	if length > uint64(e.limit-e.n) {
+		return "", fmt.Errorf("string length %d exceeds the %d bytes left", length, e.limit-e.n)
+	}
+
+	data := make([]byte, length)
+	n, err := io.ReadFull(e.r, data)
+	e.n += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return string(data), err
+}
+
+// countingByteReader lets binary.ReadUvarint consume bytes while they are counted.
+type countingByteReader struct {
+	e *entryReader
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.e.r.ReadByte()
+	if err == nil {
+		c.e.n++
+	}
+
+	return b, err
+}
@@ -0,0 +1,72 @@
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	created := time.UnixMilli(1_700_000_000_000)
+	expiration := time.UnixMilli(1_700_000_060_000)
+	entries := []Entry{
+		{Key: "plain", Value: "value"},
+		{Key: "binary", Value: "line\r\nbreak\x00nul"},
+		{Key: "empty", Value: ""},
+		{Key: "session", Value: "token", Expiration: expiration},
+		{Key: "large", Value: string(bytes.Repeat([]byte("x"), 100_000))},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, entries, created); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	var read []Entry
+	header, err := Read(bytes.NewReader(buf.Bytes()), func(e Entry) error {
+		read = append(read, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+
+	if header.Version != Version || !header.Created.Equal(created) || header.Count != uint64(len(entries)) {
+		t.Errorf("Unexpected header %+v", header)
+	}
+
+	if len(read) != len(entries) {
+		t.Fatalf("Expected %d entries, got %d", len(entries), len(read))
+	}
+	for i, want := range entries {
+		got := read[i]
+		if got.Key != want.Key || got.Value != want.Value || !got.Expiration.Equal(want.Expiration) {
+			t.Errorf("Entry %d: expected %q with expiration %v, got %q with expiration %v",
+				i, want.Key, want.Expiration, got.Key, got.Expiration)
+		}
+	}
+}
+
+func TestReadDetectsDamage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, []Entry{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}, time.Now()); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	data := buf.Bytes()
+	ignore := func(Entry) error { return nil }
+
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)-2] ^= 0xFF
+	if _, err := Read(bytes.NewReader(flipped), ignore); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch for a flipped byte, got %v", err)
+	}
+
+	if _, err := Read(bytes.NewReader(data[:len(data)-3]), ignore); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("Expected ErrInvalidFormat for a truncated snapshot, got %v", err)
+	}
+
+	if _, err := Read(bytes.NewReader([]byte("*3\r\n$3\r\nSET\r\n")), ignore); !errors.Is(err, ErrInvalidFormat) {
+		t.Errorf("Expected ErrInvalidFormat for a non-snapshot file, got %v", err)
+	}
+}
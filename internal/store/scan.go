@@ -0,0 +1,161 @@
+package store
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+	"time"
+)
+
+// minIndexBuckets is the size the key index starts at and never shrinks below.
+const minIndexBuckets = 16
+
+// randomSampleSize is how many keys RANDOMKEY gathers to pick one from.
+const randomSampleSize = 20
+
+// keyIndex groups keys into a power-of-two number of buckets by hash so they can be
+// walked with a cursor. Go maps cannot be resumed between calls, so the store keeps
+// this alongside its map, the way Redis' SCAN walks its own hash table.
+type keyIndex struct {
+	seed    maphash.Seed
+	buckets [][]string
+	size    int
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{seed: maphash.MakeSeed(), buckets: make([][]string, minIndexBuckets)}
+}
+
+// bucket returns the bucket key belongs in at the current table size.
+func (x *keyIndex) bucket(key string) uint64 {
+	return maphash.String(x.seed, key) & uint64(len(x.buckets)-1)
+}
+
+// add records a key, doubling the table once it holds more keys than buckets.
+func (x *keyIndex) add(key string) {
+	b := x.bucket(key)
+	x.buckets[b] = append(x.buckets[b], key)
+	x.size++
+
+	if x.size > len(x.buckets) {
+		x.resize(2 * len(x.buckets))
+	}
+}
+
+// remove forgets a key, halving the table once it is mostly empty.
+func (x *keyIndex) remove(key string) {
+	b := x.bucket(key)
+	keys := x.buckets[b]
+	for i, k := range keys {
+		if k == key {
+			keys[i] = keys[len(keys)-1]
+			x.buckets[b] = keys[:len(keys)-1]
+			x.size--
+			break
+		}
+	}
+
+	if len(x.buckets) > minIndexBuckets && x.size < len(x.buckets)/8 {
+		x.resize(len(x.buckets) / 2)
+	}
+}
+
+// resize rehashes every key into a table of n buckets.
+func (x *keyIndex) resize(n int) {
+	old := x.buckets
+	x.buckets = make([][]string, n)
+	for _, keys := range old {
+		for _, key := range keys {
+			b := x.bucket(key)
+			x.buckets[b] = append(x.buckets[b], key)
+		}
+	}
+}
+
+// sample gathers at least n keys, or every key there is, from consecutive buckets
+// starting at a random one, the way Redis' dictGetFairRandomKey does. Above its
+// smallest size the table holds at least one key per eight buckets, so this visits
+// few buckets, and picking among the gathered keys is close to uniform however
+// unevenly they hash.
+func (x *keyIndex) sample(n int) []string {
+	keys := make([]string, 0, n)
+	start := rand.Intn(len(x.buckets))
+	for i := 0; i < len(x.buckets) && len(keys) < n; i++ {
+		keys = append(keys, x.buckets[(start+i)&(len(x.buckets)-1)]...)
+	}
+	return keys
+}
+
+// scan passes the keys in the bucket the cursor points at to fn and returns the
+// cursor of the next bucket, or 0 once every bucket has been visited.
+//
+// Buckets are visited in the order of their reversed bit patterns, as Redis'
+// dictScan does. When the table doubles, bucket b splits into b and b+size, which
+// both come after every bucket already visited in that order, and when it halves
+// the visited buckets fold into ones that are also visited. So a key present for
+// the whole iteration is always returned, at the cost of occasional repeats after
+// the table shrinks.
+func (x *keyIndex) scan(cursor uint64, fn func(key string)) uint64 {
+	mask := uint64(len(x.buckets) - 1)
+	for _, key := range x.buckets[cursor&mask] {
+		fn(key)
+	}
+
+	// Increment the bits covered by the mask as if they were reversed
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	cursor = bits.Reverse64(cursor)
+
+	return cursor
+}
+
+// Scan returns a batch of roughly count keys and the cursor to pass to the next
+// call, starting from cursor 0 and finishing when 0 is returned again. A key that
+// exists for the whole iteration is returned at least once however the store grows
+// or shrinks in between; keys added or removed meanwhile may or may not be. A batch
+// may be empty before the iteration ends.
+func (s *Store) Scan(cursor uint64, count int) ([]string, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, count)
+	collect := func(key string) {
+		item := s.data[key].Value.(*cacheItem)
+		if item.expiration == nil || item.expiration.After(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	// Bound the empty buckets visited per call, as Redis does, so a sparse
+	// table cannot make one call walk all of it
+	for visits := count * 10; ; visits-- {
+		cursor = s.index.scan(cursor, collect)
+		if cursor == 0 || len(keys) >= count || visits <= 1 {
+			break
+		}
+	}
+
+	return keys, cursor
+}
+
+// Keys returns every live key for which match returns true, in no particular order.
+func (s *Store) Keys(match func(key string) bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var keys []string
+	for key, elem := range s.data {
+		item := elem.Value.(*cacheItem)
+		if item.expiration != nil && !item.expiration.After(now) {
+			continue
+		}
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
@@ -29,6 +29,29 @@ type Store struct {
 	maxSize int                      // Prevents unbounded memory growth
 	mu      sync.Mutex               // Ensures thread safety for concurrent access
 	withTTL map[string]bool          // Tracks keys with TTL for efficient cleanup sampling
+	index   *keyIndex                // Buckets keys so SCAN can resume where it left off
+	watched map[string]*watchState   // Keys clients are watching for WATCH
+	clock   uint64                   // Source of the versions given to watched keys
+
+	onExpire func(key string) // Told about keys removed because they expired
+	onEvict  func(key string) // Told about keys evicted to stay within maxSize
+}
+
+// OnExpire registers fn to be called with every key the store removes because it
+// expired, whether a lookup found it expired or the background sweep did. fn runs with
+// the store locked, so it must return quickly and must not call back into the store.
+func (s *Store) OnExpire(fn func(key string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onExpire = fn
+}
+
+// OnEvict registers fn to be called with every key the store evicts to stay within its
+// size limit. Like OnExpire's, fn runs with the store locked.
+func (s *Store) OnEvict(fn func(key string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onEvict = fn
 }
 
 // Set stores a key-value pair without expiration.
@@ -46,6 +69,13 @@ func (s *Store) SetWithTTL(key, value string, ttl time.Duration) {
 	s.setInternal(key, value, &expiration)
 }
 
+// SetWithExpiration stores a key-value pair that expires at an absolute point in time.
+// This lets persistence restore a key's remaining lifetime exactly, no matter how long
+// the node was down between writing the key and loading it again.
+func (s *Store) SetWithExpiration(key, value string, expiration time.Time) {
+	s.setInternal(key, value, &expiration)
+}
+
 // setInternal handles the core storage logic for both permanent and TTL-based keys.
 // This centralizes the LRU management and TTL tracking, ensuring consistent behavior
 // and optimal performance across different storage scenarios.
@@ -53,6 +83,13 @@ func (s *Store) setInternal(key, value string, expiration *time.Time) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.setLocked(key, value, expiration)
+}
+
+// setLocked stores a value while s.mu is held.
+func (s *Store) setLocked(key, value string, expiration *time.Time) {
+	s.touchLocked(key)
+
 	// Check if key already exists
 	if elem, exists := s.data[key]; exists {
 		// Update existing item and move to front
@@ -73,6 +110,7 @@ func (s *Store) setInternal(key, value string, expiration *time.Time) {
 	item := &cacheItem{key: key, value: value, expiration: expiration}
 	elem := s.lruList.PushFront(item)
 	s.data[key] = elem
+	s.index.add(key)
 
 	if expiration != nil {
 		s.withTTL[key] = true
@@ -84,6 +122,293 @@ func (s *Store) setInternal(key, value string, expiration *time.Time) {
 	}
 }
 
+// SetCondition restricts SetWithOptions to keys that do or do not already exist.
+type SetCondition int
+
+const (
+	SetAlways      SetCondition = iota // Store the value unconditionally
+	SetIfNotExists                     // Only store the value if the key does not exist (NX)
+	SetIfExists                        // Only store the value if the key already exists (XX)
+)
+
+// SetOptions controls how SetWithOptions stores a value.
+type SetOptions struct {
+	Expiration time.Time    // Absolute expiration; zero means the key is permanent
+	KeepTTL    bool         // Keep the key's current expiration and ignore Expiration
+	Condition  SetCondition // When the value may be stored
+}
+
+// SetResult reports what SetWithOptions found and did.
+type SetResult struct {
+	Old        string    // Value the key held before, valid when Existed is set
+	Existed    bool      // Whether the key held a live value before
+	Written    bool      // Whether the condition held and the value was stored
+	Removed    bool      // Whether the write deleted the key because Expiration had passed
+	Expiration time.Time // Expiration the written key has; zero means none
+}
+
+// SetWithOptions stores a value like Redis' SET with its NX, XX and KEEPTTL options.
+// The existence check and the write happen under one lock, so concurrent callers
+// cannot both win an NX race. An expiration that has already passed deletes the key.
+func (s *Store) SetWithOptions(key, value string, opts SetOptions) SetResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.setWithOptionsLocked(key, value, opts, time.Now())
+}
+
+// SetMany stores several items in one step, so no reader sees some of them written
+// and others not. Each item's Expiration applies as in SetWithOptions. The condition
+// covers all keys together: with SetIfNotExists nothing is written if any key exists,
+// as in MSETNX, and with SetIfExists nothing is written unless all of them do. It
+// returns one result per item, or nil if the condition failed.
+func (s *Store) SetMany(items []Item, cond SetCondition) []SetResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if cond != SetAlways {
+		for _, item := range items {
+			_, existing := s.liveLocked(item.Key, now)
+			if (cond == SetIfNotExists) == (existing != nil) {
+				return nil
+			}
+		}
+	}
+
+	results := make([]SetResult, len(items))
+	for i, item := range items {
+		results[i] = s.setWithOptionsLocked(item.Key, item.Value, SetOptions{Expiration: item.Expiration}, now)
+	}
+	return results
+}
+
+// GetMany looks up several keys in one step and returns their values in order.
+// found reports which keys exist; the values of the others are empty.
+func (s *Store) GetMany(keys []string) (values []string, found []bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	values = make([]string, len(keys))
+	found = make([]bool, len(keys))
+	for i, key := range keys {
+		if elem, item := s.liveLocked(key, now); item != nil {
+			s.lruList.MoveToFront(elem)
+			values[i], found[i] = item.value, true
+		}
+	}
+	return values, found
+}
+
+// setWithOptionsLocked implements SetWithOptions while s.mu is held.
+func (s *Store) setWithOptionsLocked(key, value string, opts SetOptions, now time.Time) SetResult {
+	var result SetResult
+	var current *time.Time
+
+	if _, item := s.liveLocked(key, now); item != nil {
+		result.Old, result.Existed = item.value, true
+		current = item.expiration
+	}
+
+	if (opts.Condition == SetIfNotExists && result.Existed) || (opts.Condition == SetIfExists && !result.Existed) {
+		return result
+	}
+
+	result.Written = true
+	expiration := opts.Expiration
+	if opts.KeepTTL {
+		expiration = time.Time{}
+		if current != nil {
+			expiration = *current
+		}
+	}
+	result.Expiration = expiration
+
+	switch {
+	case expiration.IsZero():
+		s.setLocked(key, value, nil)
+	case expiration.After(now):
+		s.setLocked(key, value, &expiration)
+	default:
+		result.Removed = true
+		if elem, ok := s.data[key]; ok {
+			s.removeLocked(elem)
+		}
+	}
+
+	return result
+}
+
+// UpdateResult reports what Update found and stored.
+type UpdateResult struct {
+	Old        string    // Value the key held before, valid when Existed is set
+	Existed    bool      // Whether the key held a live value before
+	Expiration time.Time // Expiration the key kept; zero means none
+}
+
+// Update replaces a key's value with the one fn computes from the current value,
+// keeping the key's expiration, in one step so concurrent read-modify-write commands
+// such as INCR cannot lose updates. fn runs with the store locked and is told whether
+// the key exists; if it returns an error the key is left unchanged.
+func (s *Store) Update(key string, fn func(old string, exists bool) (string, error)) (UpdateResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result UpdateResult
+	var expiration *time.Time
+	if _, item := s.liveLocked(key, time.Now()); item != nil {
+		result.Old, result.Existed = item.value, true
+		expiration = item.expiration
+	}
+
+	value, err := fn(result.Old, result.Existed)
+	if err != nil {
+		return result, err
+	}
+
+	if expiration != nil {
+		result.Expiration = *expiration
+	}
+	s.setLocked(key, value, expiration)
+
+	return result, nil
+}
+
+// ExpireCondition restricts Expire based on the key's current expiration, like the
+// NX, XX, GT and LT options of Redis' EXPIRE. A key without an expiration counts as
+// expiring infinitely far in the future. The zero value sets it unconditionally.
+type ExpireCondition struct {
+	NX bool // Only if the key has no expiration
+	XX bool // Only if the key already has one
+	GT bool // Only if the new expiration is later than the current one
+	LT bool // Only if the new expiration is earlier than the current one
+}
+
+// allows reports whether the condition lets current be replaced by expiration.
+func (c ExpireCondition) allows(current *time.Time, expiration time.Time) bool {
+	has := current != nil
+	switch {
+	case c.NX && has, c.XX && !has:
+		return false
+	case c.GT && (!has || !expiration.After(*current)):
+		return false
+	case c.LT && has && !expiration.Before(*current):
+		return false
+	}
+	return true
+}
+
+// ExpireResult reports what Expire did.
+type ExpireResult struct {
+	Set     bool   // Whether the key exists and the condition held
+	Removed bool   // Whether the key was deleted because the expiration had passed
+	Value   string // Value the key holds, or held if it was removed
+}
+
+// Expire sets an existing key to expire at an absolute time, keeping its value and
+// LRU position; the zero time makes it permanent, as GETEX PERSIST does. The condition
+// is checked under the same lock as the update, and an expiration that has already
+// passed deletes the key.
+func (s *Store) Expire(key string, expiration time.Time, cond ExpireCondition) ExpireResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	elem, item := s.liveLocked(key, now)
+	if item == nil {
+		return ExpireResult{}
+	}
+
+	if !cond.allows(item.expiration, expiration) {
+		return ExpireResult{Value: item.value}
+	}
+
+	switch {
+	case expiration.IsZero():
+		item.expiration = nil
+		delete(s.withTTL, key)
+	case !expiration.After(now):
+		s.removeLocked(elem)
+		return ExpireResult{Set: true, Removed: true, Value: item.value}
+	default:
+		item.expiration = &expiration
+		s.withTTL[key] = true
+	}
+	s.touchLocked(key)
+
+	return ExpireResult{Set: true, Value: item.value}
+}
+
+// Expiration returns when a key expires, or the zero time if it never does.
+// ok is false if the key does not exist.
+func (s *Store) Expiration(key string) (expiration time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, item := s.liveLocked(key, time.Now())
+	if item == nil {
+		return time.Time{}, false
+	}
+
+	if item.expiration != nil {
+		expiration = *item.expiration
+	}
+	return expiration, true
+}
+
+// Persist removes a key's expiration, making it permanent again. It reports whether
+// the key existed and had an expiration to remove.
+func (s *Store) Persist(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, item := s.liveLocked(key, time.Now())
+	if item == nil || item.expiration == nil {
+		return false
+	}
+
+	item.expiration = nil
+	delete(s.withTTL, key)
+	s.touchLocked(key)
+	return true
+}
+
+// liveLocked returns a key's entry while s.mu is held, deleting it instead if it has
+// expired. Both results are nil for keys that do not exist.
+func (s *Store) liveLocked(key string, now time.Time) (*list.Element, *cacheItem) {
+	elem, ok := s.data[key]
+	if !ok {
+		return nil, nil
+	}
+
+	item := elem.Value.(*cacheItem)
+	if item.expiration != nil && !item.expiration.After(now) {
+		s.expireLocked(elem)
+		return nil, nil
+	}
+
+	return elem, item
+}
+
+// removeLocked deletes an entry while s.mu is held.
+func (s *Store) removeLocked(elem *list.Element) {
+	key := elem.Value.(*cacheItem).key
+	s.touchLocked(key)
+	delete(s.data, key)
+	delete(s.withTTL, key)
+	s.index.remove(key)
+	s.lruList.Remove(elem)
+}
+
+// expireLocked deletes an entry whose expiration has passed while s.mu is held.
+func (s *Store) expireLocked(elem *list.Element) {
+	s.removeLocked(elem)
+	if s.onExpire != nil {
+		s.onExpire(elem.Value.(*cacheItem).key)
+	}
+}
+
 // evictLRU removes the least recently used item to maintain memory limits.
 // This prevents unbounded memory growth while preserving the most valuable data,
 // ensuring predictable performance even under heavy load.
@@ -91,10 +416,10 @@ func (s *Store) evictLRU() {
 	// Remove least recently used item (back of list)
 	elem := s.lruList.Back()
 	if elem != nil {
-		item := elem.Value.(*cacheItem)
-		delete(s.data, item.key)
-		delete(s.withTTL, item.key)
-		s.lruList.Remove(elem)
+		s.removeLocked(elem)
+		if s.onEvict != nil {
+			s.onEvict(elem.Value.(*cacheItem).key)
+		}
 	}
 }
 
@@ -114,6 +439,39 @@ func (s *Store) GetAll() map[string]string {
 	return dataCopy
 }
 
+// Item is a key-value pair together with its absolute expiration.
+// This is the unit persistence works with, since a bare value would lose its TTL.
+type Item struct {
+	Key        string
+	Value      string
+	Expiration time.Time // Zero means no expiration
+}
+
+// Items returns a copy of every live key with its value and expiration.
+// This gives snapshots a consistent point-in-time view including TTLs,
+// skipping keys that have already expired but not yet been cleaned up.
+func (s *Store) Items() []Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	items := make([]Item, 0, len(s.data))
+	for _, elem := range s.data {
+		item := elem.Value.(*cacheItem)
+		if item.expiration != nil && item.expiration.Before(now) {
+			continue
+		}
+
+		entry := Item{Key: item.key, Value: item.value}
+		if item.expiration != nil {
+			entry.Expiration = *item.expiration
+		}
+		items = append(items, entry)
+	}
+
+	return items
+}
+
 // GetAllKeys returns a sorted list of all keys currently in the store.
 // This supports administrative operations and key enumeration for applications
 // that need to iterate over stored data in a predictable order.
@@ -147,8 +505,7 @@ func (s *Store) Get(key string) (string, bool) {
 
 	if expir != nil {
 		if expir.Before(time.Now()) {
-			delete(s.data, key)
-			s.lruList.Remove(elem)
+			s.expireLocked(elem)
 			return "", false
 		}
 	}
@@ -168,14 +525,160 @@ func (s *Store) Delete(key string) bool {
 
 	elem, ok := s.data[key]
 	if ok {
-		delete(s.data, key)
-		delete(s.withTTL, key)
-		s.lruList.Remove(elem)
+		s.removeLocked(elem)
 	}
 
 	return ok
 }
 
+// GetDel removes a key and returns the value it held, in one step so no other
+// caller can read or change it in between.
+func (s *Store) GetDel(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, item := s.liveLocked(key, time.Now())
+	if item == nil {
+		return "", false
+	}
+
+	s.removeLocked(elem)
+	return item.value, true
+}
+
+// Exists counts how many of the keys exist; a key named twice is counted twice.
+func (s *Store) Exists(keys []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, key := range keys {
+		if _, item := s.liveLocked(key, now); item != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Touch marks the keys as recently used, protecting them from LRU eviction, and
+// counts how many of them exist.
+func (s *Store) Touch(keys []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, key := range keys {
+		if elem, item := s.liveLocked(key, now); item != nil {
+			s.lruList.MoveToFront(elem)
+			count++
+		}
+	}
+	return count
+}
+
+// DeleteMany removes the keys in one step and returns the items that existed.
+func (s *Store) DeleteMany(keys []string) []Item {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var removed []Item
+	for _, key := range keys {
+		if elem, item := s.liveLocked(key, now); item != nil {
+			removed = append(removed, Item{Key: key, Value: item.value})
+			s.removeLocked(elem)
+		}
+	}
+	return removed
+}
+
+// TransferResult reports what Rename or Copy found and did.
+type TransferResult struct {
+	Found      bool      // Whether the source key exists
+	Written    bool      // Whether the destination was written
+	Value      string    // Value of the source key
+	Expiration time.Time // Expiration the destination was given; zero means none
+	Old        string    // Value the destination held before, valid when Replaced
+	Replaced   bool      // Whether an existing destination value was overwritten
+}
+
+// Rename moves a key's value and expiration to dst in one step. Unless replace is
+// set, nothing happens if dst already exists.
+func (s *Store) Rename(src, dst string, replace bool) TransferResult {
+	return s.transfer(src, dst, replace, true)
+}
+
+// Copy copies a key's value and expiration to dst in one step. Unless replace is
+// set, nothing happens if dst already exists.
+func (s *Store) Copy(src, dst string, replace bool) TransferResult {
+	return s.transfer(src, dst, replace, false)
+}
+
+// transfer implements Rename and Copy.
+func (s *Store) transfer(src, dst string, replace, remove bool) TransferResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var result TransferResult
+
+	srcElem, srcItem := s.liveLocked(src, now)
+	if srcItem == nil {
+		return result
+	}
+	result.Found, result.Value = true, srcItem.value
+	expiration := srcItem.expiration
+	if expiration != nil {
+		result.Expiration = *expiration
+	}
+
+	if src == dst {
+		// The destination exists, so only a replacing transfer succeeds, and it
+		// leaves the key as it is
+		result.Written = replace
+		return result
+	}
+
+	if _, dstItem := s.liveLocked(dst, now); dstItem != nil {
+		if !replace {
+			return result
+		}
+		result.Old, result.Replaced = dstItem.value, true
+	}
+
+	if remove {
+		s.removeLocked(srcElem)
+	}
+	s.setLocked(dst, result.Value, expiration)
+	result.Written = true
+
+	return result
+}
+
+// RandomKey returns a key chosen at random, or false if the store is empty. It picks
+// from a sample of the key index rather than walking the whole store, so the choice
+// is close to uniform without costing time in proportion to the number of keys.
+func (s *Store) RandomKey() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for s.index.size > 0 {
+		keys := s.index.sample(randomSampleSize)
+		elem := s.data[keys[rand.Intn(len(keys))]]
+
+		item := elem.Value.(*cacheItem)
+		if item.expiration == nil || item.expiration.After(now) {
+			return item.key, true
+		}
+		s.expireLocked(elem)
+	}
+
+	return "", false
+}
+
 // NewStore creates a new thread-safe store with automatic cleanup and LRU eviction.
 // This initializes the data structures and background processes needed for efficient
 // memory management and TTL expiration in high-concurrency environments.
@@ -185,6 +688,8 @@ func NewStore() *Store {
 		lruList: list.New(),
 		maxSize: 1000, // Default max size, could be configurable
 		withTTL: make(map[string]bool),
+		index:   newKeyIndex(),
+		watched: make(map[string]*watchState),
 	}
 
 	go store.cleanup()
@@ -236,9 +741,7 @@ func (s *Store) cleanup() {
 					isExpired := expiration.Before(time.Now())
 					if isExpired {
 						expired++
-						delete(s.data, key)
-						delete(s.withTTL, key)
-						s.lruList.Remove(elem)
+						s.expireLocked(elem)
 					}
 				}
 			}
@@ -0,0 +1,74 @@
+package store
+
+import "time"
+
+// watchState tracks a key that at least one client is watching.
+type watchState struct {
+	watchers int    // Watch calls not yet matched by Unwatch
+	version  uint64 // Changes whenever the key is modified
+}
+
+// Watch starts tracking modifications of the keys for WATCH and returns their
+// current versions, which Modified later compares against. Every call must be
+// matched by an Unwatch of the same keys.
+func (s *Store) Watch(keys []string) []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	versions := make([]uint64, len(keys))
+	for i, key := range keys {
+		// Drop an already expired key now, so its removal later does not count as a
+		// modification made after the key was watched
+		s.liveLocked(key, now)
+
+		w := s.watched[key]
+		if w == nil {
+			w = &watchState{}
+			s.watched[key] = w
+		}
+		w.watchers++
+		versions[i] = w.version
+	}
+
+	return versions
+}
+
+// Unwatch stops tracking keys passed to Watch.
+func (s *Store) Unwatch(keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		if w := s.watched[key]; w != nil {
+			if w.watchers--; w.watchers == 0 {
+				delete(s.watched, key)
+			}
+		}
+	}
+}
+
+// Modified reports whether any of the watched keys has been set, deleted, had its
+// expiration changed, expired or been evicted since Watch returned versions.
+func (s *Store) Modified(keys []string, versions []uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for i, key := range keys {
+		s.liveLocked(key, now)
+		if w := s.watched[key]; w == nil || w.version != versions[i] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// touchLocked records a modification of key while s.mu is held.
+func (s *Store) touchLocked(key string) {
+	if w := s.watched[key]; w != nil {
+		s.clock++
+		w.version = s.clock
+	}
+}
@@ -0,0 +1,188 @@
+package wal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestFileName is the name of the manifest inside a WAL directory.
+const ManifestFileName = "MANIFEST"
+
+// SnapshotExt is the file extension of a base in the BaseSnapshot format.
+const SnapshotExt = ".snap"
+
+// BaseFormat identifies how a log's base file is encoded.
+type BaseFormat string
+
+const (
+	// BaseLog is a rewritten log: WAL records, one command per live key.
+	BaseLog BaseFormat = "log"
+	// BaseSnapshot is a binary point-in-time snapshot of the store.
+	BaseSnapshot BaseFormat = "snapshot"
+)
+
+// Manifest lists the files that make up a segmented log. Recovery loads the base,
+// if there is one, and then replays segments FirstSegment through ActiveSegment in
+// order. Files in the directory that the manifest does not mention are leftovers
+// from an interrupted rotation or rewrite and are safe to delete.
+type Manifest struct {
+	Base          string     `json:"base,omitempty"`        // Compacted file the segments apply on top of; empty when the log starts from nothing
+	BaseFormat    BaseFormat `json:"base_format,omitempty"` // How Base is encoded; empty means BaseLog
+	FirstSegment  uint64     `json:"first_segment"`         // Oldest segment still needed for recovery
+	ActiveSegment uint64     `json:"active_segment"`        // Segment currently receiving appends
+}
+
+// SegmentName returns the file name of the segment with the given sequence number.
+// Names are zero-padded so a directory listing sorts in log order.
+func SegmentName(seq uint64) string {
+	return fmt.Sprintf("segment-%010d.wal", seq)
+}
+
+// baseName returns the file name of a base that covers every segment before seq.
+func baseName(seq uint64, format BaseFormat) string {
+	if format == BaseSnapshot {
+		return fmt.Sprintf("base-%010d%s", seq, SnapshotExt)
+	}
+
+	return fmt.Sprintf("base-%010d.wal", seq)
+}
+
+// Files returns the log's files in replay order: the base first, then each segment.
+func (m *Manifest) Files() []string {
+	var files []string
+	if m.Base != "" {
+		files = append(files, m.Base)
+	}
+
+	for seq := m.FirstSegment; seq <= m.ActiveSegment; seq++ {
+		files = append(files, SegmentName(seq))
+	}
+
+	return files
+}
+
+// ReadManifest loads the manifest of the log in dir.
+// The returned error wraps fs.ErrNotExist if the directory holds no log yet.
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid WAL manifest: %w", err)
+	}
+
+	if m.FirstSegment == 0 || m.FirstSegment > m.ActiveSegment {
+		return nil, fmt.Errorf("invalid WAL manifest: segments %d to %d", m.FirstSegment, m.ActiveSegment)
+	}
+
+	return &m, nil
+}
+
+// writeManifest atomically replaces the manifest in dir, so a crash leaves either
+// the old or the new version on disk and never a partial one.
+func writeManifest(dir string, m Manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, ManifestFileName)
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write WAL manifest: %w", err)
+	}
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write WAL manifest: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync WAL manifest: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace WAL manifest: %w", err)
+	}
+	syncDir(dir)
+
+	return nil
+}
+
+// removeUnreferenced deletes log files in dir that the manifest no longer lists and
+// returns how many bytes were freed. Files the log does not own are left alone.
+func removeUnreferenced(dir string, m Manifest) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	live := make(map[string]bool)
+	for _, name := range m.Files() {
+		live[name] = true
+	}
+
+	var freed int64
+	for _, entry := range entries {
+		name := entry.Name()
+		owned := strings.HasPrefix(name, "segment-") || strings.HasPrefix(name, "base-")
+		if !owned || live[name] {
+			continue
+		}
+
+		if info, err := entry.Info(); err == nil {
+			freed += info.Size()
+		}
+
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return freed, err
+		}
+	}
+
+	return freed, nil
+}
+
+// AdoptLegacyLog moves a single-file log written before segmentation into dir as
+// its first segment. It does nothing if dir already has a manifest or there is no
+// legacy file, so it is safe to call on every start.
+func AdoptLegacyLog(dir, legacyPath string) error {
+	if _, err := os.Stat(filepath.Join(dir, ManifestFileName)); err == nil {
+		return nil
+	}
+
+	first := filepath.Join(dir, SegmentName(1))
+
+	if _, err := os.Stat(legacyPath); err == nil {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create WAL directory: %w", err)
+		}
+
+		if err := os.Rename(legacyPath, first); err != nil {
+			return fmt.Errorf("failed to move legacy WAL into %s: %w", dir, err)
+		}
+		syncDir(dir)
+		syncDir(filepath.Dir(legacyPath))
+	}
+
+	// Also covers a crash between the rename above and writing the manifest
+	if _, err := os.Stat(first); err != nil {
+		return nil
+	}
+
+	return writeManifest(dir, Manifest{FirstSegment: 1, ActiveSegment: 1})
+}
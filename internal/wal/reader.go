@@ -2,55 +2,337 @@ package wal
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"strconv"
 	"strings"
 )
 
+// DefaultMaxRecordSize bounds the records a Writer appends and the record and value
+// lengths a Reader accepts when their options leave MaxRecordSize unset. It is the
+// largest payload the length field of a record can describe. Servers pass the limit
+// RecordSizeLimit derives from their request limits to both, so every record the
+// writer accepts can be read back and a corrupted length field cannot make the reader
+// allocate more than the largest such record.
+const DefaultMaxRecordSize = math.MaxUint32
+
+// RecordSizeLimit returns the payload size of the largest command made of at most
+// maxArgs arguments of at most maxArgLen bytes each, capped at DefaultMaxRecordSize.
+// Records holding several commands, such as a transaction's, may still exceed it, in
+// which case the writer refuses them.
+func RecordSizeLimit(maxArgs, maxArgLen int64) int64 {
+	digits := func(n int64) int64 { return int64(len(strconv.FormatInt(n, 10))) }
+
+	// Each argument is "$<len>\r\n<arg>\r\n"; the array header is "*<count>\r\n"
+	arg := 1 + digits(maxArgLen) + 2 + maxArgLen + 2
+	if maxArgs > 0 && arg > (DefaultMaxRecordSize-1)/maxArgs {
+		return DefaultMaxRecordSize
+	}
+	return min(1+digits(maxArgs)+2+maxArgs*arg, DefaultMaxRecordSize)
+}
+
+// minBulkStringSize is the encoded size of an empty bulk string ("$0\r\n\r\n"),
+// used to reject array counts that could not possibly fit in a record.
+const minBulkStringSize = 6
+
+// ErrChecksumMismatch is reported when a record's payload does not match its CRC.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// RecoveryPolicy decides what the reader does when it meets a damaged record.
+type RecoveryPolicy int
+
+const (
+	// RecoverFail stops and returns a *CorruptionError for the first bad record.
+	RecoverFail RecoveryPolicy = iota
+	// RecoverTruncate treats the first bad record as the end of the log.
+	// Truncated reports where the valid prefix ends so the file can be cut there.
+	RecoverTruncate
+	// RecoverSkip skips damaged regions and resumes at the next valid record.
+	// Skipped reports every region that was passed over.
+	RecoverSkip
+)
+
+// ParseRecoveryPolicy converts a policy name (fail, truncate, skip) into a RecoveryPolicy.
+func ParseRecoveryPolicy(s string) (RecoveryPolicy, error) {
+	switch strings.ToLower(s) {
+	case "fail":
+		return RecoverFail, nil
+	case "truncate":
+		return RecoverTruncate, nil
+	case "skip":
+		return RecoverSkip, nil
+	default:
+		return 0, fmt.Errorf("invalid recovery policy %q: expected fail, truncate or skip", s)
+	}
+}
+
+func (p RecoveryPolicy) String() string {
+	switch p {
+	case RecoverFail:
+		return "fail"
+	case RecoverTruncate:
+		return "truncate"
+	case RecoverSkip:
+		return "skip"
+	default:
+		return fmt.Sprintf("RecoveryPolicy(%d)", int(p))
+	}
+}
+
+// CorruptionError describes a damaged region of the log.
+// A torn record at the end of the file wraps io.ErrUnexpectedEOF.
+type CorruptionError struct {
+	Offset int64 // Byte offset where the bad record starts
+	Length int64 // Bytes passed over under RecoverSkip; 0 when reading stopped here
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt WAL record at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// ReaderOptions configures a Reader.
+type ReaderOptions struct {
+	Recovery      RecoveryPolicy // What to do when a record fails validation
+	MaxRecordSize int64          // Largest record or value accepted; 0 means DefaultMaxRecordSize
+}
+
 type Reader struct {
-	scanner *bufio.Scanner
-	file    *os.File
+	file      *os.File
+	br        *bufio.Reader
+	opts      ReaderOptions
+	offset    int64 // Byte offset just past the last complete entry
+	done      bool  // Reading stopped at a truncation point
+	truncated *CorruptionError
+	skipped   []*CorruptionError
 }
 
 type Entry struct {
 	Command []string
 }
 
-func NewReader(filename string) (*Reader, error) {
+func NewReader(filename string, opts ReaderOptions) (*Reader, error) {
 	file, err := os.OpenFile(filename, os.O_RDONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
 
-	scanner := bufio.NewScanner(file)
+	if opts.MaxRecordSize <= 0 {
+		opts.MaxRecordSize = DefaultMaxRecordSize
+	}
 
 	return &Reader{
-		file:    file,
-		scanner: scanner,
+		file: file,
+		br:   bufio.NewReader(file),
+		opts: opts,
 	}, nil
 }
 
+// ReadEntry returns the next valid command in the log, or io.EOF at the end.
+// How damaged records are handled depends on the reader's RecoveryPolicy.
 func (r *Reader) ReadEntry() (*Entry, error) {
-	command, err := r.parseArray()
+	if r.done {
+		return nil, io.EOF
+	}
+
+	command, n, err := r.readRecord()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+
 	if err != nil {
-		return nil, err
+		corruption := &CorruptionError{Offset: r.offset, Err: err}
+
+		switch r.opts.Recovery {
+		case RecoverTruncate:
+			r.truncated = corruption
+			r.done = true
+			return nil, io.EOF
+		case RecoverSkip:
+			return r.skipFrom(corruption)
+		default:
+			r.done = true
+			return nil, corruption
+		}
 	}
 
+	r.offset += n
+
 	return &Entry{Command: command}, nil
 }
 
-func (r *Reader) parseArray() ([]string, error) {
-	if !r.scanner.Scan() {
-		if err := r.scanner.Err(); err != nil {
-			return nil, err
+// Offset returns the byte offset just past the last complete entry read.
+// After a truncation or a failure it is where the valid prefix of the log ends.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Truncated reports the damage that ended reading under RecoverTruncate or
+// RecoverSkip, or nil if the log was read to a clean end.
+func (r *Reader) Truncated() *CorruptionError {
+	return r.truncated
+}
+
+// Skipped lists the damaged regions passed over under RecoverSkip.
+func (r *Reader) Skipped() []*CorruptionError {
+	return r.skipped
+}
+
+// readRecord reads one framed or legacy record at the current position and
+// returns its command along with the number of bytes it occupied.
+// io.EOF is only returned when no bytes at all remain.
+func (r *Reader) readRecord() ([]string, int64, error) {
+	first, err := r.br.ReadByte()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if first == '*' {
+		// Legacy record written before framing: a bare RESP array
+		r.br.UnreadByte()
+		d := &decoder{r: r.br, max: r.opts.MaxRecordSize}
+		command, err := d.parseArray()
+		return command, d.n, err
+	}
+
+	if first != recordMagic {
+		return nil, 0, fmt.Errorf("invalid record marker 0x%02x", first)
+	}
+
+	var header [recordHeaderSize - 1]byte
+	if _, err := io.ReadFull(r.br, header[:]); err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+
+	if int64(length) > r.opts.MaxRecordSize {
+		return nil, 0, fmt.Errorf("record length %d exceeds maximum %d", length, r.opts.MaxRecordSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.br, payload); err != nil {
+		return nil, 0, unexpectedEOF(err)
+	}
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, 0, ErrChecksumMismatch
+	}
+
+	d := &decoder{r: bufio.NewReader(bytes.NewReader(payload)), max: int64(length)}
+	command, err := d.parseArray()
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed payload: %w", err)
+	}
+
+	if d.n != int64(length) {
+		return nil, 0, fmt.Errorf("malformed payload: %d trailing bytes", int64(length)-d.n)
+	}
+
+	return command, recordHeaderSize + int64(length), nil
+}
+
+// skipFrom scans forward from a damaged record for the next record that passes
+// its checksum. If none is found the damage is treated as a torn tail.
+func (r *Reader) skipFrom(corruption *CorruptionError) (*Entry, error) {
+	pos := corruption.Offset + 1
+
+	for {
+		next, err := r.findMagic(pos)
+		if err != nil {
+			r.truncated = corruption
+			r.done = true
+			return nil, io.EOF
 		}
 
-		return nil, io.EOF
+		command, n, err := r.readRecord()
+		if err == nil {
+			corruption.Length = next - corruption.Offset
+			r.skipped = append(r.skipped, corruption)
+			r.offset = next + n
+			return &Entry{Command: command}, nil
+		}
+
+		pos = next + 1
 	}
+}
 
-	line := r.scanner.Text()
+// findMagic positions the reader at the first record marker at or after pos.
+func (r *Reader) findMagic(pos int64) (int64, error) {
+	if _, err := r.file.Seek(pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r.br.Reset(r.file)
+
+	for {
+		b, err := r.br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if b == recordMagic {
+			r.br.UnreadByte()
+			return pos, nil
+		}
+		pos++
+	}
+}
+
+func (r *Reader) Close() error {
+	if r.file != nil {
+		return r.file.Close()
+	}
+
+	return nil
+}
+
+// unexpectedEOF converts running out of input mid-record into io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// decoder parses a RESP array of bulk strings, counting the bytes it consumes.
+// Bulk string payloads are read by their declared length rather than by line, so
+// values may contain CR, LF or any other byte.
+type decoder struct {
+	r   *bufio.Reader
+	n   int64
+	max int64 // Largest bulk string length accepted
+}
+
+// readLine reads one CRLF-terminated header line. A line cut short by the end of
+// input can only come from an interrupted append, so it is an unexpected EOF.
+func (d *decoder) readLine() (string, error) {
+	line, err := d.r.ReadString('\n')
+	d.n += int64(len(line))
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+func (d *decoder) parseArray() ([]string, error) {
+	line, err := d.readLine()
+	if err != nil {
+		return nil, err
+	}
 
 	if !strings.HasPrefix(line, "*") {
 		return nil, fmt.Errorf("expected array header, got: %s", line)
@@ -58,13 +340,17 @@ func (r *Reader) parseArray() ([]string, error) {
 
 	countStr := line[1:]
 	count, err := strconv.Atoi(countStr)
-	if err != nil {
+	if err != nil || count < 0 {
 		return nil, fmt.Errorf("invalid array count: %s", countStr)
 	}
 
+	if int64(count) > d.max/minBulkStringSize {
+		return nil, fmt.Errorf("array count %d exceeds maximum record size %d", count, d.max)
+	}
+
 	result := make([]string, count)
 	for i := 0; i < count; i++ {
-		bulkStr, err := r.parseBulkString()
+		bulkStr, err := d.parseBulkString()
 		if err != nil {
 			return nil, err
 		}
@@ -75,38 +361,37 @@ func (r *Reader) parseArray() ([]string, error) {
 	return result, nil
 }
 
-func (r *Reader) parseBulkString() (string, error) {
-	if !r.scanner.Scan() {
-		return "", fmt.Errorf("unexpecteed EOF reading bulk string header")
+func (d *decoder) parseBulkString() (string, error) {
+	line, err := d.readLine()
+	if err != nil {
+		return "", fmt.Errorf("reading bulk string header: %w", err)
 	}
 
-	line := r.scanner.Text()
 	if !strings.HasPrefix(line, "$") {
 		return "", fmt.Errorf("expected bulk string header, got: %s", line)
 	}
 
 	lengthStr := line[1:]
-	length, err := strconv.Atoi(lengthStr)
-	if err != nil {
+	length, err := strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil || length < 0 {
 		return "", fmt.Errorf("invalid bulk string length, got: %s", lengthStr)
 	}
 
-	if !r.scanner.Scan() {
-		return "", fmt.Errorf("unexpected EOF reading bulk string data")
+	if length > d.max {
+		return "", fmt.Errorf("bulk string length %d exceeds maximum %d", length, d.max)
 	}
 
-	data := r.scanner.Text()
-	if len(data) != length {
-		return "", fmt.Errorf("bulks string length mismatch: expected %d, got %d", length, len(data))
+	// Read the payload and its CRLF terminator in one go
+	data := make([]byte, length+2)
+	n, err := io.ReadFull(d.r, data)
+	d.n += int64(n)
+	if err != nil {
+		return "", fmt.Errorf("reading bulk string data: %w", unexpectedEOF(err))
 	}
 
-	return data, nil
-}
-
-func (r *Reader) Close() error {
-	if r.file != nil {
-		return r.file.Close()
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return "", fmt.Errorf("bulk string of length %d is not terminated by CRLF", length)
 	}
 
-	return nil
+	return string(data[:length]), nil
 }
@@ -1,19 +1,18 @@
 package wal
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestWriteReadRoundTrip(t *testing.T) {
-	// Create temp file
-	tmpFile, err := os.CreateTemp("", "wal_test_*.wal")
-	if err != nil {
-		t.Fatalf("Failed to create temp file: %v", err)
-	}
-	defer os.Remove(tmpFile.Name())
-	tmpFile.Close()
+	dir := t.TempDir()
 
 	// Test commands to write and read back
 	testCommands := [][]string{
@@ -26,7 +25,7 @@ func TestWriteReadRoundTrip(t *testing.T) {
 	}
 
 	// Write commands
-	writer, err := NewWriter(tmpFile.Name())
+	writer, err := NewWriter(dir, Options{Fsync: FsyncAlways})
 	if err != nil {
 		t.Fatalf("Failed to create writer: %v", err)
 	}
@@ -40,7 +39,7 @@ func TestWriteReadRoundTrip(t *testing.T) {
 	writer.Close()
 
 	// Read commands back
-	reader, err := NewReader(tmpFile.Name())
+	reader, err := NewReader(filepath.Join(dir, SegmentName(1)), ReaderOptions{})
 	if err != nil {
 		t.Fatalf("Failed to create reader: %v", err)
 	}
@@ -76,4 +75,223 @@ func TestWriteReadRoundTrip(t *testing.T) {
 			}
 		}
 	}
-}
\ No newline at end of file
+}
+func TestReaderTornRecord(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "wal_test_*.wal")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	complete := encodeRecord(t, []string{"SET", "key1", "value1"})
+	tmpFile.Write(complete)
+	tmpFile.Write(encodeRecord(t, []string{"SET", "key2", "value2"})[:20])
+	tmpFile.Close()
+
+	reader, err := NewReader(tmpFile.Name(), ReaderOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := reader.ReadEntry(); err != nil {
+		t.Fatalf("Failed to read complete entry: %v", err)
+	}
+
+	if reader.Offset() != int64(len(complete)) {
+		t.Errorf("Expected offset %d after first entry, got %d", len(complete), reader.Offset())
+	}
+
+	_, err = reader.ReadEntry()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected io.ErrUnexpectedEOF for torn record, got %v", err)
+	}
+
+	if reader.Offset() != int64(len(complete)) {
+		t.Errorf("Expected offset to stay at %d after torn record, got %d", len(complete), reader.Offset())
+	}
+}
+
+// writeWAL writes raw records to a temporary log and returns its path.
+func writeWAL(t *testing.T, records ...[]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.wal")
+	if err := os.WriteFile(path, bytes.Join(records, nil), 0644); err != nil {
+		t.Fatalf("Failed to write WAL: %v", err)
+	}
+	return path
+}
+
+// encodeRecord frames a command, failing the test if it cannot be.
+func encodeRecord(t *testing.T, cmd []string) []byte {
+	t.Helper()
+	record, err := EncodeRecord(cmd)
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	return record
+}
+
+func readAll(t *testing.T, reader *Reader) ([]string, error) {
+	t.Helper()
+	var keys []string
+	for {
+		entry, err := reader.ReadEntry()
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, entry.Command[1])
+	}
+}
+
+func TestReaderRecoveryPolicies(t *testing.T) {
+	first := encodeRecord(t, []string{"SET", "a", "1"})
+	corrupt := encodeRecord(t, []string{"SET", "b", "2"})
+	corrupt[len(corrupt)-3] ^= 0xFF // Flip bits inside the payload
+	last := encodeRecord(t, []string{"SET", "c", "3"})
+	path := writeWAL(t, first, corrupt, last)
+
+	t.Run("fail reports the offset of the bad record", func(t *testing.T) {
+		reader, _ := NewReader(path, ReaderOptions{Recovery: RecoverFail})
+		defer reader.Close()
+
+		keys, err := readAll(t, reader)
+		var corruption *CorruptionError
+		if !errors.As(err, &corruption) || !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("Expected checksum CorruptionError, got %v", err)
+		}
+		if corruption.Offset != int64(len(first)) {
+			t.Errorf("Expected corruption at offset %d, got %d", len(first), corruption.Offset)
+		}
+		if len(keys) != 1 {
+			t.Errorf("Expected 1 entry before the bad record, got %v", keys)
+		}
+	})
+
+	t.Run("truncate stops at the bad record", func(t *testing.T) {
+		reader, _ := NewReader(path, ReaderOptions{Recovery: RecoverTruncate})
+		defer reader.Close()
+
+		keys, err := readAll(t, reader)
+		if err != nil || len(keys) != 1 {
+			t.Fatalf("Expected 1 entry and a clean end, got %v (err %v)", keys, err)
+		}
+		if reader.Truncated() == nil || reader.Offset() != int64(len(first)) {
+			t.Errorf("Expected truncation point at %d, got %v at %d", len(first), reader.Truncated(), reader.Offset())
+		}
+	})
+
+	t.Run("skip resumes at the next valid record", func(t *testing.T) {
+		reader, _ := NewReader(path, ReaderOptions{Recovery: RecoverSkip})
+		defer reader.Close()
+
+		keys, err := readAll(t, reader)
+		if err != nil || strings.Join(keys, ",") != "a,c" {
+			t.Fatalf("Expected entries a and c, got %v (err %v)", keys, err)
+		}
+
+		skipped := reader.Skipped()
+		if len(skipped) != 1 || skipped[0].Offset != int64(len(first)) || skipped[0].Length != int64(len(corrupt)) {
+			t.Errorf("Expected one skipped region of %d bytes at %d, got %+v", len(corrupt), len(first), skipped)
+		}
+	})
+}
+
+func TestReaderLegacyRecords(t *testing.T) {
+	// Logs written before framing hold bare RESP arrays; new records follow them
+	path := writeWAL(t,
+		EncodeArray([]string{"SET", "old", "1"}),
+		encodeRecord(t, []string{"SET", "new", "2"}),
+	)
+
+	reader, _ := NewReader(path, ReaderOptions{})
+	defer reader.Close()
+
+	keys, err := readAll(t, reader)
+	if err != nil || strings.Join(keys, ",") != "old,new" {
+		t.Fatalf("Expected legacy and framed entries, got %v (err %v)", keys, err)
+	}
+}
+
+func TestReaderBinaryValues(t *testing.T) {
+	large := bytes.Repeat([]byte("blob\r\n\x00"), 20_000) // Well past the old 64KB line limit
+	values := []string{
+		"line one\r\nline two",
+		"bare\nnewlines\n",
+		"\r\n",
+		"nul\x00bytes\x00",
+		"$5\r\nfake\r\n*1\r\n",
+		string([]byte{0xA5, 0xFF, 0x00, '\r'}),
+		string(large),
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, SegmentName(1))
+	writer, err := NewWriter(dir, Options{Fsync: FsyncNo})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i, value := range values {
+		if err := writer.WriteCommand([]string{"SET", fmt.Sprintf("key%d", i), value}); err != nil {
+			t.Fatalf("Failed to write value %d: %v", i, err)
+		}
+	}
+	// A legacy record carrying a binary value must decode the same way
+	legacy := EncodeArray([]string{"SET", "legacy", "a\r\nb\nc"})
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close writer: %v", err)
+	}
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write(legacy)
+	file.Close()
+	values = append(values, "a\r\nb\nc")
+
+	reader, err := NewReader(path, ReaderOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	defer reader.Close()
+
+	for i, want := range values {
+		entry, err := reader.ReadEntry()
+		if err != nil {
+			t.Fatalf("Failed to read value %d: %v", i, err)
+		}
+		if got := entry.Command[2]; got != want {
+			t.Errorf("Value %d mismatch: got %d bytes, expected %d bytes", i, len(got), len(want))
+		}
+	}
+	if _, err := reader.ReadEntry(); err != io.EOF {
+		t.Errorf("Expected EOF after all values, got %v", err)
+	}
+}
+
+func TestReaderMaxRecordSize(t *testing.T) {
+	value := strings.Repeat("x", 1024)
+
+	for name, record := range map[string][]byte{
+		"framed": encodeRecord(t, []string{"SET", "k", value}),
+		"legacy": EncodeArray([]string{"SET", "k", value}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := writeWAL(t, record)
+
+			reader, _ := NewReader(path, ReaderOptions{MaxRecordSize: 512})
+			defer reader.Close()
+
+			if _, err := reader.ReadEntry(); !strings.Contains(fmt.Sprint(err), "exceeds maximum") {
+				t.Errorf("Expected size limit error, got %v", err)
+			}
+
+			reader, _ = NewReader(path, ReaderOptions{MaxRecordSize: 4096})
+			defer reader.Close()
+
+			if entry, err := reader.ReadEntry(); err != nil || entry.Command[2] != value {
+				t.Errorf("Expected value within the limit to be read, got err %v", err)
+			}
+		})
+	}
+}
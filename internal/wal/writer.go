@@ -1,36 +1,673 @@
 package wal
 
-import "os"
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
 
+// FsyncPolicy controls when appended commands are forced to stable storage.
+// The names and trade-offs mirror Redis' appendfsync setting.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways makes every write durable before it is acknowledged.
+	// Concurrent writers waiting at the same time share a single fsync (group commit).
+	FsyncAlways FsyncPolicy = iota
+	// FsyncEverySec flushes from a background goroutine once per second,
+	// so a crash loses at most about a second of writes.
+	FsyncEverySec
+	// FsyncNo never calls fsync and leaves flushing to the operating system.
+	FsyncNo
+)
+
+// everySecInterval is how often the background flusher runs under FsyncEverySec.
+const everySecInterval = time.Second
+
+// DefaultSegmentSize is the size at which the active segment is sealed and a new one
+// started when Options leaves SegmentSize unset.
+const DefaultSegmentSize = 64 << 20
+
+// ParseFsyncPolicy converts an appendfsync name (always, everysec, no) into a policy.
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	default:
+		return 0, fmt.Errorf("invalid fsync policy %q: expected always, everysec or no", s)
+	}
+}
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncEverySec:
+		return "everysec"
+	case FsyncNo:
+		return "no"
+	default:
+		return fmt.Sprintf("FsyncPolicy(%d)", int(p))
+	}
+}
+
+// Options configures a Writer.
+type Options struct {
+	Fsync         FsyncPolicy // When appended commands are fsynced
+	SegmentSize   int64       // Size at which the active segment is rotated; 0 means DefaultSegmentSize
+	MaxRecordSize int64       // Largest record payload appended; 0 means DefaultMaxRecordSize
+}
+
+// Stats reports how far the durable state of the log lags behind what was written.
+// A growing PendingBytes or FsyncLag means more data is at risk if the host crashes.
+type Stats struct {
+	Policy             FsyncPolicy
+	WrittenBytes       int64         // Bytes appended since the writer was opened
+	PendingBytes       int64         // Bytes written but not yet fsynced
+	FsyncLag           time.Duration // Age of the oldest write that is not yet durable
+	LastFsync          time.Time     // When the last successful fsync completed
+	Fsyncs             int64         // Number of fsync calls issued
+	Size               int64         // Current size of the log across all of its files
+	BaseSize           int64         // Size of the log when it was opened or last rewritten
+	Segments           int           // Number of segments still needed for recovery
+	ActiveSegment      uint64        // Sequence number of the segment receiving appends
+	RewriteInProgress  bool          // A log rewrite is being written
+	SnapshotInProgress bool          // A snapshot base is being written
+	Rewrites           int64         // Number of completed log rewrites
+	LastRewriteFailed  bool          // The most recent log rewrite was aborted
+	Snapshots          int64         // Number of completed snapshots
+	LastSnapshot       time.Time     // When the last snapshot was committed, or when the writer was opened
+	LastSnapshotFailed bool          // The most recent snapshot was aborted
+}
+
+var (
+	// ErrRewriteInProgress is returned when a base is requested while a log rewrite is running.
+	ErrRewriteInProgress = errors.New("background append only file rewriting already in progress")
+	// ErrSnapshotInProgress is returned when a base is requested while a snapshot is being written.
+	ErrSnapshotInProgress = errors.New("background save already in progress")
+	// ErrRecordTooLarge is returned for a command whose record a reader with the same
+	// MaxRecordSize would refuse.
+	ErrRecordTooLarge = errors.New("record too large")
+)
+
+// Writer appends commands to a segmented log in a directory. Appends go to the active
+// segment; once it reaches the segment size it is fsynced and sealed, and a new segment
+// with the next sequence number takes over. The directory's manifest always names the
+// files needed for recovery.
 type Writer struct {
-	file *os.File
+	file          *os.File // Active segment
+	dir           string
+	policy        FsyncPolicy
+	segmentSize   int64
+	maxRecordSize int64
+	manifest      Manifest
+	activeSize    int64 // Bytes in the active segment
+
+	mu           sync.Mutex
+	synced       *sync.Cond // Broadcast whenever an fsync finishes
+	written      int64      // Offset just past the last appended record
+	durable      int64      // Offset up to which data is known to be on disk
+	syncing      bool       // An fsync is in flight; other waiters join it
+	pendingSince time.Time  // When the oldest non-durable write happened
+	lastFsync    time.Time
+	fsyncs       int64
+	syncErr      error // Sticky: once fsync fails the log can no longer be trusted
+
+	size              int64 // Total size of the log, used for automatic rewrite triggers
+	baseSize          int64 // Total size after opening or after the last rewrite
+	rewriting         bool
+	rewriteFormat     BaseFormat // What the running rewrite produces
+	rewrites          int64
+	lastRewriteFailed bool
+
+	snapshots          int64
+	lastSnapshot       time.Time
+	lastSnapshotFailed bool
+
+	stop chan struct{}
+	done chan struct{}
 }
 
-func NewWriter(filename string) (*Writer, error) {
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+// NewWriter opens the log in dir for appending, creating the directory and an empty
+// log if needed. Leftover files from an interrupted rotation or rewrite are removed.
+func NewWriter(dir string, opts Options) (*Writer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+
+	manifest, err := ReadManifest(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		manifest = &Manifest{FirstSegment: 1, ActiveSegment: 1}
+		err = writeManifest(dir, *manifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := removeUnreferenced(dir, *manifest); err != nil {
+		return nil, fmt.Errorf("failed to clean up WAL directory: %w", err)
+	}
+
+	var size int64
+	for _, name := range manifest.Files() {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			size += info.Size()
+		}
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, SegmentName(manifest.ActiveSegment)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Writer{
-		file: file,
-	}, nil
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.MaxRecordSize <= 0 {
+		opts.MaxRecordSize = DefaultMaxRecordSize
+	}
+
+	w := &Writer{
+		file:          file,
+		dir:           dir,
+		policy:        opts.Fsync,
+		segmentSize:   opts.SegmentSize,
+		maxRecordSize: opts.MaxRecordSize,
+		manifest:      *manifest,
+		activeSize:    info.Size(),
+		size:          size,
+		baseSize:      size,
+
+		// Like Redis' LASTSAVE, report the start time until the first snapshot
+		lastSnapshot: time.Now(),
+	}
+	w.synced = sync.NewCond(&w.mu)
+
+	if w.policy == FsyncEverySec {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.flushEverySec(w.stop)
+	}
+
+	return w, nil
 }
 
+// WriteCommand appends a command and waits until the fsync policy considers it durable.
 func (w *Writer) WriteCommand(cmd []string) error {
-	encoded := EncodeArray(cmd)
-	_, err := w.file.Write(encoded)
+	pos, err := w.Append(cmd)
+	if err != nil {
+		return err
+	}
+
+	return w.Sync(pos)
+}
+
+// Append writes a command to the log without waiting for it to become durable.
+// It returns the log position to pass to Sync; splitting the two lets callers
+// release their own locks before blocking on the disk.
+func (w *Writer) Append(cmd []string) (int64, error) {
+	encoded, err := w.encode(cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if w.syncErr != nil {
+		return 0, w.syncErr
+	}
+
+	if w.activeSize > 0 && w.activeSize+int64(len(encoded)) > w.segmentSize {
+		if err := w.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(encoded)
+	if w.written == w.durable && n > 0 {
+		w.pendingSince = time.Now()
+	}
+	w.written += int64(n)
+	w.activeSize += int64(n)
+	w.size += int64(n)
+	if err != nil {
+		return 0, err
+	}
+
+	return w.written, nil
+}
+
+// encode frames a command as a record, refusing one larger than the writer's limit.
+func (w *Writer) encode(cmd []string) ([]byte, error) {
+	record, err := EncodeRecord(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.checkSize(int64(len(record) - recordHeaderSize)); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// checkSize refuses a record payload larger than the writer's limit.
+func (w *Writer) checkSize(size int64) error {
+	if size > w.maxRecordSize {
+		return fmt.Errorf("%w: %d bytes exceeds the maximum of %d", ErrRecordTooLarge, size, w.maxRecordSize)
+	}
+	return nil
+}
+
+// Check returns the error Append would return for a record whose payload is at most
+// size bytes, without writing anything: the writer is closed, an earlier fsync
+// failed, or the record is over the size limit. Callers that apply a write before
+// logging it check first, so a write that cannot be logged is never applied. Append
+// may still fail on an I/O error that no check can foresee.
+func (w *Writer) Check(size int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return os.ErrClosed
+	}
+
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+
+	return w.checkSize(size)
+}
+
+// rotateLocked seals the active segment and starts the next one. The sealed segment
+// is fsynced first, so everything appended before the rotation is durable and any
+// Sync waiters can be released. It is called with w.mu held.
+func (w *Writer) rotateLocked() error {
+	for w.syncing {
+		w.synced.Wait()
+	}
+
+	if w.file == nil {
+		return os.ErrClosed
+	}
+
+	if err := w.file.Sync(); err != nil {
+		w.syncErr = fmt.Errorf("fsync failed: %w", err)
+		w.synced.Broadcast()
+		return w.syncErr
+	}
+	w.fsyncs++
+	w.durable = w.written
+	w.lastFsync = time.Now()
+	w.synced.Broadcast()
+
+	next := w.manifest
+	next.ActiveSegment++
+	path := filepath.Join(w.dir, SegmentName(next.ActiveSegment))
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
 	if err != nil {
+		return fmt.Errorf("failed to create WAL segment: %w", err)
+	}
+
+	if err := writeManifest(w.dir, next); err != nil {
+		file.Close()
+		os.Remove(path)
 		return err
 	}
 
-	// Force write to disk
-	return w.file.Sync()
+	w.file.Close()
+	w.file = file
+	w.manifest = next
+	w.activeSize = 0
+
+	return nil
 }
 
+// Sync blocks until everything up to pos is durable under FsyncAlways.
+// Whichever waiter finds no fsync in flight becomes the leader and syncs all data
+// written so far; everyone who appended in the meantime is covered by that one call.
+// Under the other policies Sync returns immediately.
+func (w *Writer) Sync(pos int64) error {
+	if w.policy != FsyncAlways {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.durable < pos {
+		if w.syncErr != nil {
+			return w.syncErr
+		}
+
+		if w.syncing {
+			w.synced.Wait()
+			continue
+		}
+
+		w.fsyncLocked()
+	}
+
+	return w.syncErr
+}
+
+// fsyncLocked flushes everything written so far. It is called with w.mu held and
+// drops the lock during the fsync so appends can continue in parallel.
+func (w *Writer) fsyncLocked() {
+	target := w.written
+	file := w.file
+	started := time.Now()
+	w.syncing = true
+	w.mu.Unlock()
+
+	err := file.Sync()
+
+	w.mu.Lock()
+	w.syncing = false
+	w.fsyncs++
+
+	if err != nil {
+		w.syncErr = fmt.Errorf("fsync failed: %w", err)
+	} else {
+		w.durable = target
+		w.lastFsync = time.Now()
+		// Anything still pending was written after this fsync captured its target
+		if w.written > w.durable {
+			w.pendingSince = started
+		}
+	}
+
+	w.synced.Broadcast()
+}
+
+// flushEverySec is the background flusher used by FsyncEverySec.
+func (w *Writer) flushEverySec(stop <-chan struct{}) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(everySecInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.written > w.durable && !w.syncing && w.syncErr == nil {
+				w.fsyncLocked()
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// Stats returns a point-in-time view of the writer's durability metrics.
+func (w *Writer) Stats() Stats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := Stats{
+		Policy:       w.policy,
+		WrittenBytes: w.written,
+		PendingBytes: w.written - w.durable,
+		LastFsync:    w.lastFsync,
+		Fsyncs:       w.fsyncs,
+
+		Size:               w.size,
+		BaseSize:           w.baseSize,
+		Segments:           int(w.manifest.ActiveSegment - w.manifest.FirstSegment + 1),
+		ActiveSegment:      w.manifest.ActiveSegment,
+		RewriteInProgress:  w.rewriting && w.rewriteFormat == BaseLog,
+		SnapshotInProgress: w.rewriting && w.rewriteFormat == BaseSnapshot,
+		Rewrites:           w.rewrites,
+		LastRewriteFailed:  w.lastRewriteFailed,
+		Snapshots:          w.snapshots,
+		LastSnapshot:       w.lastSnapshot,
+		LastSnapshotFailed: w.lastSnapshotFailed,
+	}
+
+	if stats.PendingBytes > 0 {
+		stats.FsyncLag = time.Since(w.pendingSince)
+	}
+
+	return stats
+}
+
+// Close stops the background flusher, makes any pending data durable and closes the file.
 func (w *Writer) Close() error {
-	if w.file != nil {
-		return w.file.Close()
+	w.mu.Lock()
+	if w.file == nil {
+		w.mu.Unlock()
+		return nil
+	}
+	stop := w.stop
+	w.stop = nil
+	w.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-w.done
 	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.syncing {
+		w.synced.Wait()
+	}
+
+	if w.file == nil {
+		return nil
+	}
+
+	var err error
+	if w.policy != FsyncNo && w.written > w.durable && w.syncErr == nil {
+		err = w.file.Sync()
+	}
+
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+
+	return err
+}
+
+// Rewrite builds a compacted base for the log while appends continue.
+// Beginning a rewrite rotates to a fresh segment, so the data written through
+// the Rewrite describes exactly the state before that segment. Once committed, the
+// base replaces every older file and recovery loads it followed by the segments
+// written since.
+type Rewrite struct {
+	w      *Writer
+	file   *os.File
+	buf    *bufio.Writer
+	format BaseFormat
+	seq    uint64 // First segment the new base does not cover
+	path   string // Temporary file the base is written to
+}
+
+// BeginRewrite starts a base made of WAL records, written with Rewrite.WriteCommand.
+// Callers must make sure no append lands between reading the state they are about to
+// write out and calling BeginRewrite, otherwise that append would be lost.
+func (w *Writer) BeginRewrite() (*Rewrite, error) {
+	return w.beginBase(BaseLog)
+}
+
+// BeginSnapshot starts a base holding a snapshot, written through Rewrite's io.Writer.
+// The same rule as for BeginRewrite applies to the state being written out.
+func (w *Writer) BeginSnapshot() (*Rewrite, error) {
+	return w.beginBase(BaseSnapshot)
+}
+
+// beginBase seals the active segment and creates the temporary file for a new base.
+// Only one base can be built at a time, whatever its format.
+func (w *Writer) beginBase(format BaseFormat) (*Rewrite, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil, os.ErrClosed
+	}
+
+	if w.rewriting && w.rewriteFormat == BaseSnapshot {
+		return nil, ErrSnapshotInProgress
+	}
+
+	if w.rewriting {
+		return nil, ErrRewriteInProgress
+	}
+
+	// An empty active segment already starts exactly where the base will end
+	if w.activeSize > 0 {
+		if err := w.rotateLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	seq := w.manifest.ActiveSegment
+	path := filepath.Join(w.dir, baseName(seq, format)+".tmp")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rewrite file: %w", err)
+	}
+
+	w.rewriting = true
+	w.rewriteFormat = format
+
+	return &Rewrite{w: w, file: file, buf: bufio.NewWriter(file), format: format, seq: seq, path: path}, nil
+}
+
+// WriteCommand adds a command to a log-format base.
+func (r *Rewrite) WriteCommand(cmd []string) error {
+	record, err := r.w.encode(cmd)
+	if err != nil {
+		return err
+	}
+	_, err = r.buf.Write(record)
+	return err
+}
+
+// Write adds raw bytes to the new base, letting snapshot encoders stream into it.
+func (r *Rewrite) Write(p []byte) (int, error) {
+	return r.buf.Write(p)
+}
+
+// Commit makes the new base durable, points the manifest at it and deletes the base
+// and segments it replaces. Appends are never blocked on the rewrite's own I/O; they
+// only wait while the manifest is swapped.
+func (r *Rewrite) Commit() error {
+	if err := r.buf.Flush(); err != nil {
+		r.Abort()
+		return fmt.Errorf("failed to write rewrite file: %w", err)
+	}
+
+	if err := r.file.Sync(); err != nil {
+		r.Abort()
+		return fmt.Errorf("failed to sync rewrite file: %w", err)
+	}
+
+	info, err := r.file.Stat()
+	if err != nil {
+		r.Abort()
+		return err
+	}
+
+	if err := r.file.Close(); err != nil {
+		r.Abort()
+		return err
+	}
+
+	w := r.w
+	name := baseName(r.seq, r.format)
+	if err := os.Rename(r.path, filepath.Join(w.dir, name)); err != nil {
+		r.Abort()
+		return fmt.Errorf("failed to install rewritten base: %w", err)
+	}
+	r.path = filepath.Join(w.dir, name)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		r.abortLocked()
+		return os.ErrClosed
+	}
+
+	next := w.manifest
+	next.Base = name
+	next.BaseFormat = r.format
+	next.FirstSegment = r.seq
+	if err := writeManifest(w.dir, next); err != nil {
+		r.abortLocked()
+		return err
+	}
+	w.manifest = next
+
+	freed, err := removeUnreferenced(w.dir, next)
+	w.size = w.size - freed + info.Size()
+	w.baseSize = w.size
+	w.rewriting = false
+	if r.format == BaseSnapshot {
+		w.snapshots++
+		w.lastSnapshot = time.Now()
+		w.lastSnapshotFailed = false
+	} else {
+		w.rewrites++
+		w.lastRewriteFailed = false
+	}
+
+	if err != nil {
+		return fmt.Errorf("rewrite committed but old WAL files could not be removed: %w", err)
+	}
+
 	return nil
 }
+
+// Abort discards the rewrite and keeps the existing base and segments.
+func (r *Rewrite) Abort() {
+	r.w.mu.Lock()
+	defer r.w.mu.Unlock()
+
+	r.abortLocked()
+}
+
+func (r *Rewrite) abortLocked() {
+	r.file.Close()
+	os.Remove(r.path)
+
+	r.w.rewriting = false
+	if r.format == BaseSnapshot {
+		r.w.lastSnapshotFailed = true
+	} else {
+		r.w.lastRewriteFailed = true
+	}
+}
+
+// syncDir fsyncs a directory so a rename inside it survives a crash.
+func syncDir(path string) {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
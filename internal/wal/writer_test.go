@@ -0,0 +1,260 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for _, name := range []string{"always", "everysec", "no"} {
+		policy, err := ParseFsyncPolicy(name)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", name, err)
+		}
+		if policy.String() != name {
+			t.Errorf("Expected %q to round-trip, got %q", name, policy.String())
+		}
+	}
+
+	if _, err := ParseFsyncPolicy("sometimes"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	writer, err := NewWriter(t.TempDir(), Options{Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer writer.Close()
+
+	const writers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := writer.WriteCommand([]string{"SET", "key", "value"}); err != nil {
+				t.Errorf("Failed to write command: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := writer.Stats()
+	if stats.PendingBytes != 0 {
+		t.Errorf("Expected every acknowledged write to be durable, got %d pending bytes", stats.PendingBytes)
+	}
+	if stats.Fsyncs == 0 || stats.Fsyncs > writers {
+		t.Errorf("Expected between 1 and %d fsyncs, got %d", writers, stats.Fsyncs)
+	}
+	t.Logf("%d concurrent writes committed with %d fsyncs", writers, stats.Fsyncs)
+}
+
+func TestNoFsyncReportsPendingBytes(t *testing.T) {
+	writer, err := NewWriter(t.TempDir(), Options{Fsync: FsyncNo})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer writer.Close()
+
+	cmd := []string{"SET", "key", "value"}
+	if err := writer.WriteCommand(cmd); err != nil {
+		t.Fatalf("Failed to write command: %v", err)
+	}
+
+	stats := writer.Stats()
+	if stats.PendingBytes != int64(len(encodeRecord(t, cmd))) {
+		t.Errorf("Expected %d pending bytes, got %d", len(encodeRecord(t, cmd)), stats.PendingBytes)
+	}
+	if stats.Fsyncs != 0 {
+		t.Errorf("Expected no fsyncs under the 'no' policy, got %d", stats.Fsyncs)
+	}
+	if stats.FsyncLag <= 0 {
+		t.Errorf("Expected a positive fsync lag while bytes are pending, got %v", stats.FsyncLag)
+	}
+}
+
+// readLog reads every command in the log in dir, following its manifest.
+func readLog(t *testing.T, dir string) [][]string {
+	t.Helper()
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+
+	var commands [][]string
+	for _, name := range manifest.Files() {
+		reader, err := NewReader(filepath.Join(dir, name), ReaderOptions{})
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", name, err)
+		}
+		for {
+			entry, err := reader.ReadEntry()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", name, err)
+			}
+			commands = append(commands, entry.Command)
+		}
+		reader.Close()
+	}
+	return commands
+}
+
+func TestSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	cmd := []string{"SET", "key", "value"}
+	recordSize := int64(len(encodeRecord(t, cmd)))
+
+	writer, err := NewWriter(dir, Options{Fsync: FsyncNo, SegmentSize: 4 * recordSize})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := writer.WriteCommand(cmd); err != nil {
+			t.Fatalf("Failed to write command: %v", err)
+		}
+	}
+
+	// 10 records at 4 per segment fill segments 1 and 2 and half of segment 3
+	stats := writer.Stats()
+	if stats.Segments != 3 || stats.ActiveSegment != 3 {
+		t.Errorf("Expected 3 segments with segment 3 active, got %d with %d active", stats.Segments, stats.ActiveSegment)
+	}
+	if stats.Size != 10*recordSize {
+		t.Errorf("Expected log size %d, got %d", 10*recordSize, stats.Size)
+	}
+	if stats.PendingBytes != 2*recordSize {
+		t.Errorf("Expected sealed segments to be fsynced, got %d pending bytes", stats.PendingBytes)
+	}
+	writer.Close()
+
+	// Reopening resumes appending to the active segment
+	writer, err = NewWriter(dir, Options{Fsync: FsyncNo, SegmentSize: 4 * recordSize})
+	if err != nil {
+		t.Fatalf("Failed to reopen writer: %v", err)
+	}
+	writer.WriteCommand(cmd)
+	writer.Close()
+
+	if got := len(readLog(t, dir)); got != 11 {
+		t.Errorf("Expected 11 commands across segments, got %d", got)
+	}
+
+	manifest, _ := ReadManifest(dir)
+	if manifest.FirstSegment != 1 || manifest.ActiveSegment != 3 {
+		t.Errorf("Expected manifest to list segments 1 to 3, got %+v", manifest)
+	}
+}
+
+func TestRewriteCarriesOverConcurrentAppends(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewWriter(dir, Options{Fsync: FsyncAlways})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer writer.Close()
+
+	for i := 0; i < 10; i++ {
+		writer.WriteCommand([]string{"SET", "counter", strconv.Itoa(i)})
+	}
+
+	rewrite, err := writer.BeginRewrite()
+	if err != nil {
+		t.Fatalf("Failed to begin rewrite: %v", err)
+	}
+
+	if _, err := writer.BeginRewrite(); !errors.Is(err, ErrRewriteInProgress) {
+		t.Errorf("Expected ErrRewriteInProgress for a second rewrite, got %v", err)
+	}
+
+	// Appended while the rewrite is running; lands in the segment after the base
+	writer.WriteCommand([]string{"SET", "during", "rewrite"})
+
+	rewrite.WriteCommand([]string{"SET", "counter", "9"})
+	if err := rewrite.Commit(); err != nil {
+		t.Fatalf("Failed to commit rewrite: %v", err)
+	}
+
+	// Appended after the commit; must follow the base on replay
+	writer.WriteCommand([]string{"DEL", "during"})
+
+	expected := [][]string{
+		{"SET", "counter", "9"},
+		{"SET", "during", "rewrite"},
+		{"DEL", "during"},
+	}
+
+	commands := readLog(t, dir)
+	if len(commands) != len(expected) {
+		t.Fatalf("Expected %d commands after rewrite, got %v", len(expected), commands)
+	}
+	for i, want := range expected {
+		if strings.Join(commands[i], " ") != strings.Join(want, " ") {
+			t.Errorf("Entry %d: expected %v, got %v", i, want, commands[i])
+		}
+	}
+
+	// The base replaces segment 1, which held the pre-rewrite history
+	manifest, _ := ReadManifest(dir)
+	if manifest.Base == "" || manifest.FirstSegment != 2 {
+		t.Errorf("Expected a base followed by segment 2, got %+v", manifest)
+	}
+	if _, err := os.Stat(filepath.Join(dir, SegmentName(1))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the covered segment to be deleted, got %v", err)
+	}
+
+	stats := writer.Stats()
+	if stats.Rewrites != 1 || stats.RewriteInProgress {
+		t.Errorf("Expected one completed rewrite, got %+v", stats)
+	}
+}
+
+func TestWriterMaxRecordSize(t *testing.T) {
+	dir := t.TempDir()
+	arg := strings.Repeat("x", 100)
+	fits := []string{arg, arg, arg}
+	limit := RecordSizeLimit(3, 100)
+	if want := int64(len(EncodeArray(fits))); limit != want {
+		t.Fatalf("Expected a limit of %d bytes for three 100-byte arguments, got %d", want, limit)
+	}
+
+	writer, err := NewWriter(dir, Options{MaxRecordSize: limit})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if _, err := writer.Append(fits); err != nil {
+		t.Fatalf("Expected a record at the limit to be appended, got %v", err)
+	}
+	if _, err := writer.Append([]string{arg, arg, arg + "x"}); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Expected ErrRecordTooLarge for a record over the limit, got %v", err)
+	}
+	writer.Close()
+
+	reader, err := NewReader(filepath.Join(dir, SegmentName(1)), ReaderOptions{MaxRecordSize: limit})
+	if err != nil {
+		t.Fatalf("Failed to open reader: %v", err)
+	}
+	defer reader.Close()
+	if entry, err := reader.ReadEntry(); err != nil || entry.Command[2] != fits[2] {
+		t.Errorf("Expected the record at the limit to be read back, got err %v", err)
+	}
+	if _, err := reader.ReadEntry(); err != io.EOF {
+		t.Errorf("Expected nothing after the accepted record, got %v", err)
+	}
+
+	if limit := RecordSizeLimit(1024*1024, 512<<20); limit != DefaultMaxRecordSize {
+		t.Errorf("Expected Redis' request limits to be capped at %d, got %d", int64(DefaultMaxRecordSize), limit)
+	}
+}
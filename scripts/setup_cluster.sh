@@ -13,6 +13,7 @@ BASE_TCP_PORT=6379
 BASE_HTTP_PORT=9080
 SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
 PIDS_FILE="$SCRIPT_DIR/cluster_pids.txt"
+DATA_ROOT="$(dirname "$SCRIPT_DIR")/data"
 
 # Colors for output
 RED='\033[0;31m'
@@ -62,8 +63,8 @@ for i in $(seq 0 $((NODES-1))); do
     
     echo -e "${YELLOW}📡 Starting node $((i+1))/${NODES} on TCP:$TCP_PORT HTTP:$HTTP_PORT${NC}"
     
-    # Start the node in background
-    "$BINARY_PATH" -port="$TCP_PORT" -http-port="$HTTP_PORT" &
+    # Start the node in background, each with its own data directory
+    "$BINARY_PATH" -port="$TCP_PORT" -http-port="$HTTP_PORT" -dir="$DATA_ROOT/node-$TCP_PORT" &
     NODE_PID=$!
     echo "$NODE_PID" >> "$PIDS_FILE"
     